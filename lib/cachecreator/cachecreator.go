@@ -6,6 +6,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/yayuyokitano/eggshellver/lib/eventbus"
 	"github.com/yayuyokitano/eggshellver/lib/logging"
 	"github.com/yayuyokitano/eggshellver/lib/queries"
 )
@@ -59,11 +60,12 @@ func completeCache(songs []queries.SongData, artists []queries.UserStub) (err er
 
 	time.Sleep(5 * time.Second) //a little wait because it otherwise seems to be a bit unreliable
 	fmt.Println("Writing songs to DB...")
-	n, err := queries.PostSongs(context.Background(), songs)
+	n, items, err := queries.PostSongs(context.Background(), songs)
 	if err != nil {
 		logging.FailCache(err)
 		return
 	}
+	eventbus.Publish(items)
 	logging.AddSongs(int(n))
 	logging.CompleteCache()
 	return
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/yayuyokitano/eggshellver/lib/eventbus"
 	"github.com/yayuyokitano/eggshellver/lib/logging"
 	"github.com/yayuyokitano/eggshellver/lib/queries"
 	"github.com/yayuyokitano/eggshellver/lib/router"
@@ -23,23 +24,25 @@ type LikedTracks struct {
 }
 
 func Post(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
-	var followedUsers []string
-	eggsID, se := router.AuthenticatePostRequest(r, b, &followedUsers)
+	eggsID, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
+	var followedUsers []string
+	err := json.Unmarshal(b, &followedUsers)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
 	}
 	if len(followedUsers) == 0 {
 		fmt.Fprint(w, 0)
 		return nil
 	}
 
-	n, err := queries.SubmitFollows(context.Background(), eggsID, followedUsers)
+	n, items, err := queries.SubmitFollows(context.Background(), eggsID, followedUsers)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
+	eventbus.Publish(items)
 	logging.AddFollows(int(n))
 	fmt.Fprint(w, n)
 	return nil
@@ -49,11 +52,17 @@ func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 	query := r.URL.Query()
 	followerIDs := queries.GetArray(query, "followerIDs")
 	followeeIDs := queries.GetArray(query, "followeeIDs")
-	paginator := queries.InitializePaginator(query)
+	paginator, err := queries.InitializePaginator(query)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
 	if len(followerIDs) == 0 && len(followeeIDs) == 0 {
 		return logging.SE(http.StatusBadRequest, errors.New("followerIDs and/or followeeIDs is required"))
 	}
-	follows, err := queries.GetFollows(context.Background(), followerIDs, followeeIDs, paginator)
+	follows, err := queries.GetFollows(context.Background(), followerIDs, followeeIDs, router.EggsID(r), paginator)
+	if errors.Is(err, queries.ErrInvalidCursor) {
+		return logging.SE(http.StatusBadRequest, err)
+	}
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
@@ -66,47 +75,53 @@ func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 }
 
 func Put(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
-	var follows []string
-	eggsID, se := router.AuthenticatePostRequest(r, b, &follows)
+	eggsID, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
+	var follows []string
+	err := json.Unmarshal(b, &follows)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
 	}
 	if len(follows) == 0 {
 		fmt.Fprint(w, 0)
 		return nil
 	}
 
-	delta, total, err := queries.PutFollows(context.Background(), eggsID, follows)
+	delta, total, items, err := queries.PutFollows(context.Background(), eggsID, follows)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
+	eventbus.Publish(items)
 	logging.AddFollows(int(delta))
 	fmt.Fprint(w, total)
 	return nil
 }
 
-func Toggle(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
-	var follow string
-	eggsID, se := router.AuthenticateIndividualPostRequest(r, b, &follow)
+func Toggle(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
-	}
-	if follow == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("follow is required"))
+	var follow string
+	se = router.PathParams(r, &follow)
+	if se != nil {
+		return se
 	}
 
-	isFollowing, err := queries.ToggleFollow(context.Background(), eggsID, follow)
+	isFollowing, addedTime, err := queries.ToggleFollow(context.Background(), eggsID, follow)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
 	if isFollowing {
 		logging.AddFollows(1)
+		eventbus.Publish([]queries.TimelineItem{{
+			ID:        eggsID,
+			Type:      "follow",
+			Target:    follow,
+			Timestamp: addedTime,
+		}})
 	} else {
 		logging.AddFollows(-1)
 	}
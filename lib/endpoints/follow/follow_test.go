@@ -209,6 +209,39 @@ func TestGet(t *testing.T) {
 
 }
 
+func TestGetPrivate(t *testing.T) {
+	services.Start()
+	defer services.Stop()
+
+	err := services.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer services.RollbackTransaction()
+
+	token, err := userendpoint.CreateTestUser(1)
+	if err != nil {
+		t.Error(err)
+	}
+
+	initUserStubs(t)
+
+	r := httptest.NewRequest("POST", "/follows", strings.NewReader(`["1","2"]`))
+	router.CommitMutating(t, r, Post, token, 2)
+
+	err = queries.PutPrivacySettings(context.Background(), os.Getenv("TESTUSER_ID"), queries.PrivacySettings{FollowsPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest("GET", fmt.Sprintf("/follows?followerIDs=%s", os.Getenv("TESTUSER_ID")), nil)
+	testHasFollowersFollowees(t, r, 0, 0, []string{}, []string{})
+
+	r = httptest.NewRequest("GET", fmt.Sprintf("/follows?followerIDs=%s", os.Getenv("TESTUSER_ID")), nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	testHasFollowersFollowees(t, r, 2, 2, []string{os.Getenv("TESTUSER_ID")}, []string{"1", "2"})
+}
+
 func TestPut(t *testing.T) {
 	services.Start()
 	defer services.Stop()
@@ -305,7 +338,7 @@ func TestToggle(t *testing.T) {
 func testHasFollowersFollowees(t *testing.T, r *http.Request, num int, total int64, followerIDs []string, followeeIDs []string) {
 	t.Helper()
 	w := httptest.NewRecorder()
-	router.HandleMethod(Get, w, r)
+	router.HandleAuthenticated(Get, router.Optional(queries.ScopeReadFollows), w, r)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Status code is %d, want %d, body %s", w.Code, http.StatusOK, w.Body.String())
@@ -8,19 +8,21 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/yayuyokitano/eggshellver/lib/eventbus"
 	"github.com/yayuyokitano/eggshellver/lib/logging"
 	"github.com/yayuyokitano/eggshellver/lib/queries"
 	"github.com/yayuyokitano/eggshellver/lib/router"
 )
 
 func Post(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
-	var likes queries.LikeTargetsFixed
-	eggsID, se := router.AuthenticatePostRequest(r, b, &likes)
+	eggsID, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
+	var likes queries.LikeTargetsFixed
+	err := json.Unmarshal(b, &likes)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
 	}
 	if len(likes.Targets) == 0 {
 		fmt.Fprint(w, 0)
@@ -30,10 +32,11 @@ func Post(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
 		return logging.SE(http.StatusBadRequest, errors.New("invalid likedTracks"))
 	}
 
-	n, err := queries.LikeObjects(context.Background(), eggsID, likes)
+	n, items, err := queries.LikeObjects(context.Background(), eggsID, likes)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
+	eventbus.Publish(items)
 	logging.AddLikes(int(n), likes.Type)
 	fmt.Fprint(w, n)
 	return nil
@@ -44,11 +47,17 @@ func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 	eggsIDs := queries.GetArray(query, "eggsIDs")
 	targetIDs := queries.GetArray(query, "targetIDs")
 	targetType := r.URL.Query().Get("targetType")
-	paginator := queries.InitializePaginator(query)
+	paginator, err := queries.InitializePaginator(query)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
 	if len(eggsIDs) == 0 && len(targetIDs) == 0 {
 		return logging.SE(http.StatusBadRequest, errors.New("eggsIDs and/or targetIDs is required"))
 	}
-	likedTracks, err := queries.GetLikedObjects(context.Background(), eggsIDs, targetIDs, targetType, paginator)
+	likedTracks, err := queries.GetLikedObjects(context.Background(), eggsIDs, targetIDs, targetType, router.EggsID(r), paginator)
+	if errors.Is(err, queries.ErrInvalidCursor) {
+		return logging.SE(http.StatusBadRequest, err)
+	}
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
@@ -61,13 +70,14 @@ func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 }
 
 func Put(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
-	var likes queries.LikeTargetsFixed
-	eggsID, se := router.AuthenticatePostRequest(r, b, &likes)
+	eggsID, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
+	var likes queries.LikeTargetsFixed
+	err := json.Unmarshal(b, &likes)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
 	}
 	if len(likes.Targets) == 0 {
 		fmt.Fprint(w, 0)
@@ -77,19 +87,24 @@ func Put(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
 		return logging.SE(http.StatusBadRequest, errors.New("invalid likes"))
 	}
 
-	delta, total, err := queries.PutLikes(context.Background(), eggsID, likes)
+	delta, total, items, err := queries.PutLikes(context.Background(), eggsID, likes)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
+	eventbus.Publish(items)
 	logging.AddLikes(int(delta), likes.Type)
 	fmt.Fprint(w, total)
 	return nil
 }
 
-func Toggle(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+func Toggle(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 	var targetID string
 	var targetType string
-	eggsID, se := router.AuthenticateIndividualPostRequest(r, b, &targetType, &targetID)
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	se = router.PathParams(r, &targetType, &targetID)
 	if se != nil {
 		return se
 	}
@@ -98,19 +113,17 @@ func Toggle(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
 		ID:   targetID,
 		Type: targetType,
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
-	}
 	if !target.IsValid() {
 		return logging.SE(http.StatusBadRequest, errors.New("invalid target"))
 	}
 
-	isLiking, err := queries.ToggleLike(context.Background(), eggsID, target)
+	isLiking, addedTime, err := queries.ToggleLike(context.Background(), eggsID, target)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
 	if isLiking {
 		logging.AddLikes(1, target.Type)
+		eventbus.Publish([]queries.TimelineItem{target.TimelineItem(eggsID, addedTime)})
 	} else {
 		logging.AddLikes(-1, target.Type)
 	}
@@ -240,6 +240,34 @@ func TestGet(t *testing.T) {
 		TargetID: trackLikeTarget.Targets[0].ID,
 	}})
 
+	r = httptest.NewRequest("GET", fmt.Sprintf("/likes?targetIDs=%s&limit=1&cursor=", trackLikeTarget.Targets[0].ID), nil)
+	cursor := testHasLikes(t, r, 1, 2, []queries.PartialLike{{
+		EggsID:   os.Getenv("TESTUSER_ID2"),
+		TargetID: trackLikeTarget.Targets[0].ID,
+	}})
+	if cursor == "" {
+		t.Errorf("Expected nextCursor to be set")
+	}
+
+	r = httptest.NewRequest("GET", fmt.Sprintf("/likes?targetIDs=%s&limit=1&cursor=%s", trackLikeTarget.Targets[0].ID, cursor), nil)
+	cursor = testHasLikes(t, r, 1, 2, []queries.PartialLike{{
+		EggsID:   os.Getenv("TESTUSER_ID"),
+		TargetID: trackLikeTarget.Targets[0].ID,
+	}})
+
+	r = httptest.NewRequest("GET", fmt.Sprintf("/likes?targetIDs=%s&limit=1&cursor=%s", trackLikeTarget.Targets[0].ID, cursor), nil)
+	cursor = testHasLikes(t, r, 0, 2, []queries.PartialLike{})
+	if cursor != "" {
+		t.Errorf("Expected nextCursor to be empty, got %s", cursor)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", fmt.Sprintf("/likes?targetIDs=%s&cursor=invalid", trackLikeTarget.Targets[0].ID), nil)
+	router.HandleMethod(Get, w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Status code is %d, want %d. Body %s", w.Code, http.StatusBadRequest, w.Body.String())
+	}
+
 	r = httptest.NewRequest("GET", fmt.Sprintf("/likes?targetIDs=%s", playlistLikeTarget.Targets[0].ID), nil)
 	testHasLikes(t, r, 1, 1, []queries.PartialLike{{
 		EggsID:   os.Getenv("TESTUSER_ID"),
@@ -410,7 +438,7 @@ func testHasLikedIDs(t *testing.T, r *http.Request, num int, total int64, eggsID
 	testHasLikes(t, r, num, total, expectedLikes)
 }
 
-func testHasLikes(t *testing.T, r *http.Request, num int, total int64, expectedLikes []queries.PartialLike) {
+func testHasLikes(t *testing.T, r *http.Request, num int, total int64, expectedLikes []queries.PartialLike) (nextCursor string) {
 	t.Helper()
 	w := httptest.NewRecorder()
 	router.HandleMethod(Get, w, r)
@@ -435,4 +463,5 @@ func testHasLikes(t *testing.T, r *http.Request, num int, total int64, expectedL
 			t.Errorf("Expected slice to include like %v", like)
 		}
 	}
+	return likes.NextCursor
 }
@@ -0,0 +1,68 @@
+package notificationendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+	"github.com/yayuyokitano/eggshellver/lib/router"
+)
+
+// Get lists the user's notifications, newest first, with their unread count.
+// Only unread notifications are listed with unread=true.
+func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	query := r.URL.Query()
+	paginator, err := queries.InitializePaginator(query)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	page, err := queries.GetNotifications(context.Background(), eggsID, query.Get("unread") == "true", paginator)
+	if errors.Is(err, queries.ErrInvalidCursor) {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+
+	b, err := json.Marshal(page)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
+
+// MarkRead marks the notifications with the IDs in the body as read, or all of
+// the user's notifications if there is no body. It returns how many were unread.
+func MarkRead(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	var ids []int64
+	if len(b) > 0 {
+		err := json.Unmarshal(b, &ids)
+		if err != nil {
+			return logging.SE(http.StatusBadRequest, err)
+		}
+		if ids == nil {
+			ids = []int64{}
+		}
+	}
+
+	n, err := queries.MarkNotificationsRead(context.Background(), eggsID, ids)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	fmt.Fprint(w, n)
+	return nil
+}
@@ -8,29 +8,32 @@ import (
 	"io"
 	"net/http"
 
+	"github.com/yayuyokitano/eggshellver/lib/eventbus"
 	"github.com/yayuyokitano/eggshellver/lib/logging"
 	"github.com/yayuyokitano/eggshellver/lib/queries"
 	"github.com/yayuyokitano/eggshellver/lib/router"
 )
 
 func Post(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
-	var playlists []queries.PlaylistInput
-	eggsID, se := router.AuthenticatePostRequest(r, b, &playlists)
+	eggsID, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
+	var playlists []queries.PlaylistInput
+	err := json.Unmarshal(b, &playlists)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
 	}
 	if len(playlists) == 0 {
 		fmt.Fprint(w, 0)
 		return nil
 	}
 
-	inserted, updated, err := queries.PostPlaylists(context.Background(), eggsID, playlists)
+	inserted, updated, items, err := queries.PostPlaylists(context.Background(), eggsID, playlists)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
+	eventbus.Publish(items)
 	logging.AddPlaylists(int(inserted))
 	fmt.Fprint(w, inserted+updated)
 	return nil
@@ -40,11 +43,17 @@ func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 	query := r.URL.Query()
 	eggsIDs := queries.GetArray(query, "eggsIDs")
 	playlistIDs := queries.GetArray(query, "playlistIDs")
-	paginator := queries.InitializePaginator(query)
+	paginator, err := queries.InitializePaginator(query)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
 	if len(eggsIDs) == 0 && len(playlistIDs) == 0 {
 		return logging.SE(http.StatusBadRequest, errors.New("eggsIDs and/or playlistIDs is required"))
 	}
-	playlists, err := queries.GetPlaylists(context.Background(), eggsIDs, playlistIDs, paginator)
+	playlists, err := queries.GetPlaylists(context.Background(), eggsIDs, playlistIDs, router.EggsID(r), paginator)
+	if errors.Is(err, queries.ErrInvalidCursor) {
+		return logging.SE(http.StatusBadRequest, err)
+	}
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
@@ -57,14 +66,11 @@ func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 }
 
 func Delete(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
-	var deletedPlaylists []string
-	eggsID, se := router.AuthenticateDeleteRequest(r, &deletedPlaylists)
+	eggsID, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
-	}
+	deletedPlaylists := queries.GetArray(r.URL.Query(), "target")
 	if len(deletedPlaylists) == 0 {
 		fmt.Fprint(w, 0)
 		return nil
@@ -80,23 +86,25 @@ func Delete(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 }
 
 func Put(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
-	var playlists queries.PlaylistInputs
-	eggsID, se := router.AuthenticatePostRequest(r, b, &playlists)
+	eggsID, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
-	if eggsID == "" {
-		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
+	var playlists queries.PlaylistInputs
+	err := json.Unmarshal(b, &playlists)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
 	}
 	if len(playlists) == 0 {
 		fmt.Fprint(w, 0)
 		return nil
 	}
 
-	delta, total, err := queries.PutPlaylists(context.Background(), eggsID, playlists)
+	delta, total, items, err := queries.PutPlaylists(context.Background(), eggsID, playlists)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
+	eventbus.Publish(items)
 	logging.AddPlaylists(int(delta))
 	fmt.Fprint(w, total)
 	return nil
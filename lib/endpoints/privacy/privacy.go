@@ -0,0 +1,54 @@
+package privacyendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+	"github.com/yayuyokitano/eggshellver/lib/router"
+)
+
+// Get returns the user's privacy settings.
+func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	settings, err := queries.GetPrivacySettings(context.Background(), eggsID)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
+
+// Put replaces the user's privacy settings. Settings left out of the body are
+// turned off.
+func Put(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	var settings queries.PrivacySettings
+	err := json.Unmarshal(b, &settings)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	err = queries.PutPrivacySettings(context.Background(), eggsID, settings)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	b, err = json.Marshal(settings)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
@@ -0,0 +1,44 @@
+package roomendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+	"github.com/yayuyokitano/eggshellver/lib/router"
+)
+
+// GetHistory lists the rooms a user has hosted that the viewer may see, with the
+// tracks played in each.
+func GetHistory(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	query := r.URL.Query()
+	eggsID := query.Get("eggsID")
+	paginator, err := queries.InitializePaginator(query)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	if eggsID == "" {
+		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
+	}
+	sessions, nextCursor, err := queries.GetRoomSessions(context.Background(), eggsID, router.EggsID(r), paginator)
+	if errors.Is(err, queries.ErrInvalidCursor) {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+
+	b, err := json.Marshal(queries.RoomSessionPage{
+		Sessions:   sessions,
+		NextCursor: nextCursor,
+	})
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
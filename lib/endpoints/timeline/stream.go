@@ -0,0 +1,142 @@
+package timeline
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/eventbus"
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// Time between comments keeping idle streams open through proxies.
+const keepAlivePeriod = 30 * time.Second
+
+// Stream pushes new items on the user's timeline as server-sent events. A client
+// reconnecting with Last-Event-ID gets the items it missed, or a reset event if
+// they are no longer known, after which it should reload the timeline. Users
+// the streaming user follows after connecting are picked up straight away,
+// while unfollows and privacy changes take effect on the next connection.
+func Stream(w http.ResponseWriter, r *http.Request) *logging.StatusError {
+	eggsID := r.URL.Query().Get("eggsID")
+	if eggsID == "" {
+		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return logging.SE(http.StatusInternalServerError, errors.New("streaming is not supported"))
+	}
+	viewerID, se := authorize(r, eggsID)
+	if se != nil {
+		return se
+	}
+
+	sub, backlog, resumed, cancel := eventbus.Subscribe(r.Header.Get("Last-Event-ID"))
+	defer cancel()
+	followees, err := queries.GetFolloweeIDs(context.Background(), eggsID)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	stream := newTimelineStream(eggsID, viewerID, followees)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if !resumed {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range backlog {
+		err = stream.write(w, event)
+		if err != nil {
+			return nil
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(keepAlivePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case event, ok := <-sub:
+			if !ok {
+				return nil
+			}
+			err = stream.write(w, event)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+		}
+		if err != nil {
+			return nil
+		}
+		flusher.Flush()
+	}
+}
+
+// timelineStream picks out the items on one user's timeline that the viewer may
+// see.
+type timelineStream struct {
+	eggsID   string
+	viewerID string
+	followed map[string]bool
+	privacy  map[string]queries.PrivacySettings
+}
+
+func newTimelineStream(eggsID string, viewerID string, followees []string) *timelineStream {
+	followed := make(map[string]bool, len(followees))
+	for _, followee := range followees {
+		followed[followee] = true
+	}
+	return &timelineStream{
+		eggsID:   eggsID,
+		viewerID: viewerID,
+		followed: followed,
+		privacy:  make(map[string]queries.PrivacySettings),
+	}
+}
+
+// accepts reports whether the item belongs on the timeline, and keeps track of
+// who the user follows.
+func (s *timelineStream) accepts(item queries.TimelineItem) bool {
+	if item.Type == "follow" && item.ID == s.eggsID {
+		s.followed[item.Target] = true
+	}
+	if !s.followed[item.ID] {
+		return false
+	}
+	if item.ID == s.viewerID {
+		return true
+	}
+	settings, ok := s.privacy[item.ID]
+	if !ok {
+		var err error
+		settings, err = queries.GetPrivacySettings(context.Background(), item.ID)
+		if err != nil {
+			logging.WebsocketError(err)
+			return false
+		}
+		s.privacy[item.ID] = settings
+	}
+	return !settings.Hides(item.Type)
+}
+
+func (s *timelineStream) write(w io.Writer, event eventbus.Event) error {
+	if !s.accepts(event.Item) {
+		return nil
+	}
+	b, err := json.Marshal(event.Item)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.ID, b)
+	return err
+}
@@ -4,25 +4,130 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/yayuyokitano/eggshellver/lib/logging"
 	"github.com/yayuyokitano/eggshellver/lib/queries"
+	"github.com/yayuyokitano/eggshellver/lib/router"
 )
 
+// parseFilter reads the types and actors to include, the since and until
+// RFC 3339 timestamps, and includeSelf.
+func parseFilter(query url.Values) (filter queries.TimelineFilter, err error) {
+	filter.Types = queries.GetArray(query, "types")
+	filter.Actors = queries.GetArray(query, "actors")
+	filter.IncludeSelf = query.Get("includeSelf") == "true"
+	filter.Since, err = parseTime(query, "since")
+	if err != nil {
+		return
+	}
+	filter.Until, err = parseTime(query, "until")
+	return
+}
+
+func parseTime(query url.Values, key string) (*time.Time, error) {
+	if query.Get(key) == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, query.Get(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s, expected an RFC 3339 timestamp", key)
+	}
+	return &t, nil
+}
+
+// authorize returns who is reading the timeline of eggsID. The timeline gives
+// away who its owner follows, so only they can read it if that is private.
+func authorize(r *http.Request, eggsID string) (viewerID string, se *logging.StatusError) {
+	viewerID = router.EggsID(r)
+	if viewerID == eggsID {
+		return
+	}
+	settings, err := queries.GetPrivacySettings(context.Background(), eggsID)
+	if err != nil {
+		se = logging.SE(http.StatusInternalServerError, err)
+		return
+	}
+	if settings.FollowsPrivate {
+		se = logging.SE(http.StatusForbidden, errors.New("timeline is private"))
+	}
+	return
+}
+
+// Get returns a page of the user's timeline. With expand=users and/or
+// expand=targets, items come with the user behind them and what they are about.
+// With aggregate=true, runs of the same action by the same user are grouped.
+// See parseFilter for narrowing the timeline down.
 func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 	query := r.URL.Query()
 	eggsID := query.Get("eggsID")
-	paginator := queries.InitializePaginator(query)
+	paginator, err := queries.InitializePaginator(query)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
 	if eggsID == "" {
 		return logging.SE(http.StatusBadRequest, errors.New("eggsID is required"))
 	}
-	timeline, err := queries.GetTimeline(context.Background(), eggsID, paginator.Offset, paginator.Limit)
+	var expandUsers, expandTargets bool
+	for _, expand := range queries.GetArray(query, "expand") {
+		switch expand {
+		case "users":
+			expandUsers = true
+		case "targets":
+			expandTargets = true
+		default:
+			return logging.SE(http.StatusBadRequest, fmt.Errorf("cannot expand %q, expected users and/or targets", expand))
+		}
+	}
+	aggregate := query.Get("aggregate") == "true"
+	filter, err := parseFilter(query)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	viewerID, se := authorize(r, eggsID)
+	if se != nil {
+		return se
+	}
+
+	timeline, nextCursor, err := queries.GetTimeline(context.Background(), eggsID, viewerID, filter, paginator)
+	if errors.Is(err, queries.ErrInvalidCursor) || errors.Is(err, queries.ErrInvalidTimelineType) {
+		return logging.SE(http.StatusBadRequest, err)
+	}
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
-	b, err := json.Marshal(timeline)
+
+	// Older clients page with offset and expect a bare array.
+	var b []byte
+	if expandUsers || expandTargets || aggregate {
+		items := queries.GroupTimeline(timeline, aggregate)
+		err = queries.ExpandTimeline(context.Background(), items, expandUsers, expandTargets)
+		if err != nil {
+			return logging.SE(http.StatusInternalServerError, err)
+		}
+		if paginator.IsCursor() {
+			b, err = json.Marshal(queries.ExpandedTimelinePage{
+				Items:      items,
+				NextCursor: nextCursor,
+			})
+		} else {
+			b, err = json.Marshal(items)
+		}
+	} else if paginator.IsCursor() {
+		if timeline == nil {
+			timeline = []queries.TimelineItem{}
+		}
+		b, err = json.Marshal(queries.TimelinePage{
+			Items:      timeline,
+			NextCursor: nextCursor,
+		})
+	} else {
+		b, err = json.Marshal(timeline)
+	}
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
@@ -0,0 +1,100 @@
+package userendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+	"github.com/yayuyokitano/eggshellver/lib/router"
+)
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// PostSession logs the user in like Post, and returns the session with both of
+// its tokens.
+func PostSession(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+	tokens, se := login(b)
+	if se != nil {
+		return se
+	}
+	return writeTokens(w, tokens)
+}
+
+// RefreshSession replaces the tokens of the session with the refresh token in
+// the body.
+func RefreshSession(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+	var refresh RefreshRequest
+	err := json.Unmarshal(b, &refresh)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	if refresh.RefreshToken == "" {
+		return logging.SE(http.StatusBadRequest, errors.New("refreshToken is required"))
+	}
+	tokens, err := queries.RefreshSession(context.Background(), refresh.RefreshToken)
+	if errors.Is(err, queries.ErrInvalidRefreshToken) {
+		return logging.SE(http.StatusUnauthorized, err)
+	}
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	return writeTokens(w, tokens)
+}
+
+func writeTokens(w io.Writer, tokens queries.SessionTokens) *logging.StatusError {
+	b, err := json.Marshal(tokens)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
+
+// GetSessions lists the devices the user is logged in on.
+func GetSessions(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	sessions, err := queries.GetSessions(context.Background(), eggsID)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	b, err := json.Marshal(sessions)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
+
+// DeleteSession logs the user out of the session in the path.
+func DeleteSession(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	var sessionIDString string
+	se = router.PathParams(r, &sessionIDString)
+	if se != nil {
+		return se
+	}
+	sessionID, err := strconv.ParseInt(sessionIDString, 10, 64)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, errors.New("invalid session ID"))
+	}
+	n, err := queries.DeleteSession(context.Background(), eggsID, sessionID)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	fmt.Fprint(w, n)
+	return nil
+}
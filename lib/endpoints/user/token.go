@@ -0,0 +1,106 @@
+package userendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+	"github.com/yayuyokitano/eggshellver/lib/router"
+)
+
+type TokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Seconds the token works for. It works until it is revoked if this is 0.
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// PostToken creates an access token limited to the scopes in the body. The token
+// is only returned this once.
+func PostToken(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	var request TokenRequest
+	err := json.Unmarshal(b, &request)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	if request.Name == "" {
+		return logging.SE(http.StatusBadRequest, errors.New("name is required"))
+	}
+	if len(request.Scopes) == 0 {
+		return logging.SE(http.StatusBadRequest, errors.New("at least one scope is required"))
+	}
+	if request.ExpiresIn < 0 {
+		return logging.SE(http.StatusBadRequest, errors.New("expiresIn cannot be negative"))
+	}
+	var expires *time.Time
+	if request.ExpiresIn > 0 {
+		t := time.Now().Add(time.Duration(request.ExpiresIn) * time.Second)
+		expires = &t
+	}
+
+	token, err := queries.CreateAccessToken(context.Background(), eggsID, request.Name, request.Scopes, expires)
+	if errors.Is(err, queries.ErrInvalidScope) {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	b, err = json.Marshal(token)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
+
+// GetTokens lists the user's access tokens, without the tokens themselves.
+func GetTokens(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	tokens, err := queries.GetAccessTokens(context.Background(), eggsID)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	b, err := json.Marshal(tokens)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
+
+// DeleteToken revokes the access token in the path.
+func DeleteToken(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	var tokenIDString string
+	se = router.PathParams(r, &tokenIDString)
+	if se != nil {
+		return se
+	}
+	tokenID, err := strconv.ParseInt(tokenIDString, 10, 64)
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, errors.New("invalid token ID"))
+	}
+	n, err := queries.DeleteAccessToken(context.Background(), eggsID, tokenID)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	fmt.Fprint(w, n)
+	return nil
+}
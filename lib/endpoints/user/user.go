@@ -42,18 +42,38 @@ func Get(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 	return nil
 }
 
+// Post logs the user in on their device with their eggs credentials, and
+// returns the session token. See PostSession for the refresh token.
 func Post(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+	tokens, se := login(b)
+	if se != nil {
+		return se
+	}
+	fmt.Fprint(w, `"`+tokens.Token+`"`)
+	return nil
+}
+
+// login checks the eggs credentials in b, and starts a session on the device
+// they are from.
+func login(b []byte) (tokens queries.SessionTokens, se *logging.StatusError) {
 	var auth Auth
 	err := json.Unmarshal(b, &auth)
 	if err != nil {
-		return logging.SE(http.StatusBadRequest, err)
+		se = logging.SE(http.StatusBadRequest, err)
+		return
+	}
+	// Sessions are per device, so logins without one would replace each other.
+	if auth.DeviceID == "" {
+		se = logging.SE(http.StatusBadRequest, errors.New("deviceId is required"))
+		return
 	}
 
 	client := &http.Client{Timeout: 1 * time.Minute}
 	req, err := http.NewRequest("GET", "https://api-flmg.eggs.mu/v1/users/users/profile", nil)
 	t := time.Now()
 	if err != nil {
-		return logging.SE(http.StatusInternalServerError, err)
+		se = logging.SE(http.StatusInternalServerError, err)
+		return
 	}
 	req.Header.Set("Authorization", auth.Authorization)
 	req.Header.Set("User-Agent", auth.UserAgent)
@@ -66,65 +86,65 @@ func Post(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
 	resp, err := client.Do(req)
 	if err != nil {
 		logging.LogFetchErrored(req, resp)
-		return logging.SE(http.StatusInternalServerError, err)
+		se = logging.SE(http.StatusInternalServerError, err)
+		return
 	}
 	defer resp.Body.Close()
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
 		logging.LogFetchErrored(req, resp)
-		return logging.SE(http.StatusInternalServerError, err)
+		se = logging.SE(http.StatusInternalServerError, err)
+		return
 	}
 
 	logging.LogFetchCompleted(resp, respBody, t)
 
 	if resp.StatusCode == http.StatusUnauthorized {
-		return logging.SE(http.StatusUnauthorized, errors.New("unauthorized"))
+		se = logging.SE(http.StatusUnauthorized, errors.New("unauthorized"))
+		return
 	}
 
 	var userRaw queries.UserRaw
 	err = json.Unmarshal(respBody, &userRaw)
 	if err != nil {
-		return logging.SE(http.StatusInternalServerError, err)
+		se = logging.SE(http.StatusInternalServerError, err)
+		return
 	}
 	user := userRaw.User()
 	if !user.IsValid() {
-		return logging.SE(http.StatusUnauthorized, errors.New("invalid user"))
+		se = logging.SE(http.StatusUnauthorized, errors.New("invalid user"))
+		return
 	}
 
-	eggsID, token, err := queries.GetUserCredentials(context.Background(), user)
+	eggsID, hasSession, err := queries.GetUserAuthStatus(context.Background(), user)
 	if err != nil && err.Error() != "no rows in result set" {
-		return logging.SE(http.StatusInternalServerError, err)
+		se = logging.SE(http.StatusInternalServerError, err)
+		return
 	}
 
 	if eggsID == "" {
-		token, err = generateToken()
-		if err != nil {
-			return logging.SE(http.StatusInternalServerError, err)
-		}
-		err = queries.InsertUser(context.Background(), user, token)
+		err = queries.InsertUser(context.Background(), user)
 		if err != nil {
-			return logging.SE(http.StatusInternalServerError, err)
-		}
-	}
-
-	if token == "" {
-		token, err = generateToken()
-		if err != nil {
-			return logging.SE(http.StatusInternalServerError, err)
-		}
-		err = queries.UpdateUserToken(context.Background(), user, token)
-		if err != nil {
-			return logging.SE(http.StatusInternalServerError, err)
+			se = logging.SE(http.StatusInternalServerError, err)
+			return
 		}
 	}
 
 	err = queries.UpdateUserDetails(context.Background(), user)
 	if err != nil {
-		return logging.SE(http.StatusInternalServerError, err)
+		se = logging.SE(http.StatusInternalServerError, err)
+		return
 	}
 
-	fmt.Fprint(w, `"`+token+`"`)
-	return nil
+	tokens, err = queries.StartSession(context.Background(), user.EggsID, auth.DeviceID, auth.DeviceName)
+	if err != nil {
+		se = logging.SE(http.StatusInternalServerError, err)
+		return
+	}
+	if !hasSession {
+		logging.AddAuthenticatedUsers(1)
+	}
+	return
 }
 
 func Delete(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
@@ -133,7 +153,7 @@ func Delete(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 		return logging.SE(http.StatusBadRequest, errors.New("no user specified"))
 	}
 
-	tokenAccount, se := router.AuthenticateRequestOnly(r)
+	tokenAccount, se := router.RequireUser(r)
 	if se != nil {
 		return se
 	}
@@ -150,9 +170,3 @@ func Delete(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 	w.Write([]byte(`"Successfully deleted user ` + eggsid + `"`))
 	return nil
 }
-
-func generateToken() (token string, err error) {
-	token, err = queries.GenerateRandomString(64)
-	logging.AddAuthenticatedUsers(1)
-	return
-}
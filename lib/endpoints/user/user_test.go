@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -57,6 +58,24 @@ func TestPost(t *testing.T) {
 		t.Errorf("Status code is %d, want %d", w.Code, http.StatusUnauthorized)
 	}
 
+	b, err = json.Marshal(Auth{
+		Authorization: os.Getenv("TESTUSER_AUTHORIZATION"),
+		UserAgent:     os.Getenv("TESTUSER_USERAGENT"),
+		ApVersion:     os.Getenv("TESTUSER_APVERSION"),
+		DeviceName:    os.Getenv("TESTUSER_DEVICENAME"),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/users", bytes.NewReader(b))
+	router.HandleMethod(Post, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Status code without a device is %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
 	b, err = json.Marshal(Auth{
 		Authorization: os.Getenv("TESTUSER_AUTHORIZATION"),
 		UserAgent:     os.Getenv("TESTUSER_USERAGENT"),
@@ -98,8 +117,13 @@ func TestPost(t *testing.T) {
 		t.Errorf("Status code is %d, want %d. Body %s", w.Code, http.StatusOK, w.Body.String())
 	}
 
-	if token != w.Body.String() {
-		t.Errorf("Token is %s, want %s", token, w.Body.String())
+	if token == w.Body.String() {
+		t.Errorf("Token is still %s after logging in again", token)
+	}
+
+	_, err = queries.GetEggsIDByToken(context.Background(), token[1:len(token)-1])
+	if err == nil {
+		t.Errorf("Replaced token still works")
 	}
 
 	token = w.Body.String()
@@ -210,6 +234,162 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestSessions(t *testing.T) {
+	services.Start()
+	defer services.Stop()
+
+	err := services.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer services.RollbackTransaction()
+
+	b, err := json.Marshal(Auth{
+		Authorization: os.Getenv("TESTUSER_AUTHORIZATION"),
+		UserAgent:     os.Getenv("TESTUSER_USERAGENT"),
+		ApVersion:     os.Getenv("TESTUSER_APVERSION"),
+		DeviceID:      os.Getenv("TESTUSER_DEVICEID"),
+		DeviceName:    os.Getenv("TESTUSER_DEVICENAME"),
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/sessions", bytes.NewReader(b))
+	router.HandleMethod(PostSession, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code is %d, want %d. Body %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var tokens queries.SessionTokens
+	err = json.Unmarshal(w.Body.Bytes(), &tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokens.Token == "" || tokens.RefreshToken == "" {
+		t.Errorf("Tokens are missing from %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/sessions/refresh", strings.NewReader(fmt.Sprintf(`{"refreshToken":"%s"}`, tokens.RefreshToken)))
+	router.HandleMethod(RefreshSession, w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code is %d, want %d. Body %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var refreshed queries.SessionTokens
+	err = json.Unmarshal(w.Body.Bytes(), &refreshed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed.ID != tokens.ID || refreshed.Token == tokens.Token {
+		t.Errorf("Refreshing session %d gave session %d with token %s", tokens.ID, refreshed.ID, refreshed.Token)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/sessions/refresh", strings.NewReader(fmt.Sprintf(`{"refreshToken":"%s"}`, tokens.RefreshToken)))
+	router.HandleMethod(RefreshSession, w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Status code for reused refresh token is %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/sessions", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", refreshed.Token))
+	router.HandleAuthenticated(GetSessions, router.Required(queries.ScopeAccountManage), w, r)
+	var sessions []queries.UserSession
+	err = json.Unmarshal(w.Body.Bytes(), &sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].ID != tokens.ID {
+		t.Errorf("Sessions are %s, want only session %d", w.Body.String(), tokens.ID)
+	}
+
+	r = httptest.NewRequest("DELETE", fmt.Sprintf("/sessions/%d", tokens.ID), nil)
+	router.CommitMutating(t, r, DeleteSession, refreshed.Token, 1)
+
+	_, err = queries.GetEggsIDByToken(context.Background(), refreshed.Token)
+	if err == nil {
+		t.Errorf("Token of deleted session still works")
+	}
+}
+
+func TestTokens(t *testing.T) {
+	services.Start()
+	defer services.Stop()
+
+	err := services.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer services.RollbackTransaction()
+
+	sessionToken, err := CreateTestUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/tokens", strings.NewReader(`{"name":"stats","scopes":["account:manage"]}`))
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sessionToken))
+	router.HandleAuthenticated(PostToken, router.Required(queries.ScopeAccountManage), w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Status code for ungrantable scope is %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/tokens", strings.NewReader(`{"name":"stats","scopes":["read:likes"]}`))
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sessionToken))
+	router.HandleAuthenticated(PostToken, router.Required(queries.ScopeAccountManage), w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code is %d, want %d. Body %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var token queries.NewAccessToken
+	err = json.Unmarshal(w.Body.Bytes(), &token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token == "" {
+		t.Errorf("Token is missing from %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/tokens", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.Token))
+	router.HandleAuthenticated(GetTokens, router.Required(queries.ScopeAccountManage), w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status code for access token listing tokens is %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("DELETE", "/users", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token.Token))
+	router.HandleAuthenticated(Delete, router.Required(queries.ScopeAccountDelete), w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status code for deleting user without scope is %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/tokens", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sessionToken))
+	router.HandleAuthenticated(GetTokens, router.Required(queries.ScopeAccountManage), w, r)
+	var tokens []queries.AccessToken
+	err = json.Unmarshal(w.Body.Bytes(), &tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].ID != token.ID {
+		t.Errorf("Tokens are %s, want only token %d", w.Body.String(), token.ID)
+	}
+
+	r = httptest.NewRequest("DELETE", fmt.Sprintf("/tokens/%d", token.ID), nil)
+	router.CommitMutating(t, r, DeleteToken, sessionToken, 1)
+
+	_, err = queries.GetEggsIDByToken(context.Background(), token.Token)
+	if err == nil {
+		t.Errorf("Deleted token still works")
+	}
+}
+
 func testHasUsers(t *testing.T, r *http.Request, num int, expectedUsers []string) {
 	t.Helper()
 	w := httptest.NewRecorder()
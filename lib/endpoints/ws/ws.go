@@ -1,68 +1,254 @@
 package wsendpoint
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/yayuyokitano/eggshellver/lib/hub"
 	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/notifications"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
 	"github.com/yayuyokitano/eggshellver/lib/router"
 )
 
+type History struct {
+	Messages   []hub.AuthedMessage `json:"messages"`
+	NextCursor string              `json:"nextCursor,omitempty"`
+}
+
+type InviteRequest struct {
+	// Seconds the invite stays valid for
+	TTL int64 `json:"ttl"`
+}
+
+type Invite struct {
+	Code    string    `json:"code"`
+	Expires time.Time `json:"expires"`
+}
+
+type Ticket struct {
+	Ticket  string    `json:"ticket"`
+	Expires time.Time `json:"expires"`
+}
+
+// Default time an invite link stays valid for.
+const defaultInviteTTL = 24 * time.Hour
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    hub.Subprotocols,
 	CheckOrigin: func(r *http.Request) bool {
 		return true //firefox doesn't allow me to do a proper check, as it sends a null origin
 	},
 }
 
+// Establish joins the room at /ws/join/{room}.
 func Establish(w http.ResponseWriter, r *http.Request) *logging.StatusError {
-	userSplit := strings.Split(r.URL.Path, "/")
-	room := userSplit[len(userSplit)-2]
+	room := pathSegment(r, 3)
 	if room == "" {
 		return logging.SE(http.StatusBadRequest, errors.New("please specify room to join"))
 	}
 
-	userStub, se := router.UserStubFromToken(r)
+	userStub, se := router.AuthenticateWebsocket(r, queries.ScopeRoomsJoin)
 	if se != nil {
 		return se
 	}
+	return join(w, r, room, userStub)
+}
 
-	targetHub := hub.GetHub(room)
+func pathSegment(r *http.Request, i int) string {
+	pathSplit := strings.Split(r.URL.Path, "/")
+	if len(pathSplit) <= i {
+		return ""
+	}
+	return pathSplit[i]
+}
+
+// checkAccess returns an error if eggsID is blocked from the room of owner, or
+// check does not let them in with the invite in the query.
+func checkAccess(r *http.Request, owner string, eggsID string, check func(ctx context.Context, user string, invite string) error) *logging.StatusError {
+	if eggsID != "" && eggsID != owner {
+		blocked, err := queries.IsBlocked(r.Context(), owner, eggsID)
+		if err != nil {
+			return logging.SE(http.StatusInternalServerError, err)
+		}
+		if blocked {
+			return logging.SE(http.StatusForbidden, errors.New("you are blocked from this room"))
+		}
+	}
+
+	err := check(r.Context(), eggsID, r.URL.Query().Get("invite"))
+	if errors.Is(err, hub.ErrNoAccess) {
+		return logging.SE(http.StatusForbidden, err)
+	}
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	return nil
+}
+
+// join connects an authenticated user to room.
+func join(w http.ResponseWriter, r *http.Request, room string, userStub queries.UserStub) *logging.StatusError {
+	targetHub := hub.FindHub(room)
 	if targetHub == nil {
 		return logging.SE(http.StatusBadRequest, errors.New("room does not exist"))
 	}
 
+	se := checkAccess(r, targetHub.Owner.EggsID, userStub.EggsID, targetHub.CheckAccess)
+	if se != nil {
+		return se
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return logging.SE(http.StatusInternalServerError, err)
 	}
 
-	client := &hub.Client{Hub: targetHub, Conn: conn, Send: make(chan []byte, 256)}
-	client.Hub.Hub.Register <- client
+	client := &hub.Client{
+		Hub:     targetHub,
+		User:    userStub,
+		Conn:    conn,
+		Send:    make(chan []byte, 256),
+		Version: hub.NegotiateVersion(conn.Subprotocol(), r.URL.Query().Get("v")),
+	}
+	err = client.Hub.Hub.Join(client)
+	if err != nil {
+		// The connection is already upgraded, so the error goes in the close frame.
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, err.Error()))
+		conn.Close()
+		return nil
+	}
 
 	go client.WritePump()
-	go client.ReadPump(userStub)
+	go client.ReadPump()
+	return nil
+}
+
+// EstablishNotifications opens a socket delivering the user's notifications as
+// they arrive.
+func EstablishNotifications(w http.ResponseWriter, r *http.Request) *logging.StatusError {
+	userStub, se := router.AuthenticateWebsocket(r, queries.ScopeNotifications)
+	if se != nil {
+		return se
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	err = notifications.Serve(userStub.EggsID, conn)
+	if err != nil {
+		logging.WebsocketError(err)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "failed to load notifications"))
+		conn.Close()
+	}
 	return nil
 }
 
+// Create opens a room for the user at /ws/create/{user}, and joins it.
 func Create(w http.ResponseWriter, r *http.Request) *logging.StatusError {
-	userStub, err := router.AuthenticateSpecificUser(r)
+	user := pathSegment(r, 3)
+	if user == "" {
+		return logging.SE(http.StatusBadRequest, errors.New("please specify user to authenticate"))
+	}
+	userStub, se := router.AuthenticateWebsocket(r, queries.ScopeRoomsHost)
+	if se != nil {
+		return se
+	}
+	if userStub.EggsID != user {
+		return logging.SE(http.StatusUnauthorized, errors.New("failed to authenticate user"))
+	}
+
+	err := hub.AttachHub(userStub, r.URL.Query().Get("visibility"))
 	if err != nil {
-		return err
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	if hub.GetHub(userStub.EggsID) == nil {
+		return logging.SE(http.StatusServiceUnavailable, errors.New("rooms are shutting down"))
 	}
+	return join(w, r, userStub.EggsID, userStub)
+}
 
-	hub.AttachHub(userStub)
-	return Establish(w, r)
+// PostTicket returns a ticket to open a websocket with as the user, by adding
+// ?ticket= to its URL. It allows what the token it was made with does.
+func PostTicket(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	grant, ok := router.Grant(r)
+	if !ok {
+		return logging.SE(http.StatusUnauthorized, errors.New("authorization is required"))
+	}
+	ticket, expires, err := queries.CreateTicket(context.Background(), grant)
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	b, err := json.Marshal(Ticket{
+		Ticket:  ticket,
+		Expires: expires,
+	})
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+	w.Write(b)
+	return nil
+}
+
+// CreateInvite returns an invite link code for the owner's room, for rooms only
+// open to invited users or followers.
+func CreateInvite(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+	pathSplit := strings.Split(r.URL.Path, "/")
+	if len(pathSplit) < 4 || pathSplit[3] == "" {
+		return logging.SE(http.StatusBadRequest, errors.New("please specify room"))
+	}
+	room := pathSplit[3]
+
+	eggsID, se := router.RequireUser(r)
+	if se != nil {
+		return se
+	}
+	if eggsID != room {
+		return logging.SE(http.StatusForbidden, errors.New("only the room owner can create invites"))
+	}
+
+	ttl := defaultInviteTTL
+	if len(b) > 0 {
+		var request InviteRequest
+		err := json.Unmarshal(b, &request)
+		if err != nil {
+			return logging.SE(http.StatusBadRequest, err)
+		}
+		if request.TTL != 0 {
+			ttl = time.Duration(request.TTL) * time.Second
+		}
+	}
+	if ttl <= 0 || ttl > hub.MaxInviteTTL {
+		return logging.SE(http.StatusBadRequest, fmt.Errorf("ttl must be between 1 and %d seconds", int64(hub.MaxInviteTTL/time.Second)))
+	}
+
+	code, expires := hub.NewInvite(room, ttl)
+	output, err := json.Marshal(Invite{
+		Code:    code,
+		Expires: expires,
+	})
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+
+	w.Write(output)
+	return nil
 }
 
+// GetHubs lists the open rooms the user can see. With ?roster=true, signed in
+// users also get the listeners of each of them.
 func GetHubs(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
-	output := hub.GetHubs()
+	withRoster := r.URL.Query().Get("roster") == "true"
+	output := hub.GetHubs(router.EggsID(r), withRoster)
 
 	b, err := json.Marshal(output)
 	if err != nil {
@@ -72,3 +258,54 @@ func GetHubs(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
 	w.Write(b)
 	return nil
 }
+
+// GetHistory returns the chat of a room, to those who could join it.
+func GetHistory(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	pathSplit := strings.Split(r.URL.Path, "/")
+	if len(pathSplit) < 4 || pathSplit[3] == "" {
+		return logging.SE(http.StatusBadRequest, errors.New("please specify room"))
+	}
+	room := pathSplit[3]
+
+	// Closed rooms and rooms served by other instances are checked against
+	// what is stored, so that reading the history does not open a mirror.
+	se := checkAccess(r, room, router.EggsID(r), func(ctx context.Context, user string, invite string) error {
+		return hub.CheckRoomAccess(ctx, room, user, invite)
+	})
+	if se != nil {
+		return se
+	}
+
+	paginator, err := queries.InitializePaginator(r.URL.Query())
+	if err != nil {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	messages, nextCursor, err := hub.GetHistory(room, paginator)
+	if errors.Is(err, queries.ErrInvalidCursor) || errors.Is(err, hub.ErrRoomNotFound) {
+		return logging.SE(http.StatusBadRequest, err)
+	}
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+
+	b, err := json.Marshal(History{
+		Messages:   messages,
+		NextCursor: nextCursor,
+	})
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+
+	w.Write(b)
+	return nil
+}
+
+func GetSchema(w io.Writer, r *http.Request, _ []byte) *logging.StatusError {
+	b, err := hub.Schema()
+	if err != nil {
+		return logging.SE(http.StatusInternalServerError, err)
+	}
+
+	w.Write(b)
+	return nil
+}
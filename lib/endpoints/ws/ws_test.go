@@ -0,0 +1,109 @@
+package wsendpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	userendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/user"
+	"github.com/yayuyokitano/eggshellver/lib/hub"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+	"github.com/yayuyokitano/eggshellver/lib/router"
+	"github.com/yayuyokitano/eggshellver/lib/services"
+)
+
+// openFollowersRoom opens a followers-only room for the second test user, and
+// returns a token of the first one.
+func openFollowersRoom(t *testing.T) (token string, owner queries.UserStub) {
+	t.Helper()
+	_, err := userendpoint.CreateTestUser(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = userendpoint.CreateTestUser(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners, err := queries.GetUsers(context.Background(), []string{os.Getenv("TESTUSER_ID2")}, []int{})
+	if err != nil || len(owners) == 0 {
+		t.Fatalf("Failed to get room owner: %v", err)
+	}
+	owner = owners[0]
+	err = hub.AttachHub(owner, hub.VisibilityFollowers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestGetHistoryFollowersOnly(t *testing.T) {
+	services.Start()
+	defer services.Stop()
+
+	err := services.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer services.RollbackTransaction()
+
+	token, owner := openFollowersRoom(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", fmt.Sprintf("/ws/history/%s", owner.EggsID), nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	router.HandleAuthenticated(GetHistory, router.Optional(queries.ScopeRoomsJoin), w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status code for non-follower is %d, want %d", w.Code, http.StatusForbidden)
+	}
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", fmt.Sprintf("/ws/history/%s", owner.EggsID), nil)
+	router.HandleAuthenticated(GetHistory, router.Optional(queries.ScopeRoomsJoin), w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Status code for anonymous user is %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestGetHubsFollowersOnly(t *testing.T) {
+	services.Start()
+	defer services.Stop()
+
+	err := services.StartTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer services.RollbackTransaction()
+
+	token, owner := openFollowersRoom(t)
+	_, _, err = queries.SubmitFollows(context.Background(), os.Getenv("TESTUSER_ID"), []string{owner.EggsID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/ws/list", nil)
+	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	router.HandleAuthenticated(GetHubs, router.Optional(queries.ScopeRoomsJoin), w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status code is %d, want %d. Body %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var hubs []hub.PublicHub
+	err = json.Unmarshal(w.Body.Bytes(), &hubs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, h := range hubs {
+		found = found || h.Owner.EggsID == owner.EggsID
+		if h.Roster != nil {
+			t.Errorf("Expected no rosters without roster=true, got %+v", h.Roster)
+		}
+	}
+	if !found {
+		t.Errorf("Expected follower to see the followers-only room, got %s", w.Body.String())
+	}
+}
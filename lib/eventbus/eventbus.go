@@ -0,0 +1,211 @@
+// Package eventbus carries timeline items from the code writing them to the
+// timeline streams. Items are published through Postgres, so that every
+// instance, and the cache creator running on its own, reaches every stream.
+package eventbus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+const (
+	channel = "eggshellver_timeline"
+
+	// Items per notification, to stay well under the 8000 byte payload limit.
+	batchSize = 40
+
+	// Events kept for streams resuming after a reconnect.
+	bufferSize = 2000
+
+	// Events queued for a slow stream before it is cut off.
+	subscriberBuffer = 256
+
+	// Time to wait before listening again after losing the connection.
+	relistenDelay = time.Second
+)
+
+// Event is a timeline item with its ID on this instance. IDs are only
+// meaningful to the instance that handed them out, and only until it restarts.
+type Event struct {
+	ID   string
+	Item queries.TimelineItem
+}
+
+// bus numbers incoming items and hands them to subscribers, keeping the latest
+// for resuming.
+type bus struct {
+	mu          sync.Mutex
+	boot        string
+	seq         int64
+	events      []Event
+	subscribers map[chan Event]bool
+	closed      bool
+}
+
+func newBus() *bus {
+	b := make([]byte, 4)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return &bus{
+		boot:        hex.EncodeToString(b),
+		subscribers: make(map[chan Event]bool),
+	}
+}
+
+var events = newBus()
+
+// publish is swapped out by tests to skip the database.
+var publish = notify
+
+// Publish sends items to every timeline stream.
+func Publish(items []queries.TimelineItem) {
+	for len(items) > 0 {
+		n := batchSize
+		if n > len(items) {
+			n = len(items)
+		}
+		err := publish(items[:n])
+		if err != nil {
+			logging.WebsocketError(err)
+		}
+		items = items[n:]
+	}
+}
+
+func notify(items []queries.TimelineItem) error {
+	b, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return queries.Notify(context.Background(), channel, string(b))
+}
+
+// Init listens for published items until ctx is done, then ends every stream.
+func Init(ctx context.Context) {
+	go listen(ctx)
+	go func() {
+		<-ctx.Done()
+		events.close()
+	}()
+}
+
+func listen(ctx context.Context) {
+	for {
+		err := queries.Listen(ctx, channel, receive)
+		if ctx.Err() != nil {
+			return
+		}
+		logging.WebsocketError(err)
+		time.Sleep(relistenDelay)
+	}
+}
+
+func receive(payload string) {
+	var items []queries.TimelineItem
+	err := json.Unmarshal([]byte(payload), &items)
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	events.add(items)
+}
+
+func (b *bus) add(items []queries.TimelineItem) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, item := range items {
+		b.seq++
+		event := Event{
+			ID:   b.boot + "-" + strconv.FormatInt(b.seq, 10),
+			Item: item,
+		}
+		b.events = append(b.events, event)
+		for sub := range b.subscribers {
+			select {
+			case sub <- event:
+			default:
+				b.unsubscribeLocked(sub)
+			}
+		}
+	}
+	if len(b.events) > bufferSize {
+		b.events = append([]Event{}, b.events[len(b.events)-bufferSize:]...)
+	}
+}
+
+// since returns the buffered events after lastID, and whether they are all of
+// them. It must be called with mu held.
+func (b *bus) since(lastID string) (backlog []Event, ok bool) {
+	boot, seqString, found := strings.Cut(lastID, "-")
+	if !found || boot != b.boot {
+		return nil, false
+	}
+	seq, err := strconv.ParseInt(seqString, 10, 64)
+	if err != nil || seq > b.seq {
+		return nil, false
+	}
+	// Sequence numbers have no gaps, so the event after seq sits at a fixed
+	// offset from the newest one.
+	missed := int(b.seq - seq)
+	if missed > len(b.events) {
+		return nil, false
+	}
+	return append([]Event{}, b.events[len(b.events)-missed:]...), true
+}
+
+// Subscribe returns a channel receiving every event from now on, and a function
+// to stop receiving them. The channel is closed if the subscriber falls behind
+// or the server shuts down. If lastID is set, the events missed since are
+// returned too, and resumed reports whether they could all be found.
+func Subscribe(lastID string) (sub <-chan Event, backlog []Event, resumed bool, cancel func()) {
+	return events.subscribe(lastID)
+}
+
+func (b *bus) subscribe(lastID string) (<-chan Event, []Event, bool, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub := make(chan Event, subscriberBuffer)
+	var backlog []Event
+	resumed := true
+	if lastID != "" {
+		backlog, resumed = b.since(lastID)
+	}
+	if b.closed {
+		close(sub)
+	} else {
+		b.subscribers[sub] = true
+	}
+	return sub, backlog, resumed, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.unsubscribeLocked(sub)
+	}
+}
+
+func (b *bus) unsubscribeLocked(sub chan Event) {
+	if !b.subscribers[sub] {
+		return
+	}
+	delete(b.subscribers, sub)
+	close(sub)
+}
+
+func (b *bus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subscribers {
+		b.unsubscribeLocked(sub)
+	}
+}
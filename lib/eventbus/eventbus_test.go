@@ -0,0 +1,101 @@
+package eventbus
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+func testItems(n int) (items []queries.TimelineItem) {
+	for i := 0; i < n; i++ {
+		items = append(items, queries.TimelineItem{
+			ID:        "artist",
+			Type:      "music",
+			Target:    fmt.Sprint(i),
+			Timestamp: time.Date(2022, 10, 1, 0, 0, i, 0, time.UTC),
+		})
+	}
+	return
+}
+
+func useTestBus(t *testing.T) *bus {
+	t.Helper()
+	oldEvents, oldPublish := events, publish
+	events = newBus()
+	publish = func(items []queries.TimelineItem) error {
+		events.add(items)
+		return nil
+	}
+	t.Cleanup(func() {
+		events, publish = oldEvents, oldPublish
+	})
+	return events
+}
+
+func TestPublishAndResume(t *testing.T) {
+	useTestBus(t)
+	sub, _, _, cancel := Subscribe("")
+	defer cancel()
+
+	Publish(testItems(batchSize + 5))
+	var last Event
+	for i := 0; i < batchSize+5; i++ {
+		last = <-sub
+		if last.Item.Target != fmt.Sprint(i) {
+			t.Fatalf("Got item %q, want %d", last.Item.Target, i)
+		}
+	}
+
+	Publish(testItems(3))
+	_, backlog, resumed, cancelResume := Subscribe(last.ID)
+	defer cancelResume()
+	if !resumed || len(backlog) != 3 || backlog[0].Item.Target != "0" {
+		t.Errorf("Resumed %v with %d events, want the 3 published since", resumed, len(backlog))
+	}
+
+	for _, id := range []string{"someone-else-1", last.ID + "0", "garbage"} {
+		_, _, resumed, cancel := Subscribe(id)
+		cancel()
+		if resumed {
+			t.Errorf("Expected %q not to resume", id)
+		}
+	}
+}
+
+func TestResumeAfterBuffer(t *testing.T) {
+	b := useTestBus(t)
+	Publish(testItems(1))
+	first := b.events[0].ID
+	Publish(testItems(bufferSize + 1))
+	_, _, resumed, cancel := Subscribe(first)
+	defer cancel()
+	if resumed {
+		t.Errorf("Expected events dropped from the buffer not to resume")
+	}
+	_, backlog, resumed, cancel := Subscribe(b.events[0].ID)
+	defer cancel()
+	if !resumed || len(backlog) != bufferSize-1 {
+		t.Errorf("Resumed %v with %d events, want %d", resumed, len(backlog), bufferSize-1)
+	}
+}
+
+func TestSlowSubscriberCutOff(t *testing.T) {
+	b := useTestBus(t)
+	sub, _, _, cancel := Subscribe("")
+	defer cancel()
+	Publish(testItems(subscriberBuffer + 1))
+	for range sub {
+	}
+	if len(b.subscribers) != 0 {
+		t.Errorf("Expected the slow subscriber to be removed")
+	}
+
+	b.close()
+	sub, _, _, cancel = Subscribe("")
+	defer cancel()
+	if _, ok := <-sub; ok {
+		t.Errorf("Expected no events after shutdown")
+	}
+}
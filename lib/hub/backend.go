@@ -0,0 +1,224 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// Kinds of broadcast. Besides being delivered to clients, some kinds update the
+// state that mirrors keep of a room served by another instance.
+const (
+	kindMessage = "message"
+	kindChat    = "chat"
+	kindQueue   = "queue"
+	kindSync    = "sync"
+	// A kick, mute, block or role change. Kicked and blocked users are
+	// disconnected wherever they are.
+	kindModeration = "moderation"
+	// A client message received by a mirror, for the room's own instance to handle.
+	kindRelay = "relay"
+	// An instance's roster of the room changed.
+	kindPresence = "presence"
+	// Reactions or votes on the current track, or a summary of the last one.
+	kindFeedback = "feedback"
+	// A mirror lost its last client.
+	kindLeave = "leave"
+	// The room closed.
+	kindClose = "close"
+)
+
+// BroadcastMessage is what a Backend carries between the instances serving a
+// room.
+type BroadcastMessage struct {
+	Room    string            `json:"room"`
+	Kind    string            `json:"kind"`
+	Origin  string            `json:"origin"`
+	Sender  *queries.UserStub `json:"sender,omitempty"`
+	Version int               `json:"version,omitempty"`
+	Data    json.RawMessage   `json:"data,omitempty"`
+}
+
+// Backend delivers broadcasts to every subscriber of a room, on every instance.
+type Backend interface {
+	Publish(message BroadcastMessage) error
+	// Subscribe returns the broadcasts to room until cancel is called.
+	Subscribe(room string) (messages <-chan BroadcastMessage, cancel func())
+	// Distributed reports whether other instances may be serving rooms.
+	Distributed() bool
+}
+
+// Number of broadcasts a subscriber may fall behind before they are dropped.
+const subscriberBuffer = 256
+
+var errSubscriberBehind = errors.New("room subscriber is behind, dropping broadcast")
+
+var backend Backend = newMemoryBackend()
+
+// instanceID identifies this instance to the others. It should be stable across
+// restarts so that rooms are restored where they were served.
+var instanceID = getInstanceID()
+
+func getInstanceID() string {
+	if id := os.Getenv("INSTANCE_ID"); id != "" {
+		return id
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "eggshellver"
+	}
+	return hostname
+}
+
+// memoryBackend delivers broadcasts within this process. It is all a single
+// instance needs.
+type memoryBackend struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan BroadcastMessage]bool
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{
+		subscribers: make(map[string]map[chan BroadcastMessage]bool),
+	}
+}
+
+func (b *memoryBackend) Publish(message BroadcastMessage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for subscriber := range b.subscribers[message.Room] {
+		select {
+		case subscriber <- message:
+		default:
+			logging.WebsocketError(errSubscriberBehind)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) Subscribe(room string) (<-chan BroadcastMessage, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	subscriber := make(chan BroadcastMessage, subscriberBuffer)
+	if b.subscribers[room] == nil {
+		b.subscribers[room] = make(map[chan BroadcastMessage]bool)
+	}
+	b.subscribers[room][subscriber] = true
+
+	var once sync.Once
+	return subscriber, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers[room], subscriber)
+			if len(b.subscribers[room]) == 0 {
+				delete(b.subscribers, room)
+			}
+			close(subscriber)
+		})
+	}
+}
+
+func (b *memoryBackend) Distributed() bool {
+	return false
+}
+
+// Postgres drops notifications with payloads of 8000 bytes or more, so larger
+// broadcasts are stored in a table and only referenced in the notification.
+const (
+	notifyChannel = "eggshellver_rooms"
+	notifyLimit   = 7900
+)
+
+// Time to wait before listening again after the connection fails.
+const relistenDelay = time.Second
+
+type notification struct {
+	Ref     int64             `json:"ref,omitempty"`
+	Message *BroadcastMessage `json:"message,omitempty"`
+}
+
+// postgresBackend fans broadcasts out to every instance through LISTEN/NOTIFY.
+// Every instance, including the one publishing, hears the notification and
+// hands it to its local subscribers.
+type postgresBackend struct {
+	local *memoryBackend
+}
+
+func newPostgresBackend(ctx context.Context) *postgresBackend {
+	b := &postgresBackend{
+		local: newMemoryBackend(),
+	}
+	go b.listen(ctx)
+	return b
+}
+
+func (b *postgresBackend) listen(ctx context.Context) {
+	for {
+		err := queries.Listen(ctx, notifyChannel, b.receive)
+		if ctx.Err() != nil {
+			return
+		}
+		logging.WebsocketError(err)
+		time.Sleep(relistenDelay)
+	}
+}
+
+func (b *postgresBackend) receive(payload string) {
+	var n notification
+	err := json.Unmarshal([]byte(payload), &n)
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	if n.Ref != 0 {
+		payload, err = queries.GetRoomBroadcast(context.Background(), n.Ref)
+		if err != nil {
+			logging.WebsocketError(err)
+			return
+		}
+		err = json.Unmarshal([]byte(payload), &n)
+		if err != nil {
+			logging.WebsocketError(err)
+			return
+		}
+	}
+	if n.Message == nil {
+		return
+	}
+	b.local.Publish(*n.Message)
+}
+
+func (b *postgresBackend) Publish(message BroadcastMessage) (err error) {
+	ctx := context.Background()
+	payload, err := json.Marshal(notification{Message: &message})
+	if err != nil {
+		return
+	}
+	if len(payload) >= notifyLimit {
+		var id int64
+		id, err = queries.InsertRoomBroadcast(ctx, string(payload))
+		if err != nil {
+			return
+		}
+		payload, err = json.Marshal(notification{Ref: id})
+		if err != nil {
+			return
+		}
+	}
+	return queries.Notify(ctx, notifyChannel, string(payload))
+}
+
+func (b *postgresBackend) Subscribe(room string) (<-chan BroadcastMessage, func()) {
+	return b.local.Subscribe(room)
+}
+
+func (b *postgresBackend) Distributed() bool {
+	return true
+}
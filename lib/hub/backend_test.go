@@ -0,0 +1,59 @@
+package hub
+
+import (
+	"testing"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	b := newMemoryBackend()
+	first, cancelFirst := b.Subscribe("room")
+	second, cancelSecond := b.Subscribe("room")
+	other, cancelOther := b.Subscribe("other")
+	defer cancelSecond()
+	defer cancelOther()
+
+	err := b.Publish(BroadcastMessage{Room: "room", Kind: kindMessage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, subscriber := range []<-chan BroadcastMessage{first, second} {
+		select {
+		case message := <-subscriber:
+			if message.Kind != kindMessage {
+				t.Errorf("Received kind %s, want %s", message.Kind, kindMessage)
+			}
+		default:
+			t.Errorf("Subscriber did not receive broadcast")
+		}
+	}
+	select {
+	case <-other:
+		t.Errorf("Subscriber to another room received broadcast")
+	default:
+	}
+
+	cancelFirst()
+	cancelFirst()
+	if _, ok := <-first; ok {
+		t.Errorf("Expected cancelled subscription to be closed")
+	}
+	err = b.Publish(BroadcastMessage{Room: "room", Kind: kindMessage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(second) != 1 {
+		t.Errorf("Remaining subscriber has %d broadcasts, want 1", len(second))
+	}
+}
+
+func TestMemoryBackendDropsWhenBehind(t *testing.T) {
+	b := newMemoryBackend()
+	subscriber, cancel := b.Subscribe("room")
+	defer cancel()
+	for i := 0; i < subscriberBuffer+10; i++ {
+		b.Publish(BroadcastMessage{Room: "room"})
+	}
+	if len(subscriber) != subscriberBuffer {
+		t.Errorf("Subscriber has %d broadcasts, want %d", len(subscriber), subscriberBuffer)
+	}
+}
@@ -0,0 +1,340 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// publish sends an event to the room's clients on every instance.
+func (h *Hub) publish(kind string, event any) {
+	message := BroadcastMessage{
+		Room:   h.Owner.EggsID,
+		Kind:   kind,
+		Origin: instanceID,
+	}
+	if event != nil {
+		b, err := json.Marshal(event)
+		if err != nil {
+			logging.WebsocketError(err)
+			return
+		}
+		message.Data = b
+	}
+	err := backend.Publish(message)
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+}
+
+// relay passes a client message on to the instance serving the room.
+func (h *Hub) relay(user queries.UserStub, version int, rawMessage []byte) {
+	err := backend.Publish(BroadcastMessage{
+		Room:    h.Owner.EggsID,
+		Kind:    kindRelay,
+		Origin:  instanceID,
+		Sender:  &user,
+		Version: version,
+		Data:    rawMessage,
+	})
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+}
+
+// forward hands the room's broadcasts to run. Relayed client messages are
+// handled here instead, like a ReadPump would.
+func (h *Hub) forward(messages <-chan BroadcastMessage) {
+	for message := range messages {
+		if message.Kind == kindRelay {
+			if !h.Mirror {
+				h.handleRelay(message)
+			}
+			continue
+		}
+		select {
+		case h.Broadcast <- message:
+		case <-h.done:
+			return
+		}
+	}
+}
+
+func (h *Hub) handleRelay(relay BroadcastMessage) {
+	if relay.Sender == nil {
+		return
+	}
+	client := &Client{
+		Hub: &AuthedHub{
+			Hub:   h,
+			Owner: h.Owner,
+		},
+		User:    *relay.Sender,
+		Version: relay.Version,
+		relay:   true,
+	}
+	message, perr := decodeMessage(relay.Version, relay.Data)
+	if perr != nil {
+		logging.WebsocketError(perr)
+		return
+	}
+	client.handleError(client.handleMessage(client.User, message, relay.Data))
+}
+
+// receive delivers a broadcast to the local clients, and keeps mirrored state in
+// step with the instance serving the room. It reports whether the room closed.
+func (h *Hub) receive(message BroadcastMessage) (closed bool) {
+	switch message.Kind {
+	case kindChat:
+		var authedMessage AuthedMessage
+		err := json.Unmarshal(message.Data, &authedMessage)
+		if err != nil {
+			logging.WebsocketError(err)
+			return
+		}
+		h.History.add(authedMessage)
+	case kindQueue:
+		if h.Mirror {
+			var event QueueEvent
+			err := json.Unmarshal(message.Data, &event)
+			if err != nil {
+				logging.WebsocketError(err)
+				return
+			}
+			h.Queue.replace(event.Queue, event.Suggestions)
+		}
+	case kindSync:
+		if h.Mirror {
+			var event SyncEvent
+			err := json.Unmarshal(message.Data, &event)
+			if err != nil {
+				logging.WebsocketError(err)
+				return
+			}
+			h.Playback.apply(event)
+		}
+	case kindFeedback:
+		if h.Mirror {
+			var event FeedbackEvent
+			err := json.Unmarshal(message.Data, &event)
+			if err != nil {
+				logging.WebsocketError(err)
+				return
+			}
+			h.Feedback.replace(event)
+		}
+	case kindModeration:
+		var event ModerationEvent
+		err := json.Unmarshal(message.Data, &event)
+		if err != nil {
+			logging.WebsocketError(err)
+			return
+		}
+		if h.Mirror {
+			h.applyModeration(event)
+		}
+		h.broadcast(message.Data)
+		if event.Action == "kick" || event.Action == "block" {
+			h.disconnect(event.User)
+		}
+		return
+	case kindPresence:
+		h.receivePresence(message)
+		return
+	case kindMessage:
+		if h.Mirror {
+			h.applyOwnerMessage(message.Data)
+		}
+	case kindLeave:
+		if !h.Mirror && len(h.Clients) == 0 && !h.hasRemoteListeners() {
+			h.close(false)
+			return true
+		}
+		return
+	case kindClose:
+		if h.Mirror {
+			h.close(false)
+			return true
+		}
+		return
+	}
+	h.broadcast(message.Data)
+	return
+}
+
+// applyModeration keeps a mirror's co-hosts, mutes and blocklist in step with
+// the instance serving the room.
+func (h *Hub) applyModeration(event ModerationEvent) {
+	h.setCohosts(event.Cohosts)
+	switch event.Action {
+	case "mute":
+		if event.Until != nil {
+			h.mute(event.User, *event.Until)
+		}
+	case "unmute":
+		h.unmute(event.User)
+	case "block":
+		h.block([]string{event.User})
+	}
+}
+
+// applyOwnerMessage keeps a mirror's title, visibility and blocklist in step
+// with changes made by the owner.
+func (h *Hub) applyOwnerMessage(data json.RawMessage) {
+	var authedMessage AuthedMessage
+	err := json.Unmarshal(data, &authedMessage)
+	if err != nil || !authedMessage.Privileged {
+		return
+	}
+	message, perr := decodeMessage(ProtocolV1, []byte(authedMessage.Message))
+	if perr != nil {
+		return
+	}
+	switch message.Type {
+	case "setTitle":
+		var title TitlePayload
+		if message.decodePayload(&title) == nil {
+			h.setTitle(string(title))
+		}
+	case "setVisibility":
+		var visibility VisibilityPayload
+		if message.decodePayload(&visibility) == nil && validVisibility(string(visibility)) {
+			h.setVisibility(string(visibility))
+		}
+	case "unblockedUsers":
+		var unblockedUsers UsersPayload
+		if message.decodePayload(&unblockedUsers) == nil {
+			h.unblock(unblockedUsers)
+		}
+	}
+}
+
+// updatePresence records who this instance has in the room.
+func (h *Hub) updatePresence() {
+	h.setListeners(len(h.Clients))
+	if !backend.Distributed() {
+		return
+	}
+	users := h.localUsers()
+	roster := make([]string, 0, len(users))
+	for id := range users {
+		roster = append(roster, id)
+	}
+	err := queries.SetRoomPresence(context.Background(), h.Owner.EggsID, instanceID, len(h.Clients), roster)
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+}
+
+// hasRemoteListeners reports whether other instances still have listeners in
+// the room, which keeps it open when everyone here has left.
+func (h *Hub) hasRemoteListeners() bool {
+	if !backend.Distributed() {
+		return false
+	}
+	room, err := queries.GetRoom(context.Background(), h.Owner.EggsID)
+	if err != nil {
+		if !pgxscan.NotFound(err) {
+			logging.WebsocketError(err)
+		}
+		return false
+	}
+	return room.Listeners > len(h.Clients)
+}
+
+// FindHub returns the room owned by user. If another instance serves it, this
+// instance starts mirroring it.
+func FindHub(user string) *AuthedHub {
+	if h := GetHub(user); h != nil {
+		return h
+	}
+	if !backend.Distributed() {
+		return nil
+	}
+	room, err := queries.GetRoom(context.Background(), user)
+	if err != nil {
+		if !pgxscan.NotFound(err) {
+			logging.WebsocketError(err)
+		}
+		return nil
+	}
+	if room.InstanceID == instanceID {
+		return nil
+	}
+	h, err := hubFromRoom(room, true)
+	if err != nil {
+		logging.WebsocketError(err)
+		return nil
+	}
+	// Like a restored room, a mirror closes if nobody joins it.
+	current, _ := hubs.add(&AuthedHub{
+		Hub:   h,
+		Owner: room.Owner,
+	}, time.After(restoreGracePeriod))
+	return current
+}
+
+// getClusterHubs lists the rooms open on every instance.
+func getClusterHubs(viewer string, withRoster bool) (publicHubs []PublicHub, err error) {
+	ctx := context.Background()
+	rooms, err := queries.GetRooms(ctx)
+	if err != nil {
+		return
+	}
+
+	users := make(map[string]queries.UserStub)
+	if withRoster && viewer != "" {
+		var ids []string
+		for _, room := range rooms {
+			ids = append(ids, room.Roster...)
+		}
+		var stubs []queries.UserStub
+		stubs, err = queries.GetUsers(ctx, ids, nil)
+		if err != nil {
+			return
+		}
+		for _, stub := range stubs {
+			users[stub.EggsID] = stub
+		}
+	}
+
+	publicHubs = make([]PublicHub, 0, len(rooms))
+	for _, room := range rooms {
+		var song SongStub
+		err = json.Unmarshal(room.Song, &song)
+		if err != nil {
+			return
+		}
+		publicHub := PublicHub{
+			Owner:      room.Owner,
+			Title:      room.Title,
+			Song:       song,
+			Visibility: room.Visibility,
+			Listeners:  room.Listeners,
+		}
+		if withRoster && viewer != "" && !contains(room.Blocklist, viewer) {
+			roster := make(map[string]queries.UserStub, len(room.Roster))
+			for _, id := range room.Roster {
+				if user, ok := users[id]; ok {
+					roster[id] = user
+				}
+			}
+			publicHub.Roster = sortedUsers(roster)
+		}
+		publicHubs = append(publicHubs, publicHub)
+	}
+	return
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
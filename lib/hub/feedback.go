@@ -0,0 +1,298 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// Emoji listeners may react with.
+var reactionEmoji = map[string]bool{
+	"👍":  true,
+	"❤️": true,
+	"😂":  true,
+	"😢":  true,
+	"🔥":  true,
+	"👏":  true,
+	"🎉":  true,
+}
+
+// Shortest time between two reactions from the same user.
+const reactionInterval = time.Second
+
+// Number of finished tracks kept in the room summary.
+const summarySize = 100
+
+// Votes listeners can cast on the current track.
+const (
+	VoteLike = "like"
+	VoteSkip = "skip"
+)
+
+var (
+	errUnknownEmoji  = errors.New("emoji is not allowed")
+	errUnknownVote   = errors.New("vote must be like or skip")
+	errNothingPlays  = errors.New("nothing is playing")
+	errBadThreshold  = errors.New("skip threshold must not be negative")
+	errReactTooOften = errors.New("reacting too often")
+)
+
+// TrackFeedback is the combined reactions and votes for one track.
+type TrackFeedback struct {
+	Song      SongStub       `json:"song"`
+	Reactions map[string]int `json:"reactions"`
+	Likes     int            `json:"likes"`
+	Skips     int            `json:"skips"`
+	Started   time.Time      `json:"started"`
+	Ended     *time.Time     `json:"ended,omitempty"`
+}
+
+// FeedbackEvent is broadcast when someone reacts or votes, carrying the totals
+// for the current track, and sent to clients when they join. When the track
+// changes, a summary of the finished one is broadcast.
+type FeedbackEvent struct {
+	Type          string            `json:"type"`
+	Action        string            `json:"action"`
+	User          *queries.UserStub `json:"user,omitempty"`
+	Emoji         string            `json:"emoji,omitempty"`
+	Vote          string            `json:"vote,omitempty"`
+	Track         TrackFeedback     `json:"track"`
+	SkipThreshold int               `json:"skipThreshold"`
+}
+
+// feedback tallies reactions and votes on the current track, and keeps the
+// tallies of the tracks before it.
+type feedback struct {
+	mu            sync.Mutex
+	clock         clock
+	track         TrackFeedback
+	votes         map[string]string
+	lastReaction  map[string]time.Time
+	skipThreshold int
+	summary       []TrackFeedback
+}
+
+func newFeedback(c clock) *feedback {
+	return &feedback{
+		clock: c,
+		track: TrackFeedback{
+			Reactions: make(map[string]int),
+		},
+		votes:        make(map[string]string),
+		lastReaction: make(map[string]time.Time),
+		summary:      make([]TrackFeedback, 0),
+	}
+}
+
+func copyTrack(track TrackFeedback) TrackFeedback {
+	reactions := make(map[string]int, len(track.Reactions))
+	for emoji, n := range track.Reactions {
+		reactions[emoji] = n
+	}
+	track.Reactions = reactions
+	return track
+}
+
+// next starts tallying a new track. The previous one, if anything was playing,
+// is added to the summary and returned.
+func (f *feedback) next(song SongStub) (finished TrackFeedback, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.clock.Now()
+	if f.track.Song.MusicID != "" {
+		finished = f.track
+		finished.Ended = &now
+		f.summary = append(f.summary, finished)
+		if len(f.summary) > summarySize {
+			f.summary = f.summary[len(f.summary)-summarySize:]
+		}
+		ok = true
+	}
+	f.track = TrackFeedback{
+		Song:      song,
+		Reactions: make(map[string]int),
+		Started:   now,
+	}
+	f.votes = make(map[string]string)
+	return
+}
+
+func (f *feedback) react(user string, emoji string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !reactionEmoji[emoji] {
+		return errUnknownEmoji
+	}
+	if f.track.Song.MusicID == "" {
+		return errNothingPlays
+	}
+	now := f.clock.Now()
+	if now.Sub(f.lastReaction[user]) < reactionInterval {
+		return errReactTooOften
+	}
+	f.lastReaction[user] = now
+	f.track.Reactions[emoji]++
+	return nil
+}
+
+// vote records the user's vote, replacing any earlier vote on the same track.
+// It reports whether enough listeners voted to skip.
+func (f *feedback) vote(user string, vote string) (skip bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if vote != VoteLike && vote != VoteSkip {
+		err = errUnknownVote
+		return
+	}
+	if f.track.Song.MusicID == "" {
+		err = errNothingPlays
+		return
+	}
+	switch f.votes[user] {
+	case VoteLike:
+		f.track.Likes--
+	case VoteSkip:
+		f.track.Skips--
+	}
+	f.votes[user] = vote
+	if vote == VoteLike {
+		f.track.Likes++
+	} else {
+		f.track.Skips++
+	}
+	skip = f.skipThreshold > 0 && f.track.Skips >= f.skipThreshold
+	return
+}
+
+func (f *feedback) setSkipThreshold(threshold int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.skipThreshold = threshold
+}
+
+// replace takes on the tally of the instance serving the room.
+func (f *feedback) replace(event FeedbackEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if event.Action == "summary" {
+		return
+	}
+	if event.Action == "track" {
+		f.votes = make(map[string]string)
+	}
+	f.track = copyTrack(event.Track)
+	f.skipThreshold = event.SkipThreshold
+}
+
+func (f *feedback) event(action string) FeedbackEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return FeedbackEvent{
+		Type:          "feedback",
+		Action:        action,
+		Track:         copyTrack(f.track),
+		SkipThreshold: f.skipThreshold,
+	}
+}
+
+// summaries returns the tallies of the finished tracks, oldest first.
+func (f *feedback) summaries() []TrackFeedback {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	summary := make([]TrackFeedback, 0, len(f.summary))
+	for _, track := range f.summary {
+		summary = append(summary, copyTrack(track))
+	}
+	return summary
+}
+
+// playSong switches the room to song, summarising the feedback on the track
+// that was playing and adding it to the recap.
+func (h *Hub) playSong(song SongStub) {
+	finished, ok := h.Feedback.next(song)
+	h.setSong(song)
+	h.Playback.start(song.MusicID, 0)
+	if ok {
+		h.recordTrack(finished)
+		event := h.Feedback.event("summary")
+		event.Track = finished
+		h.publish(kindFeedback, event)
+	}
+	h.publish(kindFeedback, h.Feedback.event("track"))
+}
+
+func isFeedbackMessage(messageType string) bool {
+	switch messageType {
+	case "reaction", "vote", "setSkipThreshold":
+		return true
+	}
+	return false
+}
+
+// handleFeedbackMessage records a reaction or vote and broadcasts the new
+// totals. The owner sets how many skip votes skip the track automatically.
+func (c *Client) handleFeedbackMessage(user queries.UserStub, message Message) (err error) {
+	h := c.Hub.Hub
+	if h.isBlocked(user.EggsID) {
+		return forbidden(message.Type)
+	}
+
+	var event FeedbackEvent
+	switch message.Type {
+	case "reaction":
+		if until, muted := h.mutedUntil(user.EggsID); muted {
+			return mutedError(until)
+		}
+		var emoji ReactionPayload
+		err = message.decodePayload(&emoji)
+		if err != nil {
+			return
+		}
+		err = h.Feedback.react(user.EggsID, string(emoji))
+		if err == errReactTooOften {
+			return protocolError(ErrorRateLimited, message.Type, err)
+		}
+		if err != nil {
+			return protocolError(ErrorInvalidPayload, message.Type, err)
+		}
+		event = h.Feedback.event(message.Type)
+		event.Emoji = string(emoji)
+	case "vote":
+		var vote VotePayload
+		err = message.decodePayload(&vote)
+		if err != nil {
+			return
+		}
+		var skip bool
+		skip, err = h.Feedback.vote(user.EggsID, string(vote))
+		if err != nil {
+			return protocolError(ErrorInvalidPayload, message.Type, err)
+		}
+		event = h.Feedback.event(message.Type)
+		event.Vote = string(vote)
+		if skip {
+			defer h.skip()
+		}
+	case "setSkipThreshold":
+		if user.EggsID != c.Hub.Owner.EggsID {
+			return forbidden(message.Type)
+		}
+		var threshold SkipThresholdPayload
+		err = message.decodePayload(&threshold)
+		if err != nil {
+			return
+		}
+		if threshold < 0 {
+			return protocolError(ErrorInvalidPayload, message.Type, errBadThreshold)
+		}
+		h.Feedback.setSkipThreshold(int(threshold))
+		event = h.Feedback.event(message.Type)
+	}
+	logging.WebsocketMessage(message.Type, user.EggsID, event.Emoji+event.Vote)
+	event.User = &user
+	h.publish(kindFeedback, event)
+	return
+}
@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func newFakeFeedback() (*feedback, *fakeClock) {
+	c := &fakeClock{now: time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)}
+	return newFeedback(c), c
+}
+
+func TestReactions(t *testing.T) {
+	f, c := newFakeFeedback()
+	if err := f.react("listener", "👍"); err != errNothingPlays {
+		t.Errorf("Reacting with nothing playing returned %v", err)
+	}
+	f.next(SongStub{MusicID: "one"})
+
+	if err := f.react("listener", "🍆"); err != errUnknownEmoji {
+		t.Errorf("Reacting with an unknown emoji returned %v", err)
+	}
+	if err := f.react("listener", "👍"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.react("listener", "👍"); err != errReactTooOften {
+		t.Errorf("Reacting twice in a row returned %v", err)
+	}
+	if err := f.react("other", "👍"); err != nil {
+		t.Fatal(err)
+	}
+	c.Advance(reactionInterval)
+	if err := f.react("listener", "🔥"); err != nil {
+		t.Fatal(err)
+	}
+
+	reactions := f.event("").Track.Reactions
+	if reactions["👍"] != 2 || reactions["🔥"] != 1 {
+		t.Errorf("Got reactions %v", reactions)
+	}
+}
+
+func TestVotes(t *testing.T) {
+	f, _ := newFakeFeedback()
+	f.next(SongStub{MusicID: "one"})
+	f.setSkipThreshold(2)
+
+	if _, err := f.vote("listener", "meh"); err != errUnknownVote {
+		t.Errorf("Unknown vote returned %v", err)
+	}
+	for _, vote := range []string{VoteSkip, VoteLike, VoteSkip} {
+		skip, err := f.vote("listener", vote)
+		if err != nil || skip {
+			t.Fatalf("Vote returned %v, %v", skip, err)
+		}
+	}
+	if track := f.event("").Track; track.Likes != 0 || track.Skips != 1 {
+		t.Errorf("Changing votes left %d likes and %d skips, want 0 and 1", track.Likes, track.Skips)
+	}
+	if skip, _ := f.vote("other", VoteSkip); !skip {
+		t.Errorf("Expected the second skip vote to reach the threshold")
+	}
+
+	finished, ok := f.next(SongStub{MusicID: "two"})
+	if !ok || finished.Song.MusicID != "one" || finished.Skips != 2 || finished.Ended == nil {
+		t.Errorf("Got summary %+v", finished)
+	}
+	if track := f.event("").Track; track.Song.MusicID != "two" || track.Skips != 0 {
+		t.Errorf("New track started with %+v", track)
+	}
+	if summary := f.summaries(); len(summary) != 1 {
+		t.Errorf("Got %d summaries, want 1", len(summary))
+	}
+}
+
+func TestVoteSkips(t *testing.T) {
+	useTestRegistry(t)
+	clients := joinTestRoom(t, "owner", "listener", "other")
+	owner, listener, other := clients[0], clients[1], clients[2]
+
+	for _, raw := range []string{
+		`{"type":"start","message":"{\"musicId\":\"one\"}"}`,
+		`{"type":"enqueue","message":"{\"musicId\":\"two\"}"}`,
+		`{"type":"setSkipThreshold","message":"2"}`,
+	} {
+		err := sendTestMessage(owner, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectCode(t, sendTestMessage(listener, `{"type":"setSkipThreshold","message":"1"}`), ErrorForbidden)
+
+	h := owner.Hub.Hub
+	for _, c := range []*Client{listener, other} {
+		err := sendTestMessage(c, `{"type":"vote","message":"\"skip\""}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if song := h.public("", false).Song.MusicID; song != "two" {
+		t.Errorf("Playing %q after skip votes, want two", song)
+	}
+	if summary := h.Feedback.summaries(); len(summary) != 1 || summary[0].Skips != 2 {
+		t.Errorf("Got summary %+v", summary)
+	}
+}
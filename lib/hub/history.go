@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// Number of chat messages each room keeps in memory for replay.
+const historySize = 100
+
+// Whether chat messages are also written to Postgres.
+var persistChat = os.Getenv("PERSIST_ROOM_CHAT") == "true"
+
+var ErrRoomNotFound = errors.New("room does not exist")
+
+// history is a ring buffer of the most recent chat messages in a room.
+type history struct {
+	mu       sync.Mutex
+	messages []AuthedMessage
+	next     int
+	full     bool
+}
+
+func newHistory(size int) *history {
+	return &history{
+		messages: make([]AuthedMessage, size),
+	}
+}
+
+func (h *history) add(message AuthedMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages[h.next] = message
+	h.next = (h.next + 1) % len(h.messages)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// all returns the buffered messages, oldest first.
+func (h *history) all() (messages []AuthedMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	messages = make([]AuthedMessage, 0, len(h.messages))
+	if h.full {
+		messages = append(messages, h.messages[h.next:]...)
+	}
+	messages = append(messages, h.messages[:h.next]...)
+	return
+}
+
+// page returns up to paginator.Limit buffered messages older than the cursor,
+// newest first.
+func (h *history) page(paginator queries.Paginator) (messages []AuthedMessage, nextCursor string, err error) {
+	cursor := queries.Cursor{}
+	if paginator.Cursor != nil {
+		cursor = *paginator.Cursor
+	}
+	if !cursor.Timestamp.IsZero() && len(cursor.Keys) != 1 {
+		err = queries.ErrInvalidCursor
+		return
+	}
+	all := h.all()
+	messages = make([]AuthedMessage, 0)
+	for i := len(all) - 1; i >= 0 && len(messages) < paginator.Limit; i-- {
+		m := all[i]
+		if !cursor.Timestamp.IsZero() && !m.Timestamp.Before(cursor.Timestamp) && !(m.Timestamp.Equal(cursor.Timestamp) && m.ID < cursor.Keys[0]) {
+			continue
+		}
+		messages = append(messages, m)
+	}
+	if len(messages) > 0 && len(messages) == paginator.Limit {
+		last := messages[len(messages)-1]
+		nextCursor = queries.Cursor{
+			Timestamp: last.Timestamp,
+			Keys:      []string{last.ID},
+		}.Encode()
+	}
+	return
+}
+
+func (m AuthedMessage) toRoomMessage(ownerID string) queries.RoomMessage {
+	return queries.RoomMessage{
+		ID:         m.ID,
+		OwnerID:    ownerID,
+		Sender:     m.Sender,
+		Message:    m.Message,
+		Privileged: m.Privileged,
+		Blocked:    m.Blocked,
+		Timestamp:  m.Timestamp,
+	}
+}
+
+func fromRoomMessage(m queries.RoomMessage) AuthedMessage {
+	return AuthedMessage{
+		ID:         m.ID,
+		Privileged: m.Privileged,
+		Blocked:    m.Blocked,
+		Sender:     m.Sender,
+		Message:    m.Message,
+		Timestamp:  m.Timestamp,
+	}
+}
+
+// GetHistory pages through older chat messages of a room, newest first. Rooms
+// that are not open only have history if chat persistence is enabled.
+func GetHistory(room string, paginator queries.Paginator) (messages []AuthedMessage, nextCursor string, err error) {
+	if persistChat {
+		var roomMessages []queries.RoomMessage
+		roomMessages, nextCursor, err = queries.GetRoomMessages(context.Background(), room, paginator)
+		if err != nil {
+			return
+		}
+		messages = make([]AuthedMessage, 0, len(roomMessages))
+		for _, m := range roomMessages {
+			messages = append(messages, fromRoomMessage(m))
+		}
+		return
+	}
+	h := GetHub(room)
+	if h == nil {
+		err = ErrRoomNotFound
+		return
+	}
+	return h.Hub.History.page(paginator)
+}
@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+func TestHistoryWraps(t *testing.T) {
+	h := newHistory(3)
+	for i := 0; i < 5; i++ {
+		h.add(AuthedMessage{ID: fmt.Sprint(i)})
+	}
+	messages := h.all()
+	if len(messages) != 3 {
+		t.Fatalf("Returned %d messages, want %d", len(messages), 3)
+	}
+	for i, m := range messages {
+		if m.ID != fmt.Sprint(i+2) {
+			t.Errorf("Message %d is %s, want %d", i, m.ID, i+2)
+		}
+	}
+}
+
+func TestHistoryPage(t *testing.T) {
+	h := newHistory(10)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		h.add(AuthedMessage{ID: fmt.Sprint(i), Timestamp: start.Add(time.Duration(i) * time.Second)})
+	}
+
+	messages, nextCursor, err := h.page(queries.Paginator{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || messages[0].ID != "4" || messages[1].ID != "3" {
+		t.Errorf("Returned %v, want messages 4 and 3", messages)
+	}
+
+	cursor, err := queries.DecodeCursor(nextCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, nextCursor, err = h.page(queries.Paginator{Limit: 5, Cursor: &cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 3 || messages[0].ID != "2" || messages[2].ID != "0" {
+		t.Errorf("Returned %v, want messages 2 to 0", messages)
+	}
+	if nextCursor != "" {
+		t.Errorf("Expected nextCursor to be empty, got %s", nextCursor)
+	}
+}
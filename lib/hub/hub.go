@@ -1,9 +1,12 @@
 package hub
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -11,10 +14,71 @@ import (
 	"github.com/yayuyokitano/eggshellver/lib/queries"
 )
 
-var hubs map[string]*AuthedHub
+var hubs = newRegistry(context.Background())
 
-func Init() {
-	hubs = make(map[string]*AuthedHub)
+// Init picks the broadcast backend and restores the rooms that were open on
+// this instance when it last stopped. Rooms shut down when ctx is cancelled,
+// keeping their saved state for the next start.
+func Init(ctx context.Context) (err error) {
+	hubs = newRegistry(ctx)
+	if os.Getenv("ROOM_BACKEND") == "postgres" {
+		backend = newPostgresBackend(ctx)
+	}
+	rooms, err := queries.GetRooms(context.Background())
+	if err != nil {
+		return
+	}
+	return restoreRooms(rooms)
+}
+
+// restoreRooms reopens the rooms of this instance. A room that cannot be
+// restored is logged and skipped, so that it does not keep the others closed.
+func restoreRooms(rooms []queries.Room) error {
+	var failed []string
+	for _, room := range rooms {
+		if backend.Distributed() && room.InstanceID != instanceID {
+			continue
+		}
+		h, err := hubFromRoom(room, false)
+		if err != nil {
+			err = fmt.Errorf("failed to restore room of %s: %w", room.Owner.EggsID, err)
+			logging.WebsocketError(err)
+			failed = append(failed, err.Error())
+			continue
+		}
+		hubs.add(&AuthedHub{
+			Hub:   h,
+			Owner: room.Owner,
+		}, time.After(restoreGracePeriod))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d rooms could not be restored: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// hubFromRoom rebuilds a hub from its saved state.
+func hubFromRoom(room queries.Room, mirror bool) (h *Hub, err error) {
+	h = newHub(room.Owner, mirror)
+	h.Title = room.Title
+	h.session = room.SessionID
+	if validVisibility(room.Visibility) {
+		h.Visibility = room.Visibility
+	}
+	h.Created = room.CreatedTime
+	h.block(room.Blocklist)
+	h.setCohosts(room.Cohosts)
+	err = json.Unmarshal(room.Song, &h.Song)
+	if err != nil {
+		return
+	}
+	var items []QueueItem
+	err = json.Unmarshal(room.Queue, &items)
+	if err != nil {
+		return
+	}
+	h.Queue.restore(items)
+	return
 }
 
 type AuthedHub struct {
@@ -39,29 +103,43 @@ const (
 
 	// Maximum message size allowed from peer.
 	maxMessageSize = 65536
+
+	// Time a restored room stays open without anyone rejoining it.
+	restoreGracePeriod = 5 * time.Minute
 )
 
 // Client is a middleman between the websocket connection and the hub.
 type Client struct {
 	Hub *AuthedHub
 
+	// The user the client authenticated as.
+	User queries.UserStub
+
 	// The websocket connection.
 	Conn *websocket.Conn
 
 	// Buffered channel of outbound messages.
 	Send chan []byte
+
+	// Protocol version negotiated during the handshake.
+	Version int
+
+	// Whether the client is connected to another instance, which relayed its
+	// message here.
+	relay bool
+
+	// When the client was last warned for going over a rate limit.
+	warnedAt time.Time
 }
 
 type AuthedMessage struct {
+	ID         string           `json:"id"`
 	Privileged bool             `json:"privileged"`
+	Cohost     bool             `json:"cohost,omitempty"`
 	Blocked    bool             `json:"blocked"`
 	Sender     queries.UserStub `json:"sender"`
 	Message    string           `json:"message"`
-}
-
-type RawMessage struct {
-	Type    string `json:"type"`
-	Message string `json:"message"`
+	Timestamp  time.Time        `json:"timestamp"`
 }
 
 // readPump pumps messages from the websocket connection to the hub.
@@ -69,9 +147,9 @@ type RawMessage struct {
 // The application runs readPump in a per-connection goroutine. The application
 // ensures that there is at most one reader on a connection by executing all
 // reads from this goroutine.
-func (c *Client) ReadPump(user queries.UserStub) {
+func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.Hub.Unregister <- c
+		c.leave()
 		c.Conn.Close()
 	}()
 	c.Conn.SetReadLimit(maxMessageSize)
@@ -86,79 +164,174 @@ func (c *Client) ReadPump(user queries.UserStub) {
 			break
 		}
 
-		var message RawMessage
-		err = json.Unmarshal(rawMessage, &message)
+		if !c.Hub.Hub.limiter.allow(c.User.EggsID, rateLimitAll) {
+			if c.throttle(rateLimitAll) {
+				break
+			}
+			continue
+		}
+		message, perr := decodeMessage(c.Version, rawMessage)
+		if perr != nil {
+			c.sendError(perr)
+			continue
+		}
+		if !c.Hub.Hub.limiter.allow(c.User.EggsID, message.Type) {
+			if c.throttle(message.Type) {
+				break
+			}
+			continue
+		}
+
+		if c.Hub.Hub.Mirror {
+			c.Hub.Hub.relay(c.User, c.Version, rawMessage)
+			continue
+		}
+		c.handleError(c.handleMessage(c.User, message, rawMessage))
+	}
+}
+
+// leave unregisters the client, unless the room has already closed.
+func (c *Client) leave() {
+	select {
+	case c.Hub.Hub.Unregister <- c:
+	case <-c.Hub.Hub.done:
+	}
+}
+
+// handleMessage applies a message from user and broadcasts it to the room.
+func (c *Client) handleMessage(user queries.UserStub, message Message, rawMessage []byte) (err error) {
+	if isQueueMessage(message.Type) {
+		return c.handleQueueMessage(user, message)
+	}
+
+	if isPlaybackMessage(message.Type) {
+		return c.handlePlaybackMessage(user, message)
+	}
+
+	if isModerationMessage(message.Type) {
+		return c.handleModerationMessage(user, message)
+	}
+
+	if isFeedbackMessage(message.Type) {
+		return c.handleFeedbackMessage(user, message)
+	}
+
+	if message.Type == "chat" {
+		if until, muted := c.Hub.Hub.mutedUntil(user.EggsID); muted {
+			return mutedError(until)
+		}
+		var chatMessage ChatPayload
+		err = message.decodePayload(&chatMessage)
+		if err != nil {
+			return
+		}
+		logging.WebsocketMessage("chat", user.EggsID, string(chatMessage))
+	}
+
+	if isOwnerMessage(message.Type) {
+		err = c.handleOwnerMessage(user, message)
 		if err != nil {
-			logging.WebsocketError(err)
-			break
+			return
 		}
+	}
 
-		if message.Type == "chat" {
-			var chatMessage string
-			err = json.Unmarshal([]byte(message.Message), &chatMessage)
+	id, err := queries.GenerateRandomString(16)
+	if err != nil {
+		return
+	}
+	authedMessage := AuthedMessage{
+		ID:         id,
+		Privileged: c.Hub.Owner.EggsID == user.EggsID,
+		Cohost:     c.Hub.Hub.isCohost(user.EggsID),
+		Blocked:    user.EggsID == "" || c.Hub.Hub.isBlocked(user.EggsID),
+		Sender:     user,
+		Message:    c.legacyMessage(message, rawMessage),
+		Timestamp:  time.Now(),
+	}
+	kind := kindMessage
+	if message.Type == "chat" {
+		kind = kindChat
+		c.Hub.Hub.countChat()
+		// Anonymous senders have no user to store the message under.
+		if persistChat && user.EggsID != "" {
+			err = queries.InsertRoomMessage(context.Background(), authedMessage.toRoomMessage(c.Hub.Owner.EggsID))
 			if err != nil {
 				logging.WebsocketError(err)
-				break
 			}
-			logging.WebsocketMessage("chat", user.EggsID, chatMessage)
 		}
+	}
+	c.Hub.Hub.publish(kind, authedMessage)
+	return nil
+}
 
-		if user.EggsID == c.Hub.Owner.EggsID {
-			if message.Type == "start" {
-				var songStub RawSongStub
-				err = json.Unmarshal([]byte(message.Message), &songStub)
-				if err != nil {
-					logging.WebsocketError(err)
-					break
-				}
-				c.Hub.Hub.Song = songStub.ToSongStub()
-			}
-			if message.Type == "setTitle" {
-				var title string
-				err = json.Unmarshal([]byte(message.Message), &title)
-				if err != nil {
-					logging.WebsocketError(err)
-					break
-				}
-				c.Hub.Hub.Title = title
-			}
-			if message.Type == "blockedUsers" {
-				var blockedUsers []string
-				err = json.Unmarshal([]byte(message.Message), &blockedUsers)
-				if err != nil {
-					logging.WebsocketError(err)
-					break
-				}
-				logging.WebsocketMessage("blockedUsers", user.EggsID, strings.Join(blockedUsers, ","))
-				for _, blockedUser := range blockedUsers {
-					c.Hub.Hub.Blocklist[blockedUser] = true
-				}
-			}
-			if message.Type == "unblockedUsers" {
-				var unblockedUsers []string
-				err = json.Unmarshal([]byte(message.Message), &unblockedUsers)
-				if err != nil {
-					logging.WebsocketError(err)
-					break
-				}
-				for _, unblockedUser := range unblockedUsers {
-					delete(c.Hub.Hub.Blocklist, unblockedUser)
-				}
+func isOwnerMessage(messageType string) bool {
+	switch messageType {
+	case "start", "setTitle", "setVisibility", "blockedUsers", "unblockedUsers":
+		return true
+	}
+	return false
+}
+
+// handleOwnerMessage applies a change to the room itself, which only the owner
+// may make. Co-hosts may also start songs.
+func (c *Client) handleOwnerMessage(user queries.UserStub, message Message) (err error) {
+	h := c.Hub.Hub
+	isOwner := user.EggsID == c.Hub.Owner.EggsID
+	if !isOwner && !(message.Type == "start" && h.isCohost(user.EggsID)) {
+		return forbidden(message.Type)
+	}
+
+	switch message.Type {
+	case "start":
+		var songStub SongPayload
+		err = message.decodePayload(&songStub)
+		if err != nil {
+			return
+		}
+		h.playSong(RawSongStub(songStub).ToSongStub())
+		h.save()
+		h.sendSync()
+	case "setTitle":
+		var title TitlePayload
+		err = message.decodePayload(&title)
+		if err != nil {
+			return
+		}
+		h.setTitle(string(title))
+		h.save()
+	case "setVisibility":
+		var visibility VisibilityPayload
+		err = message.decodePayload(&visibility)
+		if err != nil {
+			return
+		}
+		err = h.SetVisibility(string(visibility))
+		if err != nil {
+			return protocolError(ErrorInvalidPayload, message.Type, err)
+		}
+	case "blockedUsers":
+		var blockedUsers UsersPayload
+		err = message.decodePayload(&blockedUsers)
+		if err != nil {
+			return
+		}
+		logging.WebsocketMessage("blockedUsers", user.EggsID, strings.Join(blockedUsers, ","))
+		blocked := make([]string, 0, len(blockedUsers))
+		for _, blockedUser := range blockedUsers {
+			if blockedUser != c.Hub.Owner.EggsID {
+				blocked = append(blocked, blockedUser)
 			}
 		}
-
-		reply, err := json.Marshal(AuthedMessage{
-			Privileged: c.Hub.Owner.EggsID == user.EggsID,
-			Blocked:    user.EggsID == "" || c.Hub.Hub.Blocklist[user.EggsID],
-			Sender:     user,
-			Message:    string(bytes.TrimSpace(bytes.Replace(rawMessage, newline, space, -1))),
-		})
+		h.blockUsers(blocked)
+	case "unblockedUsers":
+		var unblockedUsers UsersPayload
+		err = message.decodePayload(&unblockedUsers)
 		if err != nil {
-			logging.WebsocketError(err)
-			break
+			return
 		}
-		c.Hub.Hub.Broadcast <- reply
+		h.unblockUsers(unblockedUsers)
 	}
+	return
 }
 
 // writePump pumps messages from the hub to the websocket connection.
@@ -210,11 +383,11 @@ func (c *Client) WritePump() {
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
-	// Registered clients.
+	// Registered clients. Only run may touch them.
 	Clients map[*Client]bool
 
-	// Inbound messages from the clients.
-	Broadcast chan []byte
+	// Broadcasts to the room, from this instance or another.
+	Broadcast chan BroadcastMessage
 
 	// Register requests from the clients.
 	Register chan *Client
@@ -222,20 +395,151 @@ type Hub struct {
 	// Unregister requests from clients.
 	Unregister chan *Client
 
+	// Messages for a single client, such as error frames.
+	Direct chan directMessage
+
 	// Owner of hub
 	Owner queries.UserStub
 
+	// Guards Song, Title, Visibility, Blocklist, Cohosts, mutes, listeners,
+	// roster, session and chats, which clients change from their own goroutines.
+	mu sync.RWMutex
+
 	// Currently playing song
 	Song SongStub
 
 	// Room title
 	Title string
 
+	// Who can see and join the room
+	Visibility string
+
 	// Blocklist
 	Blocklist map[string]bool
+
+	// Users who may control playback alongside the owner
+	Cohosts map[string]bool
+
+	// Muted users, and when their mute ends
+	mutes map[string]time.Time
+
+	// Number of clients, for readers outside run
+	listeners int
+
+	// Everyone in the room on any instance, for readers outside run
+	roster []queries.UserStub
+
+	// Rosters of the other instances serving the room, by instance. Only
+	// touched by run.
+	remoteRosters map[string][]queries.UserStub
+
+	// Time the room was first opened
+	Created time.Time
+
+	// Recap of this time the room was open, and chats yet to be added to it
+	session int64
+	chats   int
+
+	// Most users in the room at once since the recap was last updated. Only
+	// touched by run.
+	peakListeners int
+
+	// Recent chat messages, replayed to clients when they join
+	History *history
+
+	// Upcoming songs and listener suggestions
+	Queue *queue
+
+	// Position of the owner's player
+	Playback *playback
+
+	// Reactions and votes on the current and past tracks
+	Feedback *feedback
+
+	// Limits how quickly clients may send messages
+	limiter *rateLimiter
+
+	// Whether the room is served by another instance, which this one relays
+	// client messages to.
+	Mirror bool
+
+	// Ends the room's subscription to the backend. Set by run.
+	unsubscribe func()
+
+	// Closed when the room closes.
+	done chan struct{}
+}
+
+func (h *Hub) setSong(song SongStub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Song = song
+}
+
+func (h *Hub) setTitle(title string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Title = title
+}
+
+func (h *Hub) block(users []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, user := range users {
+		h.Blocklist[user] = true
+	}
+}
+
+func (h *Hub) unblock(users []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, user := range users {
+		delete(h.Blocklist, user)
+	}
+}
+
+func (h *Hub) isBlocked(user string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.Blocklist[user]
+}
+
+func (h *Hub) setListeners(listeners int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.listeners = listeners
+}
+
+// public describes the room for the room list. The roster is only included
+// when asked for, and never for users the owner has blocked.
+func (h *Hub) public(viewer string, withRoster bool) PublicHub {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	publicHub := PublicHub{
+		Owner:      h.Owner,
+		Title:      h.Title,
+		Song:       h.Song,
+		Visibility: h.Visibility,
+		Listeners:  h.listeners,
+	}
+	if withRoster && viewer != "" && !h.Blocklist[viewer] {
+		publicHub.Roster = append([]queries.UserStub{}, h.roster...)
+	}
+	return publicHub
+}
+
+// Join registers a client with the hub. It fails if the room has closed.
+func (h *Hub) Join(client *Client) error {
+	select {
+	case h.Register <- client:
+		return nil
+	case <-h.done:
+		return ErrRoomNotFound
+	}
 }
 
 type RawSongStub struct {
+	MusicID       string `json:"musicId"`
 	MusicTitle    string `json:"musicTitle"`
 	ImageDataPath string `json:"imageDataPath"`
 	ArtistData    struct {
@@ -246,6 +550,7 @@ type RawSongStub struct {
 
 func (s RawSongStub) ToSongStub() SongStub {
 	return SongStub{
+		MusicID:             s.MusicID,
 		Title:               s.MusicTitle,
 		Artist:              s.ArtistData.DisplayName,
 		MusicImageDataPath:  s.ImageDataPath,
@@ -254,17 +559,19 @@ func (s RawSongStub) ToSongStub() SongStub {
 }
 
 type SongStub struct {
+	MusicID             string `json:"musicId"`
 	Title               string `json:"title"`
 	Artist              string `json:"artist"`
 	MusicImageDataPath  string `json:"musicImageDataPath"`
 	ArtistImageDataPath string `json:"artistImageDataPath"`
 }
 
-func newHub(owner queries.UserStub) *Hub {
+func newHub(owner queries.UserStub, mirror bool) *Hub {
 	return &Hub{
-		Broadcast:  make(chan []byte),
+		Broadcast:  make(chan BroadcastMessage),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
+		Direct:     make(chan directMessage),
 		Clients:    make(map[*Client]bool),
 		Owner:      owner,
 		Song: SongStub{
@@ -273,73 +580,287 @@ func newHub(owner queries.UserStub) *Hub {
 			MusicImageDataPath:  "",
 			ArtistImageDataPath: "",
 		},
-		Title:     owner.EggsID + "のルーム",
-		Blocklist: make(map[string]bool),
+		Title:         owner.EggsID + "のルーム",
+		Visibility:    VisibilityPublic,
+		Blocklist:     make(map[string]bool),
+		Cohosts:       make(map[string]bool),
+		mutes:         make(map[string]time.Time),
+		remoteRosters: make(map[string][]queries.UserStub),
+		Created:       time.Now(),
+		History:       newHistory(historySize),
+		Queue:         newQueue(),
+		Playback:      newPlayback(realClock{}),
+		Feedback:      newFeedback(realClock{}),
+		limiter:       newRateLimiter(rateLimits, realClock{}),
+		Mirror:        mirror,
+		done:          make(chan struct{}),
+	}
+}
+
+// save persists the room state so it can be restored after a restart.
+func (h *Hub) save() {
+	h.mu.RLock()
+	title := h.Title
+	visibility := h.Visibility
+	session := h.session
+	blocklist := make([]string, 0, len(h.Blocklist))
+	for blockedUser := range h.Blocklist {
+		blocklist = append(blocklist, blockedUser)
+	}
+	cohosts := h.cohostsLocked()
+	song, err := json.Marshal(h.Song)
+	h.mu.RUnlock()
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	items, _ := h.Queue.snapshot()
+	queued, err := json.Marshal(items)
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	err = store.SaveRoom(context.Background(), queries.Room{
+		Owner:       h.Owner,
+		Title:       title,
+		Blocklist:   blocklist,
+		Song:        song,
+		Queue:       queued,
+		CreatedTime: h.Created,
+		InstanceID:  instanceID,
+		Cohosts:     cohosts,
+		Visibility:  visibility,
+		SessionID:   session,
+	})
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+}
+
+// close disconnects the room's clients and forgets the room. Unless keep is
+// set, as on shutdown, the room is also deleted. Mirrors never delete it, as the
+// room lives on at the instance serving it.
+func (h *Hub) close(keep bool) {
+	for client := range h.Clients {
+		close(client.Send)
+		delete(h.Clients, client)
+	}
+	h.updatePresence()
+	h.publishPresence(false)
+	close(h.done)
+	h.unsubscribe()
+	if !h.Mirror {
+		h.endSession(keep)
+	}
+	if !keep && !h.Mirror {
+		h.publish(kindClose, nil)
+		err := store.DeleteRoom(context.Background(), h.Owner.EggsID)
+		if err != nil {
+			logging.WebsocketError(err)
+		}
+	}
+	hubs.remove(h)
+}
+
+// replayHistory sends the buffered chat messages to a client that just joined.
+func (h *Hub) replayHistory(client *Client) {
+	for _, message := range h.History.all() {
+		b, err := json.Marshal(message)
+		if err != nil {
+			logging.WebsocketError(err)
+			continue
+		}
+		select {
+		case client.Send <- b:
+		default:
+			return
+		}
+	}
+}
+
+// sendQueue sends the full queue to a client that just joined.
+func (h *Hub) sendQueue(client *Client) {
+	h.sendTo(client, h.Queue.event("snapshot", nil))
+}
+
+// sendTo sends an event to a single client, dropping it if the client is behind.
+func (h *Hub) sendTo(client *Client, event any) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	select {
+	case client.Send <- b:
+	default:
+	}
+}
+
+// sendSync broadcasts the playback position.
+func (h *Hub) sendSync() {
+	h.publish(kindSync, h.Playback.event())
+}
+
+// broadcast sends a message to every client, dropping clients that are behind.
+func (h *Hub) broadcast(message []byte) {
+	var before map[string]queries.UserStub
+	for client := range h.Clients {
+		select {
+		case client.Send <- message:
+		default:
+			if before == nil {
+				before = h.rosterSet()
+			}
+			close(client.Send)
+			delete(h.Clients, client)
+		}
+	}
+	if before != nil {
+		h.clientsChanged(before)
 	}
 }
 
-func (h *Hub) run() {
+// run handles the room until its last client leaves or ctx is cancelled.
+// Restored rooms are given an expiry, after which they close if nobody has
+// rejoined.
+func (h *Hub) run(ctx context.Context, expiry <-chan time.Time) {
+	messages, unsubscribe := backend.Subscribe(h.Owner.EggsID)
+	h.unsubscribe = unsubscribe
+	go h.forward(messages)
+	h.publishPresence(true)
+	if !h.Mirror {
+		h.startSession()
+	}
+
+	ticker := time.NewTicker(syncPeriod)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			h.close(true)
+			return
+		case <-ticker.C:
+			if h.Mirror || !h.Playback.loaded() {
+				continue
+			}
+			h.sendSync()
+		case <-expiry:
+			if len(h.Clients) == 0 && (h.Mirror || !h.hasRemoteListeners()) {
+				h.close(false)
+				return
+			}
 		case client := <-h.Register:
+			before := h.rosterSet()
 			h.Clients[client] = true
+			h.clientsChanged(before)
+			expiry = nil
+			h.replayHistory(client)
+			h.sendQueue(client)
+			h.sendTo(client, h.moderationEvent("snapshot", "", nil))
+			h.sendTo(client, h.rosterEvent())
+			h.sendTo(client, h.Feedback.event("snapshot"))
+			if h.Playback.loaded() {
+				h.sendTo(client, h.Playback.event())
+			}
 		case client := <-h.Unregister:
 			if _, ok := h.Clients[client]; ok {
+				before := h.rosterSet()
 				delete(h.Clients, client)
 				close(client.Send)
+				h.clientsChanged(before)
 
 				if len(h.Clients) == 0 {
-					// cleanup
-					close(h.Unregister)
-					close(h.Broadcast)
-					close(h.Register)
-					delete(hubs, h.Owner.EggsID)
-					h = nil
-					return
+					if h.Mirror {
+						h.publish(kindLeave, nil)
+					}
+					if h.Mirror || !h.hasRemoteListeners() {
+						h.close(false)
+						return
+					}
 				}
 			}
 		case message := <-h.Broadcast:
-			for client := range h.Clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.Clients, client)
-				}
+			if h.receive(message) {
+				return
+			}
+		case direct := <-h.Direct:
+			if h.Clients[direct.client] {
+				h.sendTo(direct.client, direct.event)
 			}
 		}
 	}
 }
 
-func AttachHub(userStub queries.UserStub) {
-	hubs[userStub.EggsID] = &AuthedHub{
-		Hub:   newHub(userStub),
+// AttachHub opens a room for the user, or keeps their existing room so that an
+// owner reconnecting after a restart gets the same state back. Visibility is
+// left as it is when empty, and new rooms default to public. Followers are
+// notified of new rooms unless they are invite only.
+func AttachHub(userStub queries.UserStub, visibility string) error {
+	if visibility != "" && !validVisibility(visibility) {
+		return errInvalidVisibility
+	}
+	if existing := FindHub(userStub.EggsID); existing != nil {
+		if visibility == "" {
+			return nil
+		}
+		return existing.Hub.SetVisibility(visibility)
+	}
+	h := newHub(userStub, false)
+	if visibility != "" {
+		h.Visibility = visibility
+	}
+	blocked, err := store.GetBlocks(context.Background(), userStub.EggsID)
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+	h.block(blocked)
+	current, added := hubs.add(&AuthedHub{
+		Hub:   h,
 		Owner: userStub,
+	}, nil)
+	if !added {
+		if current != nil && visibility != "" {
+			return current.Hub.SetVisibility(visibility)
+		}
+		return nil
 	}
-	go hubs[userStub.EggsID].Hub.run()
+	current.Hub.save()
+	if h.visibility() != VisibilityInvite {
+		err = store.NotifyRoomStart(context.Background(), userStub.EggsID)
+		if err != nil {
+			logging.WebsocketError(err)
+		}
+	}
+	return nil
 }
 
 func GetHub(user string) *AuthedHub {
-	return hubs[user]
+	return hubs.get(user)
 }
 
 type PublicHub struct {
-	Owner     queries.UserStub `json:"owner"`
-	Title     string           `json:"title"`
-	Song      SongStub         `json:"song"`
-	Listeners int              `json:"listeners"`
+	Owner      queries.UserStub   `json:"owner"`
+	Title      string             `json:"title"`
+	Song       SongStub           `json:"song"`
+	Visibility string             `json:"visibility"`
+	Listeners  int                `json:"listeners"`
+	Roster     []queries.UserStub `json:"roster,omitempty"`
 }
 
-func GetHubs() []PublicHub {
+// GetHubs lists the open rooms viewer may see. viewer is empty for anonymous
+// requests. Rosters are included if withRoster is set and viewer may see them.
+func GetHubs(viewer string, withRoster bool) []PublicHub {
+	if backend.Distributed() {
+		publicHubs, err := getClusterHubs(viewer, withRoster)
+		if err == nil {
+			return visibleRooms(viewer, publicHubs)
+		}
+		logging.WebsocketError(err)
+	}
 	var publicHubs []PublicHub
-	for _, hub := range hubs {
-		publicHubs = append(publicHubs, PublicHub{
-			Owner:     hub.Owner,
-			Title:     hub.Hub.Title,
-			Song:      hub.Hub.Song,
-			Listeners: len(hub.Hub.Clients),
-		})
+	for _, hub := range hubs.list() {
+		publicHubs = append(publicHubs, hub.Hub.public(viewer, withRoster))
 	}
 
-	return publicHubs
+	return visibleRooms(viewer, publicHubs)
 }
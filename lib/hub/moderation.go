@@ -0,0 +1,209 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// ModerationEvent is broadcast whenever the owner moderates the room, and sent
+// to clients when they join. It always carries the full list of co-hosts.
+type ModerationEvent struct {
+	Type    string     `json:"type"`
+	Action  string     `json:"action"`
+	User    string     `json:"user,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+	Cohosts []string   `json:"cohosts"`
+}
+
+var errModerateOwner = errors.New("the room owner cannot be moderated")
+
+func (h *Hub) isCohost(user string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.Cohosts[user]
+}
+
+// canControlPlayback reports whether user may start, pause, seek and skip.
+func (h *Hub) canControlPlayback(user string) bool {
+	return user == h.Owner.EggsID || h.isCohost(user)
+}
+
+func (h *Hub) promote(user string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Cohosts[user] = true
+}
+
+func (h *Hub) demote(user string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.Cohosts, user)
+}
+
+func (h *Hub) cohosts() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cohostsLocked()
+}
+
+func (h *Hub) cohostsLocked() []string {
+	cohosts := make([]string, 0, len(h.Cohosts))
+	for cohost := range h.Cohosts {
+		cohosts = append(cohosts, cohost)
+	}
+	sort.Strings(cohosts)
+	return cohosts
+}
+
+func (h *Hub) setCohosts(cohosts []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Cohosts = make(map[string]bool, len(cohosts))
+	for _, cohost := range cohosts {
+		h.Cohosts[cohost] = true
+	}
+}
+
+func (h *Hub) mute(user string, until time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.mutes[user] = until
+}
+
+func (h *Hub) unmute(user string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.mutes, user)
+}
+
+// mutedUntil returns when the user's mute ends, if they are muted.
+func (h *Hub) mutedUntil(user string) (until time.Time, muted bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	until, muted = h.mutes[user]
+	if muted && !time.Now().Before(until) {
+		delete(h.mutes, user)
+		return time.Time{}, false
+	}
+	return
+}
+
+func (h *Hub) moderationEvent(action string, user string, until *time.Time) ModerationEvent {
+	return ModerationEvent{
+		Type:    "moderation",
+		Action:  action,
+		User:    user,
+		Until:   until,
+		Cohosts: h.cohosts(),
+	}
+}
+
+// disconnect drops every client of user from this instance. It must only be
+// called from run.
+func (h *Hub) disconnect(user string) {
+	before := h.rosterSet()
+	for client := range h.Clients {
+		if client.User.EggsID == user {
+			close(client.Send)
+			delete(h.Clients, client)
+		}
+	}
+	h.clientsChanged(before)
+}
+
+func isModerationMessage(messageType string) bool {
+	switch messageType {
+	case "kick", "mute", "unmute", "promote", "demote":
+		return true
+	}
+	return false
+}
+
+// handleModerationMessage applies a kick, mute or role change from the owner.
+// Kicked users are disconnected on every instance, but may rejoin unless they
+// are also blocked.
+func (c *Client) handleModerationMessage(user queries.UserStub, message Message) (err error) {
+	h := c.Hub.Hub
+	if user.EggsID != c.Hub.Owner.EggsID {
+		return forbidden(message.Type)
+	}
+
+	var target string
+	var until *time.Time
+	if message.Type == "mute" {
+		var mute MutePayload
+		err = message.decodePayload(&mute)
+		if err != nil {
+			return
+		}
+		if mute.Duration <= 0 {
+			return protocolError(ErrorInvalidPayload, message.Type, errors.New("mute duration must be positive"))
+		}
+		target = mute.User
+		t := time.Now().Add(time.Duration(mute.Duration) * time.Second)
+		until = &t
+	} else {
+		var payload UserPayload
+		err = message.decodePayload(&payload)
+		if err != nil {
+			return
+		}
+		target = string(payload)
+	}
+	if target == c.Hub.Owner.EggsID {
+		return protocolError(ErrorInvalidPayload, message.Type, errModerateOwner)
+	}
+
+	logging.WebsocketMessage(message.Type, user.EggsID, target)
+	switch message.Type {
+	case "mute":
+		h.mute(target, *until)
+	case "unmute":
+		h.unmute(target)
+	case "promote":
+		h.promote(target)
+		h.save()
+	case "demote":
+		h.demote(target)
+		h.save()
+	}
+	h.publish(kindModeration, h.moderationEvent(message.Type, target, until))
+	return
+}
+
+// blockUsers adds users to the owner's blocklist, which covers all of their
+// rooms, and disconnects them.
+func (h *Hub) blockUsers(users []string) {
+	if len(users) == 0 {
+		return
+	}
+	h.block(users)
+	h.save()
+	err := store.InsertBlocks(context.Background(), h.Owner.EggsID, users)
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+	for _, user := range users {
+		h.publish(kindModeration, h.moderationEvent("block", user, nil))
+	}
+}
+
+func (h *Hub) unblockUsers(users []string) {
+	h.unblock(users)
+	h.save()
+	err := store.DeleteBlocks(context.Background(), h.Owner.EggsID, users)
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+}
+
+// mutedError tells a muted client when they can chat again.
+func mutedError(until time.Time) *ProtocolError {
+	return protocolError(ErrorMuted, "chat", fmt.Errorf("muted until %s", until.UTC().Format(time.RFC3339)))
+}
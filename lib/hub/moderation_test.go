@@ -0,0 +1,204 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+func sendTestMessage(c *Client, raw string) error {
+	message, perr := decodeMessage(ProtocolV1, []byte(raw))
+	if perr != nil {
+		return perr
+	}
+	return c.handleMessage(c.User, message, []byte(raw))
+}
+
+func expectCode(t *testing.T, err error, code string) {
+	t.Helper()
+	var perr *ProtocolError
+	if !errors.As(err, &perr) || perr.Code != code {
+		t.Errorf("Got error %v, want code %s", err, code)
+	}
+}
+
+func joinTestRoom(t *testing.T, owner string, users ...string) (clients []*Client) {
+	t.Helper()
+	AttachHub(queries.UserStub{EggsID: owner}, "")
+	h := GetHub(owner)
+	for _, user := range append([]string{owner}, users...) {
+		c := &Client{
+			Hub:     h,
+			User:    queries.UserStub{EggsID: user},
+			Send:    make(chan []byte, 256),
+			Version: ProtocolV1,
+		}
+		err := h.Hub.Join(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, c)
+	}
+	return
+}
+
+// expectDisconnected waits for the hub to close the client's send channel.
+func expectDisconnected(t *testing.T, c *Client) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.Send:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("%s was not disconnected", c.User.EggsID)
+		}
+	}
+}
+
+func TestKick(t *testing.T) {
+	useTestRegistry(t)
+	clients := joinTestRoom(t, "owner", "listener", "other")
+	owner, listener, other := clients[0], clients[1], clients[2]
+
+	expectCode(t, sendTestMessage(listener, `{"type":"kick","message":"\"other\""}`), ErrorForbidden)
+	expectCode(t, sendTestMessage(owner, `{"type":"kick","message":"\"owner\""}`), ErrorInvalidPayload)
+
+	err := sendTestMessage(owner, `{"type":"kick","message":"\"listener\""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDisconnected(t, listener)
+	if len(other.Send) == 0 {
+		t.Errorf("Expected other listeners to receive the kick")
+	}
+}
+
+func TestMute(t *testing.T) {
+	useTestRegistry(t)
+	clients := joinTestRoom(t, "owner", "listener")
+	owner, listener := clients[0], clients[1]
+
+	expectCode(t, sendTestMessage(owner, `{"type":"mute","message":"{\"user\":\"listener\",\"duration\":0}"}`), ErrorInvalidPayload)
+	err := sendTestMessage(owner, `{"type":"mute","message":"{\"user\":\"listener\",\"duration\":60}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, sendTestMessage(listener, `{"type":"chat","message":"\"hello\""}`), ErrorMuted)
+
+	// An expired mute no longer applies.
+	owner.Hub.Hub.mute("listener", time.Now().Add(-time.Second))
+	err = sendTestMessage(listener, `{"type":"chat","message":"\"hello\""}`)
+	if err != nil {
+		t.Errorf("Chat after mute expired returned %v", err)
+	}
+
+	err = sendTestMessage(owner, `{"type":"mute","message":"{\"user\":\"listener\",\"duration\":60}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sendTestMessage(owner, `{"type":"unmute","message":"\"listener\""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sendTestMessage(listener, `{"type":"chat","message":"\"hello\""}`)
+	if err != nil {
+		t.Errorf("Chat after unmute returned %v", err)
+	}
+}
+
+func TestCohost(t *testing.T) {
+	useTestRegistry(t)
+	clients := joinTestRoom(t, "owner", "cohost")
+	owner, cohost := clients[0], clients[1]
+
+	expectCode(t, sendTestMessage(cohost, `{"type":"pause","message":"true"}`), ErrorForbidden)
+	err := sendTestMessage(owner, `{"type":"promote","message":"\"cohost\""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, raw := range []string{
+		`{"type":"start","message":"{\"musicId\":\"music\"}"}`,
+		`{"type":"pause","message":"true"}`,
+		`{"type":"seek","message":"1000"}`,
+		`{"type":"skip","message":""}`,
+	} {
+		err = sendTestMessage(cohost, raw)
+		if err != nil {
+			t.Errorf("Co-host sending %s returned %v", raw, err)
+		}
+	}
+	expectCode(t, sendTestMessage(cohost, `{"type":"kick","message":"\"owner\""}`), ErrorForbidden)
+	expectCode(t, sendTestMessage(cohost, `{"type":"clear","message":""}`), ErrorForbidden)
+
+	err = sendTestMessage(owner, `{"type":"demote","message":"\"cohost\""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectCode(t, sendTestMessage(cohost, `{"type":"pause","message":"false"}`), ErrorForbidden)
+}
+
+func TestBlockDisconnects(t *testing.T) {
+	useTestRegistry(t)
+	clients := joinTestRoom(t, "owner", "listener")
+	owner, listener := clients[0], clients[1]
+
+	err := sendTestMessage(owner, `{"type":"blockedUsers","message":"[\"listener\",\"owner\"]"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDisconnected(t, listener)
+	h := owner.Hub.Hub
+	if !h.isBlocked("listener") || h.isBlocked("owner") {
+		t.Errorf("Expected listener and not owner to be blocked")
+	}
+}
+
+func TestMirrorFollowsModeration(t *testing.T) {
+	useTestRegistry(t)
+	clients := joinTestRoom(t, "owner", "listener")
+	owner := clients[0]
+	received, cancel := backend.Subscribe("owner")
+	defer cancel()
+	mirror := newHub(owner.Hub.Owner, true)
+	receive := func() {
+		t.Helper()
+		select {
+		case message := <-received:
+			mirror.receive(message)
+		case <-time.After(time.Second):
+			t.Fatal("Mirror did not receive the broadcast")
+		}
+	}
+
+	err := sendTestMessage(owner, `{"type":"mute","message":"{\"user\":\"listener\",\"duration\":60}"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive()
+	if _, muted := mirror.mutedUntil("listener"); !muted {
+		t.Errorf("Expected listener to be muted on the mirror")
+	}
+
+	err = sendTestMessage(owner, `{"type":"unmute","message":"\"listener\""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive()
+	if _, muted := mirror.mutedUntil("listener"); muted {
+		t.Errorf("Expected listener to be unmuted on the mirror")
+	}
+
+	err = sendTestMessage(owner, `{"type":"blockedUsers","message":"[\"listener\"]"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive()
+	if !mirror.isBlocked("listener") {
+		t.Errorf("Expected listener to be blocked on the mirror")
+	}
+}
@@ -0,0 +1,181 @@
+package hub
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// Period between sync broadcasts while a song is loaded.
+const syncPeriod = 5 * time.Second
+
+// clock is the time source of the playback clock, so tests can control it.
+type clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// SyncEvent tells listeners where the owner's player is. Clients compare
+// Position against their own player, adjusted by how long ago ServerTime was.
+type SyncEvent struct {
+	Type       string `json:"type"`
+	MusicID    string `json:"musicId"`
+	Position   int64  `json:"position"`
+	Paused     bool   `json:"paused"`
+	ServerTime int64  `json:"serverTime"`
+}
+
+// playback is a server-side clock following the owner's player. While playing,
+// the position is derived from when position zero would have been.
+type playback struct {
+	mu        sync.Mutex
+	clock     clock
+	musicID   string
+	startedAt time.Time
+	paused    bool
+	pausedAt  time.Duration
+}
+
+func newPlayback(c clock) *playback {
+	return &playback{
+		clock:  c,
+		paused: true,
+	}
+}
+
+func (p *playback) start(musicID string, position time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.musicID = musicID
+	p.paused = false
+	p.startedAt = p.clock.Now().Add(-clampPosition(position))
+}
+
+func (p *playback) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		return
+	}
+	p.pausedAt = p.positionLocked()
+	p.paused = true
+}
+
+func (p *playback) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.paused {
+		return
+	}
+	p.startedAt = p.clock.Now().Add(-p.pausedAt)
+	p.paused = false
+}
+
+func (p *playback) seek(position time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	position = clampPosition(position)
+	if p.paused {
+		p.pausedAt = position
+		return
+	}
+	p.startedAt = p.clock.Now().Add(-position)
+}
+
+// apply follows a sync event from the instance serving the room, accounting
+// for the time the event took to arrive.
+func (p *playback) apply(event SyncEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.musicID = event.MusicID
+	p.paused = event.Paused
+	position := time.Duration(event.Position) * time.Millisecond
+	if p.paused {
+		p.pausedAt = position
+		return
+	}
+	elapsed := clampPosition(p.clock.Now().Sub(time.UnixMilli(event.ServerTime)))
+	p.startedAt = p.clock.Now().Add(-position - elapsed)
+}
+
+func (p *playback) position() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.positionLocked()
+}
+
+func (p *playback) positionLocked() time.Duration {
+	if p.paused {
+		return p.pausedAt
+	}
+	return p.clock.Now().Sub(p.startedAt)
+}
+
+func (p *playback) loaded() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.musicID != ""
+}
+
+func (p *playback) event() SyncEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return SyncEvent{
+		Type:       "sync",
+		MusicID:    p.musicID,
+		Position:   p.positionLocked().Milliseconds(),
+		Paused:     p.paused,
+		ServerTime: p.clock.Now().UnixMilli(),
+	}
+}
+
+func clampPosition(position time.Duration) time.Duration {
+	if position < 0 {
+		return 0
+	}
+	return position
+}
+
+func isPlaybackMessage(messageType string) bool {
+	return messageType == "pause" || messageType == "seek"
+}
+
+// handlePlaybackMessage applies a pause or seek from the owner and broadcasts
+// the new position. pause carries true to pause and false to resume, seek
+// carries the position in milliseconds.
+func (c *Client) handlePlaybackMessage(user queries.UserStub, message Message) (err error) {
+	h := c.Hub.Hub
+	if !h.canControlPlayback(user.EggsID) {
+		return forbidden(message.Type)
+	}
+
+	switch message.Type {
+	case "pause":
+		var paused PausePayload
+		err = message.decodePayload(&paused)
+		if err != nil {
+			return
+		}
+		if paused {
+			h.Playback.pause()
+		} else {
+			h.Playback.resume()
+		}
+	case "seek":
+		var position SeekPayload
+		err = message.decodePayload(&position)
+		if err != nil {
+			return
+		}
+		h.Playback.seek(time.Duration(position) * time.Millisecond)
+	}
+
+	h.sendSync()
+	return
+}
@@ -0,0 +1,106 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newFakePlayback() (*playback, *fakeClock) {
+	c := &fakeClock{now: time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)}
+	return newPlayback(c), c
+}
+
+func expectPosition(t *testing.T, p *playback, want time.Duration) {
+	t.Helper()
+	if got := p.position(); got != want {
+		t.Errorf("Position is %v, want %v", got, want)
+	}
+}
+
+func TestPlaybackAdvances(t *testing.T) {
+	p, c := newFakePlayback()
+	if p.loaded() {
+		t.Errorf("Expected new playback not to be loaded")
+	}
+
+	p.start("music", 0)
+	c.Advance(3 * time.Second)
+	expectPosition(t, p, 3*time.Second)
+
+	p.start("music2", 10*time.Second)
+	c.Advance(time.Second)
+	expectPosition(t, p, 11*time.Second)
+}
+
+func TestPlaybackPause(t *testing.T) {
+	p, c := newFakePlayback()
+	p.start("music", 0)
+	c.Advance(2 * time.Second)
+	p.pause()
+	c.Advance(time.Minute)
+	expectPosition(t, p, 2*time.Second)
+
+	p.pause()
+	expectPosition(t, p, 2*time.Second)
+
+	p.resume()
+	c.Advance(500 * time.Millisecond)
+	expectPosition(t, p, 2500*time.Millisecond)
+}
+
+func TestPlaybackSeek(t *testing.T) {
+	p, c := newFakePlayback()
+	p.start("music", 0)
+	c.Advance(5 * time.Second)
+	p.seek(30 * time.Second)
+	c.Advance(time.Second)
+	expectPosition(t, p, 31*time.Second)
+
+	p.seek(-10 * time.Second)
+	expectPosition(t, p, 0)
+
+	p.pause()
+	p.seek(20 * time.Second)
+	c.Advance(time.Second)
+	expectPosition(t, p, 20*time.Second)
+
+	event := p.event()
+	if event.Type != "sync" || event.MusicID != "music" || !event.Paused || event.Position != 20000 {
+		t.Errorf("Event is %+v", event)
+	}
+	if event.ServerTime != c.Now().UnixMilli() {
+		t.Errorf("ServerTime is %d, want %d", event.ServerTime, c.Now().UnixMilli())
+	}
+}
+
+func TestPlaybackApply(t *testing.T) {
+	p, c := newFakePlayback()
+	sent := c.Now().Add(-200 * time.Millisecond)
+	p.apply(SyncEvent{
+		MusicID:    "music",
+		Position:   5000,
+		ServerTime: sent.UnixMilli(),
+	})
+	expectPosition(t, p, 5200*time.Millisecond)
+
+	p.apply(SyncEvent{
+		MusicID:    "music",
+		Position:   7000,
+		Paused:     true,
+		ServerTime: sent.UnixMilli(),
+	})
+	c.Advance(time.Second)
+	expectPosition(t, p, 7*time.Second)
+}
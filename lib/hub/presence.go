@@ -0,0 +1,152 @@
+package hub
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// PresenceEvent tells clients who is in the room. A roster is sent to clients
+// when they join, and join and leave follow as users come and go. Users with
+// several tabs open are listed once, and only join with their first tab and
+// leave with their last.
+type PresenceEvent struct {
+	Type   string             `json:"type"`
+	Action string             `json:"action"`
+	User   *queries.UserStub  `json:"user,omitempty"`
+	Roster []queries.UserStub `json:"roster,omitempty"`
+}
+
+// presenceUpdate is the roster of a single instance, which it publishes
+// whenever it changes. Instances that just opened the room request everyone
+// else's.
+type presenceUpdate struct {
+	Users   []queries.UserStub `json:"users"`
+	Request bool               `json:"request,omitempty"`
+}
+
+// localUsers returns the users connected to this instance, once each.
+func (h *Hub) localUsers() map[string]queries.UserStub {
+	users := make(map[string]queries.UserStub, len(h.Clients))
+	for client := range h.Clients {
+		users[client.User.EggsID] = client.User
+	}
+	return users
+}
+
+// rosterSet returns everyone in the room on any instance. It must only be called
+// from run.
+func (h *Hub) rosterSet() map[string]queries.UserStub {
+	users := h.localUsers()
+	for _, remote := range h.remoteRosters {
+		for _, user := range remote {
+			if _, ok := users[user.EggsID]; !ok {
+				users[user.EggsID] = user
+			}
+		}
+	}
+	return users
+}
+
+func sortedUsers(set map[string]queries.UserStub) []queries.UserStub {
+	users := make([]queries.UserStub, 0, len(set))
+	for _, user := range set {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].EggsID < users[j].EggsID
+	})
+	return users
+}
+
+func (h *Hub) setRoster(roster []queries.UserStub) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.roster = roster
+}
+
+func (h *Hub) rosterEvent() PresenceEvent {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return PresenceEvent{
+		Type:   "presence",
+		Action: "roster",
+		Roster: append([]queries.UserStub{}, h.roster...),
+	}
+}
+
+// announce tells the local clients who joined or left since before was taken.
+func (h *Hub) announce(before map[string]queries.UserStub) {
+	after := h.rosterSet()
+	h.setRoster(sortedUsers(after))
+	if len(after) > h.peakListeners {
+		h.peakListeners = len(after)
+	}
+	for id, user := range after {
+		if _, ok := before[id]; !ok {
+			h.broadcastPresence("join", user)
+		}
+	}
+	for id, user := range before {
+		if _, ok := after[id]; !ok {
+			h.broadcastPresence("leave", user)
+		}
+	}
+}
+
+func (h *Hub) broadcastPresence(action string, user queries.UserStub) {
+	b, err := json.Marshal(PresenceEvent{
+		Type:   "presence",
+		Action: action,
+		User:   &user,
+	})
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	h.broadcast(b)
+}
+
+// clientsChanged is called from run after clients connect or disconnect, with
+// the roster from before.
+func (h *Hub) clientsChanged(before map[string]queries.UserStub) {
+	h.updatePresence()
+	h.announce(before)
+	h.publishPresence(false)
+}
+
+// publishPresence sends this instance's roster to the others.
+func (h *Hub) publishPresence(request bool) {
+	if !backend.Distributed() {
+		return
+	}
+	h.publish(kindPresence, presenceUpdate{
+		Users:   sortedUsers(h.localUsers()),
+		Request: request,
+	})
+}
+
+// receivePresence takes another instance's roster.
+func (h *Hub) receivePresence(message BroadcastMessage) {
+	if message.Origin == instanceID {
+		return
+	}
+	var update presenceUpdate
+	err := json.Unmarshal(message.Data, &update)
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	before := h.rosterSet()
+	if len(update.Users) == 0 {
+		delete(h.remoteRosters, message.Origin)
+	} else {
+		h.remoteRosters[message.Origin] = update.Users
+	}
+	h.announce(before)
+	if update.Request {
+		h.publishPresence(false)
+	}
+}
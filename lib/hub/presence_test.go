@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// nextPresence waits for the next presence event sent to the client.
+func nextPresence(t *testing.T, c *Client) PresenceEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case b, ok := <-c.Send:
+			if !ok {
+				t.Fatalf("%s was disconnected", c.User.EggsID)
+			}
+			var event PresenceEvent
+			if json.Unmarshal(b, &event) == nil && event.Type == "presence" {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("%s got no presence event", c.User.EggsID)
+		}
+	}
+}
+
+func rosterIDs(roster []queries.UserStub) (ids []string) {
+	for _, user := range roster {
+		ids = append(ids, user.EggsID)
+	}
+	return
+}
+
+func TestRosterDeduplicatesTabs(t *testing.T) {
+	useTestRegistry(t)
+	clients := joinTestRoom(t, "owner", "listener", "listener")
+	owner := clients[0]
+
+	event := nextPresence(t, owner)
+	if event.Action != "join" || event.User.EggsID != "owner" {
+		t.Fatalf("Got %+v, want owner joining", event)
+	}
+	if event = nextPresence(t, owner); event.Action != "roster" {
+		t.Fatalf("Got %+v, want roster", event)
+	}
+	if event = nextPresence(t, owner); event.Action != "join" || event.User.EggsID != "listener" {
+		t.Fatalf("Got %+v, want listener joining", event)
+	}
+
+	second := clients[2]
+	for event = nextPresence(t, second); event.Action != "roster"; event = nextPresence(t, second) {
+	}
+	if ids := rosterIDs(event.Roster); len(ids) != 2 || ids[0] != "listener" || ids[1] != "owner" {
+		t.Errorf("Got roster %v, want [listener owner]", ids)
+	}
+	if hubs := GetHubs("owner", true); len(hubs) != 1 || len(hubs[0].Roster) != 2 {
+		t.Errorf("GetHubs returned %+v", hubs)
+	}
+	if hubs := GetHubs("", true); len(hubs) != 1 || hubs[0].Roster != nil {
+		t.Errorf("Expected no roster for anonymous requests, got %+v", hubs)
+	}
+
+	// Closing one of two tabs leaves the user in the room.
+	clients[1].leave()
+	clients[2].leave()
+	if event = nextPresence(t, owner); event.Action != "leave" || event.User.EggsID != "listener" {
+		t.Fatalf("Got %+v, want listener leaving", event)
+	}
+	select {
+	case b := <-owner.Send:
+		t.Errorf("Got unexpected event %s", b)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRosterHiddenFromBlockedUsers(t *testing.T) {
+	useTestRegistry(t)
+	joinTestRoom(t, "owner", "listener")
+	GetHub("owner").Hub.block([]string{"blocked"})
+
+	if hubs := GetHubs("blocked", true); len(hubs) != 1 || hubs[0].Roster != nil {
+		t.Errorf("Expected no roster for blocked users, got %+v", hubs)
+	}
+}
@@ -0,0 +1,366 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+)
+
+// Protocol versions. Version 1 is the original format, where the payload is a
+// JSON-encoded string inside RawMessage. Version 2 carries the payload as plain
+// JSON inside an Envelope, and rejects message types it does not know.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+)
+
+// Subprotocols offered during the websocket handshake, preferred first.
+var Subprotocols = []string{"eggshellver.v2", "eggshellver.v1"}
+
+// RawMessage is an inbound message in protocol version 1.
+type RawMessage struct {
+	Type    string `json:"type"`
+	Message string `json:"message"`
+}
+
+// Envelope is an inbound message in protocol version 2.
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Message is an inbound message after decoding, whichever version the client
+// speaks. Payload has the same shape in both versions.
+type Message struct {
+	Version int
+	Type    string
+	Payload json.RawMessage
+}
+
+type ChatPayload string
+type SongPayload RawSongStub
+type TitlePayload string
+
+// VisibilityPayload is one of VisibilityPublic, VisibilityFollowers and
+// VisibilityInvite.
+type VisibilityPayload string
+type UsersPayload []string
+type ItemIDPayload string
+type ReorderPayload struct {
+	ID       string `json:"id"`
+	Position int    `json:"position"`
+}
+type PausePayload bool
+type SeekPayload int64
+type EmptyPayload struct{}
+type UserPayload string
+type MutePayload struct {
+	User string `json:"user"`
+	// Seconds
+	Duration int64 `json:"duration"`
+}
+type ReactionPayload string
+
+// VotePayload is VoteLike or VoteSkip.
+type VotePayload string
+
+// SkipThresholdPayload is the number of skip votes that skip a track, or 0 to
+// never skip.
+type SkipThresholdPayload int
+
+// payloadTypes maps every message type to the type of its payload.
+var payloadTypes = map[string]reflect.Type{
+	"chat":             reflect.TypeOf(ChatPayload("")),
+	"start":            reflect.TypeOf(SongPayload{}),
+	"setTitle":         reflect.TypeOf(TitlePayload("")),
+	"setVisibility":    reflect.TypeOf(VisibilityPayload("")),
+	"blockedUsers":     reflect.TypeOf(UsersPayload{}),
+	"unblockedUsers":   reflect.TypeOf(UsersPayload{}),
+	"enqueue":          reflect.TypeOf(SongPayload{}),
+	"suggest":          reflect.TypeOf(SongPayload{}),
+	"dequeue":          reflect.TypeOf(ItemIDPayload("")),
+	"approve":          reflect.TypeOf(ItemIDPayload("")),
+	"reject":           reflect.TypeOf(ItemIDPayload("")),
+	"reorder":          reflect.TypeOf(ReorderPayload{}),
+	"skip":             reflect.TypeOf(EmptyPayload{}),
+	"clear":            reflect.TypeOf(EmptyPayload{}),
+	"pause":            reflect.TypeOf(PausePayload(false)),
+	"seek":             reflect.TypeOf(SeekPayload(0)),
+	"kick":             reflect.TypeOf(UserPayload("")),
+	"mute":             reflect.TypeOf(MutePayload{}),
+	"unmute":           reflect.TypeOf(UserPayload("")),
+	"promote":          reflect.TypeOf(UserPayload("")),
+	"demote":           reflect.TypeOf(UserPayload("")),
+	"reaction":         reflect.TypeOf(ReactionPayload("")),
+	"vote":             reflect.TypeOf(VotePayload("")),
+	"setSkipThreshold": reflect.TypeOf(SkipThresholdPayload(0)),
+}
+
+// Error codes sent back to clients in an ErrorFrame.
+const (
+	ErrorInvalidEnvelope = "invalidEnvelope"
+	ErrorUnknownType     = "unknownType"
+	ErrorInvalidPayload  = "invalidPayload"
+	ErrorForbidden       = "forbidden"
+	ErrorMuted           = "muted"
+	ErrorRateLimited     = "rateLimited"
+)
+
+// ErrorFrame is sent to a client whose message could not be handled. The
+// connection stays open.
+type ErrorFrame struct {
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	Message     string `json:"message"`
+	MessageType string `json:"messageType,omitempty"`
+}
+
+type ProtocolError struct {
+	Code        string
+	MessageType string
+	Err         error
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Err.Error()
+}
+
+func protocolError(code string, messageType string, err error) *ProtocolError {
+	return &ProtocolError{
+		Code:        code,
+		MessageType: messageType,
+		Err:         err,
+	}
+}
+
+func (e *ProtocolError) Frame() ErrorFrame {
+	return ErrorFrame{
+		Type:        "error",
+		Code:        e.Code,
+		Message:     e.Err.Error(),
+		MessageType: e.MessageType,
+	}
+}
+
+func forbidden(messageType string) *ProtocolError {
+	return protocolError(ErrorForbidden, messageType, errors.New("only the room owner can do this"))
+}
+
+type directMessage struct {
+	client *Client
+	event  any
+}
+
+// sendError sends an error frame to the client through the hub, which owns the
+// client's send channel.
+func (c *Client) sendError(perr *ProtocolError) {
+	if c.relay {
+		logging.WebsocketError(perr)
+		return
+	}
+	select {
+	case c.Hub.Hub.Direct <- directMessage{
+		client: c,
+		event:  perr.Frame(),
+	}:
+	case <-c.Hub.Hub.done:
+	}
+}
+
+// handleError reports protocol errors to the client and logs anything else.
+func (c *Client) handleError(err error) {
+	if err == nil {
+		return
+	}
+	var perr *ProtocolError
+	if errors.As(err, &perr) {
+		c.sendError(perr)
+		return
+	}
+	logging.WebsocketError(err)
+}
+
+// legacyMessage is the message as relayed to other clients. Version 1 senders
+// keep their original encoding.
+func (c *Client) legacyMessage(message Message, rawMessage []byte) string {
+	if message.Version == ProtocolV1 {
+		return string(bytes.TrimSpace(bytes.Replace(rawMessage, newline, space, -1)))
+	}
+	return message.Legacy()
+}
+
+// NegotiateVersion picks the protocol version from the accepted subprotocol, or
+// the v query parameter for clients that cannot set subprotocols.
+func NegotiateVersion(subprotocol string, queryVersion string) int {
+	if subprotocol == "eggshellver.v2" || queryVersion == "2" {
+		return ProtocolV2
+	}
+	return ProtocolV1
+}
+
+// decodeMessage decodes and validates an inbound message. Version 1 lets unknown
+// types through so that older clients can keep using their own message types.
+func decodeMessage(version int, b []byte) (message Message, perr *ProtocolError) {
+	message.Version = version
+	if version == ProtocolV2 {
+		var envelope Envelope
+		err := json.Unmarshal(b, &envelope)
+		if err != nil {
+			perr = protocolError(ErrorInvalidEnvelope, "", err)
+			return
+		}
+		if envelope.Version != ProtocolV2 {
+			perr = protocolError(ErrorInvalidEnvelope, envelope.Type, errors.New("unsupported protocol version"))
+			return
+		}
+		message.Type = envelope.Type
+		message.Payload = envelope.Payload
+	} else {
+		var raw RawMessage
+		err := json.Unmarshal(b, &raw)
+		if err != nil {
+			perr = protocolError(ErrorInvalidEnvelope, "", err)
+			return
+		}
+		message.Type = raw.Type
+		message.Payload = json.RawMessage(raw.Message)
+	}
+	if len(bytes.TrimSpace(message.Payload)) == 0 {
+		message.Payload = json.RawMessage("null")
+	}
+
+	payloadType, ok := payloadTypes[message.Type]
+	if !ok {
+		if version == ProtocolV2 {
+			perr = protocolError(ErrorUnknownType, message.Type, errors.New("unknown message type"))
+		}
+		return
+	}
+	err := json.Unmarshal(message.Payload, reflect.New(payloadType).Interface())
+	if err != nil {
+		perr = protocolError(ErrorInvalidPayload, message.Type, err)
+	}
+	return
+}
+
+// Legacy returns the message in protocol version 1, which is what every client
+// receives inside an AuthedMessage.
+func (m Message) Legacy() string {
+	payload := string(m.Payload)
+	if payload == "null" {
+		payload = ""
+	}
+	b, err := json.Marshal(RawMessage{
+		Type:    m.Type,
+		Message: payload,
+	})
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// decodePayload decodes the payload of a message that decodeMessage has already
+// validated.
+func (m Message) decodePayload(v any) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// Schema returns a JSON schema describing protocol version 2, for clients to
+// validate against.
+func Schema() ([]byte, error) {
+	types := make([]string, 0, len(payloadTypes))
+	for messageType := range payloadTypes {
+		types = append(types, messageType)
+	}
+	sort.Strings(types)
+
+	inbound := make([]any, 0, len(types))
+	for _, messageType := range types {
+		inbound = append(inbound, map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"v":       map[string]any{"const": ProtocolV2},
+				"type":    map[string]any{"const": messageType},
+				"payload": schemaFor(payloadTypes[messageType]),
+			},
+			"required":             []string{"v", "type", "payload"},
+			"additionalProperties": false,
+		})
+	}
+
+	outbound := make([]any, 0)
+	for _, event := range []any{AuthedMessage{}, QueueEvent{}, SyncEvent{}, ModerationEvent{}, PresenceEvent{}, FeedbackEvent{}, ErrorFrame{}} {
+		outbound = append(outbound, schemaFor(reflect.TypeOf(event)))
+	}
+
+	return json.MarshalIndent(map[string]any{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   "eggshellver websocket protocol v2",
+		"$ref":    "#/definitions/inbound",
+		"definitions": map[string]any{
+			"inbound":  map[string]any{"oneOf": inbound},
+			"outbound": map[string]any{"anyOf": outbound},
+		},
+	}, "", "  ")
+}
+
+func schemaFor(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return map[string]any{}
+	}
+	if t.PkgPath() == "time" && t.Name() == "Time" {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]any{}
+		required := make([]string, 0)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaFor(field.Type)
+			if !strings.Contains(options, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		if t.NumField() == 0 {
+			return map[string]any{"type": []string{"object", "null"}}
+		}
+		return map[string]any{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		}
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,112 @@
+package hub
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeMessage(t *testing.T) {
+	message, perr := decodeMessage(ProtocolV1, []byte(`{"type":"chat","message":"\"hello\""}`))
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	var chat ChatPayload
+	err := message.decodePayload(&chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chat != "hello" {
+		t.Errorf("Chat payload is %q, want %q", chat, "hello")
+	}
+
+	message, perr = decodeMessage(ProtocolV2, []byte(`{"v":2,"type":"reorder","payload":{"id":"a","position":3}}`))
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	var reorder ReorderPayload
+	err = message.decodePayload(&reorder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reorder.ID != "a" || reorder.Position != 3 {
+		t.Errorf("Reorder payload is %+v, want {ID:a Position:3}", reorder)
+	}
+	if legacy := message.Legacy(); legacy != `{"type":"reorder","message":"{\"id\":\"a\",\"position\":3}"}` {
+		t.Errorf("Legacy message is %s", legacy)
+	}
+
+	message, perr = decodeMessage(ProtocolV2, []byte(`{"v":2,"type":"skip"}`))
+	if perr != nil {
+		t.Fatal(perr)
+	}
+	if string(message.Payload) != "null" {
+		t.Errorf("Empty payload is %s, want null", message.Payload)
+	}
+}
+
+func TestDecodeMessageErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		message string
+		code    string
+	}{
+		{"malformed v1", ProtocolV1, `{"type":`, ErrorInvalidEnvelope},
+		{"malformed v2", ProtocolV2, `not json`, ErrorInvalidEnvelope},
+		{"wrong version", ProtocolV2, `{"v":1,"type":"chat","payload":"hi"}`, ErrorInvalidEnvelope},
+		{"unknown type v2", ProtocolV2, `{"v":2,"type":"dance","payload":null}`, ErrorUnknownType},
+		{"invalid payload v1", ProtocolV1, `{"type":"seek","message":"\"soon\""}`, ErrorInvalidPayload},
+		{"invalid payload v2", ProtocolV2, `{"v":2,"type":"blockedUsers","payload":"everyone"}`, ErrorInvalidPayload},
+	}
+	for _, test := range tests {
+		_, perr := decodeMessage(test.version, []byte(test.message))
+		if perr == nil {
+			t.Errorf("%s: expected error", test.name)
+			continue
+		}
+		if perr.Code != test.code {
+			t.Errorf("%s: error code is %s, want %s", test.name, perr.Code, test.code)
+		}
+		if frame := perr.Frame(); frame.Type != "error" || frame.Message == "" {
+			t.Errorf("%s: bad error frame %+v", test.name, frame)
+		}
+	}
+
+	_, perr := decodeMessage(ProtocolV1, []byte(`{"type":"dance","message":"anything"}`))
+	if perr != nil {
+		t.Errorf("Unknown v1 type should pass through, got %v", perr)
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	if v := NegotiateVersion("eggshellver.v2", ""); v != ProtocolV2 {
+		t.Errorf("Subprotocol v2 negotiated %d", v)
+	}
+	if v := NegotiateVersion("", "2"); v != ProtocolV2 {
+		t.Errorf("Query v2 negotiated %d", v)
+	}
+	if v := NegotiateVersion("", ""); v != ProtocolV1 {
+		t.Errorf("Default negotiated %d", v)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	b, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Definitions struct {
+			Inbound struct {
+				OneOf []json.RawMessage `json:"oneOf"`
+			} `json:"inbound"`
+		} `json:"definitions"`
+	}
+	err = json.Unmarshal(b, &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schema.Definitions.Inbound.OneOf) != len(payloadTypes) {
+		t.Errorf("Schema has %d inbound messages, want %d", len(schema.Definitions.Inbound.OneOf), len(payloadTypes))
+	}
+}
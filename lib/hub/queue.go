@@ -0,0 +1,325 @@
+package hub
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+type QueueItem struct {
+	ID      string           `json:"id"`
+	Song    SongStub         `json:"song"`
+	AddedBy queries.UserStub `json:"addedBy"`
+}
+
+// QueueEvent is broadcast whenever the queue changes, and sent to clients when
+// they join. It always carries the full queue so clients never drift.
+type QueueEvent struct {
+	Type        string      `json:"type"`
+	Action      string      `json:"action"`
+	Item        *QueueItem  `json:"item,omitempty"`
+	Queue       []QueueItem `json:"queue"`
+	Suggestions []QueueItem `json:"suggestions"`
+}
+
+var errQueueItemNotFound = errors.New("queue item not found")
+
+// Limits on pending suggestions, so that listeners cannot grow the queue, and
+// every QueueEvent with it, without bound.
+const (
+	maxSuggestions        = 50
+	maxSuggestionsPerUser = 3
+)
+
+var (
+	errTooManySuggestions     = errors.New("the room has too many pending suggestions")
+	errTooManyUserSuggestions = errors.New("you have too many pending suggestions")
+)
+
+// queue holds the upcoming songs of a room, and songs suggested by listeners that
+// the owner has not yet approved.
+type queue struct {
+	mu          sync.Mutex
+	items       []QueueItem
+	suggestions []QueueItem
+}
+
+func newQueue() *queue {
+	return &queue{
+		items:       make([]QueueItem, 0),
+		suggestions: make([]QueueItem, 0),
+	}
+}
+
+func indexOf(items []QueueItem, id string) int {
+	for i, item := range items {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (q *queue) enqueue(item QueueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, item)
+}
+
+func (q *queue) dequeue(id string) (item QueueItem, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := indexOf(q.items, id)
+	if i == -1 {
+		err = errQueueItemNotFound
+		return
+	}
+	item = q.items[i]
+	q.items = append(q.items[:i], q.items[i+1:]...)
+	return
+}
+
+// reorder moves an item to position, clamped to the bounds of the queue.
+func (q *queue) reorder(id string, position int) (item QueueItem, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := indexOf(q.items, id)
+	if i == -1 {
+		err = errQueueItemNotFound
+		return
+	}
+	item = q.items[i]
+	q.items = append(q.items[:i], q.items[i+1:]...)
+	if position < 0 {
+		position = 0
+	}
+	if position > len(q.items) {
+		position = len(q.items)
+	}
+	q.items = append(q.items[:position], append([]QueueItem{item}, q.items[position:]...)...)
+	return
+}
+
+// skip takes the next item off the queue.
+func (q *queue) skip() (item QueueItem, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return
+	}
+	item = q.items[0]
+	q.items = q.items[1:]
+	ok = true
+	return
+}
+
+func (q *queue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = make([]QueueItem, 0)
+}
+
+// suggest adds a suggestion, unless the room or the user suggesting it already
+// has as many pending as allowed.
+func (q *queue) suggest(item QueueItem) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.suggestions) >= maxSuggestions {
+		return errTooManySuggestions
+	}
+	pending := 0
+	for _, suggestion := range q.suggestions {
+		if suggestion.AddedBy.EggsID == item.AddedBy.EggsID {
+			pending++
+		}
+	}
+	if pending >= maxSuggestionsPerUser {
+		return errTooManyUserSuggestions
+	}
+	q.suggestions = append(q.suggestions, item)
+	return nil
+}
+
+// approve moves a suggestion to the end of the queue.
+func (q *queue) approve(id string) (item QueueItem, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := indexOf(q.suggestions, id)
+	if i == -1 {
+		err = errQueueItemNotFound
+		return
+	}
+	item = q.suggestions[i]
+	q.suggestions = append(q.suggestions[:i], q.suggestions[i+1:]...)
+	q.items = append(q.items, item)
+	return
+}
+
+func (q *queue) reject(id string) (item QueueItem, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := indexOf(q.suggestions, id)
+	if i == -1 {
+		err = errQueueItemNotFound
+		return
+	}
+	item = q.suggestions[i]
+	q.suggestions = append(q.suggestions[:i], q.suggestions[i+1:]...)
+	return
+}
+
+func (q *queue) restore(items []QueueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = items
+}
+
+// replace takes on the queue of the instance serving the room.
+func (q *queue) replace(items []QueueItem, suggestions []QueueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = items
+	q.suggestions = suggestions
+}
+
+// snapshot returns copies of the queue and suggestions.
+func (q *queue) snapshot() (items []QueueItem, suggestions []QueueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items = append(make([]QueueItem, 0, len(q.items)), q.items...)
+	suggestions = append(make([]QueueItem, 0, len(q.suggestions)), q.suggestions...)
+	return
+}
+
+func (q *queue) event(action string, item *QueueItem) QueueEvent {
+	items, suggestions := q.snapshot()
+	return QueueEvent{
+		Type:        "queue",
+		Action:      action,
+		Item:        item,
+		Queue:       items,
+		Suggestions: suggestions,
+	}
+}
+
+func isQueueMessage(messageType string) bool {
+	switch messageType {
+	case "enqueue", "dequeue", "reorder", "skip", "clear", "suggest", "approve", "reject":
+		return true
+	}
+	return false
+}
+
+func newQueueItem(message Message, user queries.UserStub) (item QueueItem, err error) {
+	var songStub SongPayload
+	err = message.decodePayload(&songStub)
+	if err != nil {
+		return
+	}
+	id, err := queries.GenerateRandomString(16)
+	if err != nil {
+		return
+	}
+	item = QueueItem{
+		ID:      id,
+		Song:    RawSongStub(songStub).ToSongStub(),
+		AddedBy: user,
+	}
+	return
+}
+
+// handleQueueMessage applies a queue message and broadcasts the result. Only
+// suggest is open to listeners and skip to co-hosts, everything else is
+// reserved for the owner.
+func (c *Client) handleQueueMessage(user queries.UserStub, message Message) (err error) {
+	h := c.Hub.Hub
+	isOwner := user.EggsID == c.Hub.Owner.EggsID
+	allowed := isOwner || message.Type == "suggest" || (message.Type == "skip" && h.isCohost(user.EggsID))
+	if !allowed {
+		return forbidden(message.Type)
+	}
+
+	var item QueueItem
+	switch message.Type {
+	case "enqueue":
+		item, err = newQueueItem(message, user)
+		if err != nil {
+			return
+		}
+		h.Queue.enqueue(item)
+	case "suggest":
+		if h.isBlocked(user.EggsID) {
+			return
+		}
+		item, err = newQueueItem(message, user)
+		if err != nil {
+			return
+		}
+		err = h.Queue.suggest(item)
+		if err != nil {
+			return protocolError(ErrorInvalidPayload, message.Type, err)
+		}
+	case "dequeue", "approve", "reject":
+		var id ItemIDPayload
+		err = message.decodePayload(&id)
+		if err != nil {
+			return
+		}
+		switch message.Type {
+		case "dequeue":
+			item, err = h.Queue.dequeue(string(id))
+		case "approve":
+			item, err = h.Queue.approve(string(id))
+		case "reject":
+			item, err = h.Queue.reject(string(id))
+		}
+		if err == errQueueItemNotFound {
+			// Another message got there first, nothing to do.
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	case "reorder":
+		var reorder ReorderPayload
+		err = message.decodePayload(&reorder)
+		if err != nil {
+			return
+		}
+		item, err = h.Queue.reorder(reorder.ID, reorder.Position)
+		if err == errQueueItemNotFound {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+	case "skip":
+		h.skip()
+		return
+	case "clear":
+		h.Queue.clear()
+	}
+
+	h.save()
+	event := h.Queue.event(message.Type, nil)
+	if message.Type != "clear" {
+		event.Item = &item
+	}
+	h.publish(kindQueue, event)
+	return
+}
+
+// skip plays the next song in the queue, if there is one.
+func (h *Hub) skip() {
+	item, ok := h.Queue.skip()
+	if !ok {
+		return
+	}
+	h.playSong(item.Song)
+	h.save()
+	h.publish(kindQueue, h.Queue.event("skip", &item))
+	h.sendSync()
+}
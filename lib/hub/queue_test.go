@@ -0,0 +1,101 @@
+package hub
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+func queueIDs(q *queue) (ids []string) {
+	items, _ := q.snapshot()
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return
+}
+
+func TestQueueReorder(t *testing.T) {
+	q := newQueue()
+	for _, id := range []string{"a", "b", "c"} {
+		q.enqueue(QueueItem{ID: id})
+	}
+
+	_, err := q.reorder("c", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := queueIDs(q); len(ids) != 3 || ids[0] != "c" || ids[1] != "a" || ids[2] != "b" {
+		t.Errorf("Queue is %v, want [c a b]", ids)
+	}
+
+	_, err = q.reorder("c", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := queueIDs(q); ids[2] != "c" {
+		t.Errorf("Queue is %v, want c last", ids)
+	}
+
+	_, err = q.reorder("x", 0)
+	if err != errQueueItemNotFound {
+		t.Errorf("Error is %v, want %v", err, errQueueItemNotFound)
+	}
+}
+
+func TestQueueSuggestions(t *testing.T) {
+	q := newQueue()
+	q.suggest(QueueItem{ID: "a"})
+	q.suggest(QueueItem{ID: "b"})
+
+	_, err := q.approve("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = q.reject("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, suggestions := q.snapshot()
+	if len(items) != 1 || items[0].ID != "b" {
+		t.Errorf("Queue is %v, want [b]", items)
+	}
+	if len(suggestions) != 0 {
+		t.Errorf("Suggestions are %v, want none", suggestions)
+	}
+
+	item, ok := q.skip()
+	if !ok || item.ID != "b" {
+		t.Errorf("Skipped to %v, want b", item)
+	}
+	if _, ok = q.skip(); ok {
+		t.Errorf("Expected skip on empty queue to fail")
+	}
+}
+
+func TestQueueSuggestionLimits(t *testing.T) {
+	q := newQueue()
+	for i := 0; i < maxSuggestionsPerUser; i++ {
+		err := q.suggest(QueueItem{ID: fmt.Sprint("listener", i), AddedBy: queries.UserStub{EggsID: "listener"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := q.suggest(QueueItem{ID: "listener", AddedBy: queries.UserStub{EggsID: "listener"}})
+	if err != errTooManyUserSuggestions {
+		t.Errorf("Error is %v, want %v", err, errTooManyUserSuggestions)
+	}
+
+	for i := 0; i < maxSuggestions-maxSuggestionsPerUser; i++ {
+		user := fmt.Sprint("user", i)
+		err = q.suggest(QueueItem{ID: user, AddedBy: queries.UserStub{EggsID: user}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = q.suggest(QueueItem{ID: "other", AddedBy: queries.UserStub{EggsID: "other"}})
+	if err != errTooManySuggestions {
+		t.Errorf("Error is %v, want %v", err, errTooManySuggestions)
+	}
+}
@@ -0,0 +1,206 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+)
+
+// rateLimit lets a user send Rate messages per second on average, and up to
+// Burst at once.
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// Limit on all messages from a user, whatever their type.
+const rateLimitAll = "*"
+
+var defaultRateLimits = map[string]rateLimit{
+	rateLimitAll: {Rate: 10, Burst: 20},
+	"chat":       {Rate: 1, Burst: 5},
+	"suggest":    {Rate: 0.2, Burst: 3},
+	"reaction":   {Rate: 2, Burst: 5},
+	"vote":       {Rate: 1, Burst: 3},
+}
+
+// Once warned, a client that keeps exceeding its limits for longer than
+// throttleGrace, to let messages already sent arrive, is disconnected. The
+// warning is forgotten after throttleWindow.
+const (
+	throttleGrace  = time.Second
+	throttleWindow = 10 * time.Second
+)
+
+// Buckets are swept at most this often, and the ones that have refilled since
+// dropped, as they are no different from new ones.
+const rateLimitSweepInterval = time.Minute
+
+var errThrottled = errors.New("sending messages too quickly, slow down or you will be disconnected")
+
+// rateLimits are the defaults, overridden by ROOM_RATE_LIMITS, a comma separated
+// list of type=rate:burst such as "*=10:20,chat=1:5".
+var rateLimits = loadRateLimits(os.Getenv("ROOM_RATE_LIMITS"))
+
+func loadRateLimits(config string) map[string]rateLimit {
+	limits, err := parseRateLimits(config)
+	if err != nil {
+		logging.WebsocketError(err)
+		limits, _ = parseRateLimits("")
+	}
+	return limits
+}
+
+func parseRateLimits(config string) (limits map[string]rateLimit, err error) {
+	limits = make(map[string]rateLimit, len(defaultRateLimits))
+	for messageType, limit := range defaultRateLimits {
+		limits[messageType] = limit
+	}
+	if config == "" {
+		return
+	}
+	for _, entry := range strings.Split(config, ",") {
+		messageType, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		rate, burst, ok2 := strings.Cut(value, ":")
+		if !ok || !ok2 || messageType == "" {
+			return limits, fmt.Errorf("invalid rate limit %q, want type=rate:burst", entry)
+		}
+		var limit rateLimit
+		limit.Rate, err = strconv.ParseFloat(rate, 64)
+		if err != nil || limit.Rate <= 0 {
+			return limits, fmt.Errorf("invalid rate in rate limit %q", entry)
+		}
+		limit.Burst, err = strconv.ParseFloat(burst, 64)
+		if err != nil || limit.Burst < 1 {
+			return limits, fmt.Errorf("invalid burst in rate limit %q", entry)
+		}
+		limits[messageType] = limit
+	}
+	return
+}
+
+type tokenBucket struct {
+	limit  rateLimit
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= b.limit.Burst
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.limit.Rate
+	if b.tokens > b.limit.Burst {
+		b.tokens = b.limit.Burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimiter keeps a token bucket per user and limited message type. Users
+// with several tabs open share their buckets.
+type rateLimiter struct {
+	mu        sync.Mutex
+	clock     clock
+	limits    map[string]rateLimit
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(limits map[string]rateLimit, c clock) *rateLimiter {
+	return &rateLimiter{
+		clock:   c,
+		limits:  limits,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the user's bucket for messageType, and reports
+// whether there was one. Types without a limit are always allowed.
+func (l *rateLimiter) allow(user string, messageType string) bool {
+	limit, ok := l.limits[messageType]
+	if !ok {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now()
+	l.sweep(now)
+	key := user + "\x00" + messageType
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{
+			limit:  limit,
+			tokens: limit.Burst,
+			last:   now,
+		}
+		l.buckets[key] = bucket
+	}
+	return bucket.allow(now)
+}
+
+// sweep drops the buckets that have refilled, so that users who left do not
+// keep theirs for as long as the room is open. l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// What happens to a client that went over a limit.
+const (
+	throttleWarn = iota
+	throttleDrop
+	throttleDisconnect
+)
+
+// strike records that the client went over a limit at now. Only ReadPump calls
+// it.
+func (c *Client) strike(now time.Time) int {
+	if c.warnedAt.IsZero() || now.Sub(c.warnedAt) >= throttleWindow {
+		c.warnedAt = now
+		return throttleWarn
+	}
+	if now.Sub(c.warnedAt) < throttleGrace {
+		return throttleDrop
+	}
+	return throttleDisconnect
+}
+
+// throttle drops a message that went over a limit. It warns the client the
+// first time, and disconnects it if it carries on. It reports whether the
+// client was disconnected.
+func (c *Client) throttle(messageType string) (disconnected bool) {
+	logging.WebsocketThrottled(messageType, c.User.EggsID)
+	switch c.strike(time.Now()) {
+	case throttleWarn:
+		c.sendError(protocolError(ErrorRateLimited, messageType, errThrottled))
+	case throttleDisconnect:
+		logging.WebsocketThrottleDisconnect(c.User.EggsID)
+		c.Conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+			time.Now().Add(writeWait),
+		)
+		return true
+	}
+	return false
+}
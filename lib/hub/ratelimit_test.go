@@ -0,0 +1,96 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("*=5:10, chat=0.5:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[rateLimitAll] != (rateLimit{Rate: 5, Burst: 10}) || limits["chat"] != (rateLimit{Rate: 0.5, Burst: 2}) {
+		t.Errorf("Got limits %v", limits)
+	}
+	if limits["vote"] != defaultRateLimits["vote"] {
+		t.Errorf("Expected unconfigured types to keep their defaults")
+	}
+
+	for _, config := range []string{"chat", "chat=1", "=1:1", "chat=0:1", "chat=1:0", "chat=a:b"} {
+		if _, err := parseRateLimits(config); err == nil {
+			t.Errorf("Expected %q to be rejected", config)
+		}
+	}
+	if limits := loadRateLimits("chat=0:1"); limits["chat"] != defaultRateLimits["chat"] {
+		t.Errorf("Expected invalid config to fall back to defaults, got %v", limits["chat"])
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	c := &fakeClock{now: time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)}
+	l := newRateLimiter(map[string]rateLimit{
+		"chat": {Rate: 1, Burst: 3},
+	}, c)
+
+	for i := 0; i < 3; i++ {
+		if !l.allow("listener", "chat") {
+			t.Fatalf("Message %d within burst was throttled", i)
+		}
+	}
+	if l.allow("listener", "chat") {
+		t.Errorf("Expected message over burst to be throttled")
+	}
+	if !l.allow("other", "chat") {
+		t.Errorf("Expected users to have their own buckets")
+	}
+	if !l.allow("listener", "skip") {
+		t.Errorf("Expected types without a limit to be allowed")
+	}
+
+	c.Advance(1500 * time.Millisecond)
+	if !l.allow("listener", "chat") {
+		t.Errorf("Expected a token back after a second")
+	}
+	if l.allow("listener", "chat") {
+		t.Errorf("Expected only one token back after a second and a half")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	c := &fakeClock{now: time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)}
+	l := newRateLimiter(map[string]rateLimit{
+		"chat":   {Rate: 1, Burst: 3},
+		"invite": {Rate: 0.001, Burst: 1},
+	}, c)
+	l.allow("listener", "chat")
+	l.allow("listener", "invite")
+
+	c.Advance(rateLimitSweepInterval)
+	l.allow("other", "chat")
+	if len(l.buckets) != 2 {
+		t.Errorf("Got %d buckets, want the refilled one dropped and 2 left", len(l.buckets))
+	}
+	if l.allow("listener", "invite") {
+		t.Errorf("Expected the bucket that has not refilled to be kept")
+	}
+}
+
+func TestStrikes(t *testing.T) {
+	c := &Client{}
+	now := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		after time.Duration
+		want  int
+	}{
+		{0, throttleWarn},
+		{throttleGrace / 2, throttleDrop},
+		{throttleGrace, throttleDisconnect},
+		{throttleWindow, throttleWarn},
+	}
+	for _, step := range steps {
+		if got := c.strike(now.Add(step.after)); got != step.want {
+			t.Errorf("Strike after %v returned %d, want %d", step.after, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package hub
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// registry owns the rooms open on this instance. HTTP handlers look rooms up in
+// it while hub goroutines add and remove them, so all access goes through mu.
+type registry struct {
+	mu   sync.RWMutex
+	hubs map[string]*AuthedHub
+
+	// Cancelled to shut every room down.
+	ctx context.Context
+
+	// Running hub goroutines.
+	wg sync.WaitGroup
+}
+
+func newRegistry(ctx context.Context) *registry {
+	return &registry{
+		hubs: make(map[string]*AuthedHub),
+		ctx:  ctx,
+	}
+}
+
+func (r *registry) get(owner string) *AuthedHub {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.hubs[owner]
+}
+
+// add registers the hub and starts it, unless its owner already has one open. It
+// returns whichever hub is registered, or nil if the registry is shutting down.
+func (r *registry) add(h *AuthedHub, expiry <-chan time.Time) (current *AuthedHub, added bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ctx.Err() != nil {
+		return
+	}
+	if current, ok := r.hubs[h.Owner.EggsID]; ok {
+		return current, false
+	}
+	r.hubs[h.Owner.EggsID] = h
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		h.Hub.run(r.ctx, expiry)
+	}()
+	return h, true
+}
+
+// remove forgets the hub, unless it has already been replaced.
+func (r *registry) remove(h *Hub) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.hubs[h.Owner.EggsID]; ok && current.Hub == h {
+		delete(r.hubs, h.Owner.EggsID)
+	}
+}
+
+func (r *registry) list() []*AuthedHub {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	hubs := make([]*AuthedHub, 0, len(r.hubs))
+	for _, h := range r.hubs {
+		hubs = append(hubs, h)
+	}
+	return hubs
+}
+
+// wait blocks until every hub has stopped, or ctx is done.
+func (r *registry) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until every room has shut down after the context given to Init
+// was cancelled, or until ctx is done.
+func Wait(ctx context.Context) error {
+	return hubs.wait(ctx)
+}
+
+// roomStore persists rooms, so that tests can run hubs without a database.
+type roomStore interface {
+	SaveRoom(ctx context.Context, room queries.Room) error
+	DeleteRoom(ctx context.Context, ownerID string) error
+	GetVisibility(ctx context.Context, ownerID string) (string, error)
+	GetBlocks(ctx context.Context, ownerID string) ([]string, error)
+	InsertBlocks(ctx context.Context, ownerID string, blockedIDs []string) error
+	DeleteBlocks(ctx context.Context, ownerID string, blockedIDs []string) error
+	GetFollowedAmong(ctx context.Context, followerID string, followeeIDs []string) ([]string, error)
+	StartSession(ctx context.Context, ownerID string, title string, visibility string, started time.Time) (int64, error)
+	AddSessionTrack(ctx context.Context, sessionID int64, track TrackFeedback) error
+	UpdateSession(ctx context.Context, sessionID int64, title string, visibility string, peakListeners int, chats int, ended *time.Time) error
+	SetSessionVisibility(ctx context.Context, sessionID int64, visibility string) error
+	NotifyRoomStart(ctx context.Context, ownerID string) error
+}
+
+type dbStore struct{}
+
+func (dbStore) SaveRoom(ctx context.Context, room queries.Room) error {
+	return queries.SaveRoom(ctx, room)
+}
+
+func (dbStore) DeleteRoom(ctx context.Context, ownerID string) error {
+	return queries.DeleteRoom(ctx, ownerID)
+}
+
+func (dbStore) GetVisibility(ctx context.Context, ownerID string) (string, error) {
+	return queries.GetRoomVisibility(ctx, ownerID)
+}
+
+func (dbStore) GetBlocks(ctx context.Context, ownerID string) ([]string, error) {
+	return queries.GetBlocks(ctx, ownerID)
+}
+
+func (dbStore) InsertBlocks(ctx context.Context, ownerID string, blockedIDs []string) error {
+	_, err := queries.InsertBlocks(ctx, ownerID, blockedIDs)
+	return err
+}
+
+func (dbStore) DeleteBlocks(ctx context.Context, ownerID string, blockedIDs []string) error {
+	_, err := queries.DeleteBlocks(ctx, ownerID, blockedIDs)
+	return err
+}
+
+func (dbStore) GetFollowedAmong(ctx context.Context, followerID string, followeeIDs []string) ([]string, error) {
+	return queries.GetFollowedAmong(ctx, followerID, followeeIDs)
+}
+
+func (dbStore) StartSession(ctx context.Context, ownerID string, title string, visibility string, started time.Time) (int64, error) {
+	return queries.StartRoomSession(ctx, ownerID, title, visibility, started)
+}
+
+func (dbStore) AddSessionTrack(ctx context.Context, sessionID int64, track TrackFeedback) error {
+	return queries.InsertRoomSessionTrack(ctx, sessionID, queries.RoomSessionTrack{
+		MusicID:             track.Song.MusicID,
+		Title:               track.Song.Title,
+		Artist:              track.Song.Artist,
+		MusicImageDataPath:  track.Song.MusicImageDataPath,
+		ArtistImageDataPath: track.Song.ArtistImageDataPath,
+		Reactions:           track.Reactions,
+		Likes:               track.Likes,
+		Skips:               track.Skips,
+		StartedTime:         track.Started,
+		EndedTime:           *track.Ended,
+	})
+}
+
+func (dbStore) UpdateSession(ctx context.Context, sessionID int64, title string, visibility string, peakListeners int, chats int, ended *time.Time) error {
+	return queries.UpdateRoomSession(ctx, sessionID, title, visibility, peakListeners, chats, ended)
+}
+
+func (dbStore) SetSessionVisibility(ctx context.Context, sessionID int64, visibility string) error {
+	return queries.SetRoomSessionVisibility(ctx, sessionID, visibility)
+}
+
+func (dbStore) NotifyRoomStart(ctx context.Context, ownerID string) error {
+	return queries.NotifyRoomStart(ctx, ownerID)
+}
+
+var store roomStore = dbStore{}
@@ -0,0 +1,319 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+type memoryStore struct {
+	mu      sync.Mutex
+	saved   map[string]queries.Room
+	deleted map[string]int
+	// Followees by follower
+	follows map[string][]string
+	// Session recaps by ID
+	sessions map[int64]*testSession
+	// Owners whose followers were notified of a new room
+	roomStarts []string
+}
+
+type testSession struct {
+	owner         string
+	visibility    string
+	tracks        []TrackFeedback
+	peakListeners int
+	chats         int
+	ended         *time.Time
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		saved:    make(map[string]queries.Room),
+		deleted:  make(map[string]int),
+		follows:  make(map[string][]string),
+		sessions: make(map[int64]*testSession),
+	}
+}
+
+func (s *memoryStore) SaveRoom(ctx context.Context, room queries.Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved[room.Owner.EggsID] = room
+	return nil
+}
+
+func (s *memoryStore) GetBlocks(ctx context.Context, ownerID string) ([]string, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) InsertBlocks(ctx context.Context, ownerID string, blockedIDs []string) error {
+	return nil
+}
+
+func (s *memoryStore) DeleteBlocks(ctx context.Context, ownerID string, blockedIDs []string) error {
+	return nil
+}
+
+func (s *memoryStore) GetVisibility(ctx context.Context, ownerID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if room, ok := s.saved[ownerID]; ok {
+		return room.Visibility, nil
+	}
+	var last int64
+	visibility := VisibilityPublic
+	for id, session := range s.sessions {
+		if session.owner == ownerID && id > last {
+			last, visibility = id, session.visibility
+		}
+	}
+	return visibility, nil
+}
+
+func (s *memoryStore) GetFollowedAmong(ctx context.Context, followerID string, followeeIDs []string) (followed []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, followee := range s.follows[followerID] {
+		for _, id := range followeeIDs {
+			if followee == id {
+				followed = append(followed, id)
+			}
+		}
+	}
+	return
+}
+
+func (s *memoryStore) StartSession(ctx context.Context, ownerID string, title string, visibility string, started time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := int64(len(s.sessions) + 1)
+	s.sessions[id] = &testSession{owner: ownerID, visibility: visibility}
+	return id, nil
+}
+
+func (s *memoryStore) AddSessionTrack(ctx context.Context, sessionID int64, track TrackFeedback) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sessionID].tracks = append(s.sessions[sessionID].tracks, track)
+	return nil
+}
+
+func (s *memoryStore) UpdateSession(ctx context.Context, sessionID int64, title string, visibility string, peakListeners int, chats int, ended *time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session := s.sessions[sessionID]
+	session.visibility = visibility
+	if peakListeners > session.peakListeners {
+		session.peakListeners = peakListeners
+	}
+	session.chats += chats
+	if ended != nil {
+		session.ended = ended
+	}
+	return nil
+}
+
+func (s *memoryStore) SetSessionVisibility(ctx context.Context, sessionID int64, visibility string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[sessionID].visibility = visibility
+	return nil
+}
+
+func (s *memoryStore) NotifyRoomStart(ctx context.Context, ownerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.roomStarts = append(s.roomStarts, ownerID)
+	return nil
+}
+
+func (s *memoryStore) DeleteRoom(ctx context.Context, ownerID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.saved, ownerID)
+	s.deleted[ownerID]++
+	return nil
+}
+
+// useTestRegistry swaps in an empty registry and an in-memory store for the
+// duration of a test.
+func useTestRegistry(t *testing.T) (*memoryStore, context.CancelFunc) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	oldHubs, oldStore := hubs, store
+	s := newMemoryStore()
+	hubs, store = newRegistry(ctx), s
+	t.Cleanup(func() {
+		cancel()
+		hubs.wait(context.Background())
+		hubs, store = oldHubs, oldStore
+	})
+	return s, cancel
+}
+
+func newTestClient(h *AuthedHub) *Client {
+	c := &Client{
+		Hub:     h,
+		User:    queries.UserStub{EggsID: "listener"},
+		Send:    make(chan []byte, 256),
+		Version: ProtocolV1,
+	}
+	go func() {
+		for range c.Send {
+		}
+	}()
+	return c
+}
+
+func waitForEmpty(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hubs.list()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d rooms still open", len(hubs.list()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRoomClosesWhenEmpty(t *testing.T) {
+	s, _ := useTestRegistry(t)
+	owner := queries.UserStub{EggsID: "owner"}
+
+	AttachHub(owner, "")
+	h := GetHub("owner")
+	if h == nil {
+		t.Fatal("Expected room to be open")
+	}
+	c := newTestClient(h)
+	err := h.Hub.Join(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hubs := GetHubs("", false); len(hubs) != 1 || hubs[0].Owner.EggsID != "owner" {
+		t.Errorf("GetHubs returned %+v", hubs)
+	}
+
+	c.leave()
+	waitForEmpty(t)
+	if err := h.Hub.Join(newTestClient(h)); err != ErrRoomNotFound {
+		t.Errorf("Joining a closed room returned %v, want %v", err, ErrRoomNotFound)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deleted["owner"] != 1 {
+		t.Errorf("Room deleted %d times, want 1", s.deleted["owner"])
+	}
+}
+
+func TestShutdownKeepsRooms(t *testing.T) {
+	s, cancel := useTestRegistry(t)
+	for i := 0; i < 5; i++ {
+		owner := queries.UserStub{EggsID: fmt.Sprintf("owner%d", i)}
+		AttachHub(owner, "")
+		err := GetHub(owner.EggsID).Hub.Join(newTestClient(GetHub(owner.EggsID)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cancel()
+	ctx, cancelWait := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelWait()
+	err := Wait(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(hubs.list()); n != 0 {
+		t.Errorf("%d rooms still open after shutdown", n)
+	}
+	AttachHub(queries.UserStub{EggsID: "late"}, "")
+	if GetHub("late") != nil {
+		t.Errorf("Expected no rooms to open after shutdown")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.saved) != 5 || len(s.deleted) != 0 {
+		t.Errorf("Store has %d saved and %d deleted rooms, want 5 and 0", len(s.saved), len(s.deleted))
+	}
+}
+
+func TestRestoreSkipsBrokenRooms(t *testing.T) {
+	useTestRegistry(t)
+	rooms := []queries.Room{
+		{Owner: queries.UserStub{EggsID: "broken"}, Song: []byte("{"), Queue: []byte("[]")},
+		{Owner: queries.UserStub{EggsID: "owner"}, Song: []byte("{}"), Queue: []byte("[]")},
+	}
+
+	err := restoreRooms(rooms)
+	if err == nil {
+		t.Errorf("Expected the broken room to be reported")
+	}
+	if GetHub("broken") != nil {
+		t.Errorf("Expected the broken room to be skipped")
+	}
+	if GetHub("owner") == nil {
+		t.Errorf("Expected the room after the broken one to be restored")
+	}
+}
+
+// TestConcurrentJoinLeaveCreate is meant to be run with -race.
+func TestConcurrentJoinLeaveCreate(t *testing.T) {
+	useTestRegistry(t)
+	const (
+		rooms      = 4
+		listeners  = 8
+		iterations = 25
+	)
+
+	var wg sync.WaitGroup
+	for r := 0; r < rooms; r++ {
+		owner := queries.UserStub{EggsID: fmt.Sprintf("owner%d", r)}
+		for l := 0; l < listeners; l++ {
+			user := queries.UserStub{EggsID: fmt.Sprintf("user%d", l)}
+			if l == 0 {
+				user = owner
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < iterations; i++ {
+					AttachHub(owner, "")
+					h := GetHub(owner.EggsID)
+					if h == nil {
+						continue
+					}
+					c := newTestClient(h)
+					if h.Hub.Join(c) != nil {
+						continue
+					}
+					messages := []string{
+						`{"type":"chat","message":"\"hi\""}`,
+						`{"type":"setTitle","message":"\"title\""}`,
+						`{"type":"blockedUsers","message":"[\"user1\"]"}`,
+						`{"type":"unblockedUsers","message":"[\"user1\"]"}`,
+						`{"type":"enqueue","message":"{\"musicId\":\"music\"}"}`,
+						`{"type":"skip","message":""}`,
+					}
+					for _, raw := range messages {
+						message, perr := decodeMessage(ProtocolV1, []byte(raw))
+						if perr != nil {
+							t.Error(perr)
+							continue
+						}
+						c.handleError(c.handleMessage(user, message, []byte(raw)))
+					}
+					GetHubs("listener", true)
+					c.leave()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	waitForEmpty(t)
+}
@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"context"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+)
+
+func (h *Hub) sessionID() int64 {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.session
+}
+
+func (h *Hub) countChat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.chats++
+}
+
+// takeChats returns the chats not yet added to the recap.
+func (h *Hub) takeChats() (chats int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	chats, h.chats = h.chats, 0
+	return
+}
+
+// startSession starts the room's recap, unless it is a restored room that
+// already has one. It must only be called from run.
+func (h *Hub) startSession() {
+	if h.sessionID() != 0 {
+		return
+	}
+	h.mu.RLock()
+	title := h.Title
+	h.mu.RUnlock()
+	session, err := store.StartSession(context.Background(), h.Owner.EggsID, title, h.visibility(), h.Created)
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	h.mu.Lock()
+	h.session = session
+	h.mu.Unlock()
+	h.save()
+}
+
+// recordTrack adds a finished track to the recap.
+func (h *Hub) recordTrack(track TrackFeedback) {
+	session := h.sessionID()
+	if session == 0 || track.Ended == nil {
+		return
+	}
+	err := store.AddSessionTrack(context.Background(), session, track)
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+}
+
+// endSession brings the recap up to date as the room closes. Unless keep is
+// set, as on shutdown, the session ends along with the room. It must only be
+// called from run.
+func (h *Hub) endSession(keep bool) {
+	session := h.sessionID()
+	if session == 0 {
+		return
+	}
+	var ended *time.Time
+	if !keep {
+		if finished, ok := h.Feedback.next(SongStub{}); ok {
+			h.recordTrack(finished)
+		}
+		now := time.Now()
+		ended = &now
+	}
+	h.mu.RLock()
+	title, visibility := h.Title, h.Visibility
+	h.mu.RUnlock()
+	err := store.UpdateSession(context.Background(), session, title, visibility, h.peakListeners, h.takeChats(), ended)
+	if err != nil {
+		logging.WebsocketError(err)
+	}
+}
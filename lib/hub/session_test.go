@@ -0,0 +1,77 @@
+package hub
+
+import "testing"
+
+func TestSessionRecap(t *testing.T) {
+	s, _ := useTestRegistry(t)
+	clients := joinTestRoom(t, "owner", "listener", "listener")
+	owner, listener := clients[0], clients[1]
+
+	for _, raw := range []string{
+		`{"type":"start","message":"{\"musicId\":\"one\"}"}`,
+		`{"type":"chat","message":"\"hi\""}`,
+		`{"type":"start","message":"{\"musicId\":\"two\"}"}`,
+	} {
+		err := sendTestMessage(owner, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := sendTestMessage(listener, `{"type":"chat","message":"\"hello\""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range clients {
+		c.leave()
+	}
+	waitForEmpty(t)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sessions) != 1 {
+		t.Fatalf("Got %d sessions, want 1", len(s.sessions))
+	}
+	session := s.sessions[1]
+	if session.owner != "owner" || session.visibility != VisibilityPublic || session.ended == nil {
+		t.Errorf("Got session %+v, want an ended public session of owner", session)
+	}
+	if session.chats != 2 || session.peakListeners != 2 {
+		t.Errorf("Got %d chats and %d peak listeners, want 2 and 2", session.chats, session.peakListeners)
+	}
+	if len(session.tracks) != 2 || session.tracks[0].Song.MusicID != "one" || session.tracks[1].Song.MusicID != "two" {
+		t.Errorf("Got tracks %+v, want one and two", session.tracks)
+	}
+}
+
+func TestShutdownKeepsSession(t *testing.T) {
+	s, cancel := useTestRegistry(t)
+	joinTestRoom(t, "owner")
+	cancel()
+	waitForEmpty(t)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.sessions) != 1 || s.sessions[1].ended != nil {
+		t.Errorf("Expected the session to stay open across a restart")
+	}
+	if s.saved["owner"].SessionID != 1 {
+		t.Errorf("Saved room has session %d, want 1", s.saved["owner"].SessionID)
+	}
+}
+
+func TestSessionFollowsVisibility(t *testing.T) {
+	s, _ := useTestRegistry(t)
+	owner := joinTestRoom(t, "owner")[0]
+
+	err := sendTestMessage(owner, `{"type":"setVisibility","message":"\"invite\""}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	visibility := s.sessions[1].visibility
+	s.mu.Unlock()
+	if visibility != VisibilityInvite {
+		t.Errorf("Session visibility is %q, want %q", visibility, VisibilityInvite)
+	}
+}
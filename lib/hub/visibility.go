@@ -0,0 +1,210 @@
+package hub
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+)
+
+// Who can see and join a room. The owner always can.
+const (
+	// Anyone signed in.
+	VisibilityPublic = "public"
+	// Users following the owner.
+	VisibilityFollowers = "followers"
+	// Users with an invite link from the owner.
+	VisibilityInvite = "invite"
+)
+
+// ErrNoAccess is returned, wrapped, when a user may not join a room.
+var ErrNoAccess = errors.New("you are not allowed in this room")
+
+var (
+	errInvalidVisibility = errors.New("visibility must be public, followers or invite")
+	errInvalidInvite     = fmt.Errorf("%w: invalid invite link", ErrNoAccess)
+	errExpiredInvite     = fmt.Errorf("%w: invite link has expired", ErrNoAccess)
+	errNotFollowing      = fmt.Errorf("%w: only followers of the owner can join", ErrNoAccess)
+)
+
+// Longest an invite link can stay valid for.
+const MaxInviteTTL = 7 * 24 * time.Hour
+
+// inviteSecret signs invite links. Without ROOM_INVITE_SECRET a random secret is
+// used, so links only work on this instance until it restarts. services.Start
+// refuses to run without it when rooms are shared between instances.
+var inviteSecret = getInviteSecret()
+
+func getInviteSecret() []byte {
+	if secret := os.Getenv("ROOM_INVITE_SECRET"); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+func validVisibility(visibility string) bool {
+	switch visibility {
+	case VisibilityPublic, VisibilityFollowers, VisibilityInvite:
+		return true
+	}
+	return false
+}
+
+func (h *Hub) visibility() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.Visibility
+}
+
+func (h *Hub) setVisibility(visibility string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Visibility = visibility
+}
+
+// SetVisibility changes who can see and join the room, and its recap. Users
+// already in the room stay until they leave or are kicked.
+func (h *Hub) SetVisibility(visibility string) error {
+	if !validVisibility(visibility) {
+		return errInvalidVisibility
+	}
+	h.setVisibility(visibility)
+	h.save()
+	if session := h.sessionID(); session != 0 {
+		err := store.SetSessionVisibility(context.Background(), session, visibility)
+		if err != nil {
+			logging.WebsocketError(err)
+		}
+	}
+	return nil
+}
+
+func signInvite(room string, expires int64) string {
+	mac := hmac.New(sha256.New, inviteSecret)
+	mac.Write([]byte(room + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewInvite returns a code that lets anyone holding it join room until it
+// expires.
+func NewInvite(room string, ttl time.Duration) (code string, expires time.Time) {
+	expires = time.Now().Add(ttl).Truncate(time.Second)
+	code = strconv.FormatInt(expires.Unix(), 10) + "." + signInvite(room, expires.Unix())
+	return
+}
+
+func verifyInvite(room string, code string) error {
+	unix, signature, ok := strings.Cut(code, ".")
+	if !ok {
+		return errInvalidInvite
+	}
+	expires, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return errInvalidInvite
+	}
+	if !hmac.Equal([]byte(signature), []byte(signInvite(room, expires))) {
+		return errInvalidInvite
+	}
+	if time.Now().Unix() >= expires {
+		return errExpiredInvite
+	}
+	return nil
+}
+
+// CheckAccess returns an error wrapping ErrNoAccess if user may not join the
+// room. A valid invite lets users in whatever the visibility.
+func (h *AuthedHub) CheckAccess(ctx context.Context, user string, invite string) error {
+	return checkAccess(ctx, h.Owner.EggsID, h.Hub.visibility(), user, invite)
+}
+
+// CheckRoomAccess is CheckAccess for the room of owner, which may not be open
+// on this instance or at all. Rather than mirroring the room, it reads the
+// visibility from the store.
+func CheckRoomAccess(ctx context.Context, owner string, user string, invite string) error {
+	if h := GetHub(owner); h != nil {
+		return h.CheckAccess(ctx, user, invite)
+	}
+	visibility, err := store.GetVisibility(ctx, owner)
+	if err != nil {
+		return err
+	}
+	return checkAccess(ctx, owner, visibility, user, invite)
+}
+
+func checkAccess(ctx context.Context, owner string, visibility string, user string, invite string) error {
+	if user == owner {
+		return nil
+	}
+	if visibility == VisibilityPublic {
+		return nil
+	}
+	if invite != "" {
+		err := verifyInvite(owner, invite)
+		if err == nil || visibility == VisibilityInvite {
+			return err
+		}
+	}
+	if visibility == VisibilityInvite {
+		return errInvalidInvite
+	}
+	followed, err := store.GetFollowedAmong(ctx, user, []string{owner})
+	if err != nil {
+		return err
+	}
+	if len(followed) == 0 {
+		return errNotFollowing
+	}
+	return nil
+}
+
+// visibleRooms filters rooms down to those viewer may see in the room list.
+// Invite-only rooms are only listed for their owner.
+func visibleRooms(viewer string, publicHubs []PublicHub) []PublicHub {
+	var followersOnly []string
+	for _, publicHub := range publicHubs {
+		if publicHub.Visibility == VisibilityFollowers && publicHub.Owner.EggsID != viewer {
+			followersOnly = append(followersOnly, publicHub.Owner.EggsID)
+		}
+	}
+	followed := make(map[string]bool)
+	if viewer != "" && len(followersOnly) > 0 {
+		owners, err := store.GetFollowedAmong(context.Background(), viewer, followersOnly)
+		if err != nil {
+			logging.WebsocketError(err)
+		}
+		for _, owner := range owners {
+			followed[owner] = true
+		}
+	}
+
+	visible := make([]PublicHub, 0, len(publicHubs))
+	for _, publicHub := range publicHubs {
+		owner := publicHub.Owner.EggsID
+		switch publicHub.Visibility {
+		case VisibilityFollowers:
+			if owner != viewer && !followed[owner] {
+				continue
+			}
+		case VisibilityInvite:
+			if owner != viewer {
+				continue
+			}
+		}
+		visible = append(visible, publicHub)
+	}
+	return visible
+}
@@ -0,0 +1,133 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+func TestInvites(t *testing.T) {
+	code, _ := NewInvite("owner", time.Hour)
+	if err := verifyInvite("owner", code); err != nil {
+		t.Errorf("Valid invite returned %v", err)
+	}
+	if err := verifyInvite("other", code); !errors.Is(err, ErrNoAccess) {
+		t.Errorf("Invite for another room returned %v", err)
+	}
+	expired, _ := NewInvite("owner", -time.Hour)
+	if err := verifyInvite("owner", expired); err != errExpiredInvite {
+		t.Errorf("Expired invite returned %v, want %v", err, errExpiredInvite)
+	}
+	for _, code := range []string{"", "garbage", "1.garbage", code + "x"} {
+		if err := verifyInvite("owner", code); err != errInvalidInvite {
+			t.Errorf("Invite %q returned %v, want %v", code, err, errInvalidInvite)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	s, _ := useTestRegistry(t)
+	s.follows["follower"] = []string{"owner"}
+	AttachHub(queries.UserStub{EggsID: "owner"}, "")
+	h := GetHub("owner")
+	invite, _ := NewInvite("owner", time.Hour)
+
+	tests := []struct {
+		visibility string
+		user       string
+		invite     string
+		allowed    bool
+	}{
+		{VisibilityPublic, "listener", "", true},
+		{VisibilityFollowers, "listener", "", false},
+		{VisibilityFollowers, "follower", "", true},
+		{VisibilityFollowers, "listener", invite, true},
+		{VisibilityInvite, "follower", "", false},
+		{VisibilityInvite, "listener", "bad", false},
+		{VisibilityInvite, "listener", invite, true},
+		{VisibilityInvite, "owner", "", true},
+	}
+	for _, test := range tests {
+		err := h.Hub.SetVisibility(test.visibility)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = h.CheckAccess(context.Background(), test.user, test.invite)
+		if test.allowed && err != nil || !test.allowed && !errors.Is(err, ErrNoAccess) {
+			t.Errorf("%s room let %s in with invite %q: got %v", test.visibility, test.user, test.invite, err)
+		}
+	}
+	if err := h.Hub.SetVisibility("secret"); err != errInvalidVisibility {
+		t.Errorf("Got %v, want %v", err, errInvalidVisibility)
+	}
+}
+
+func TestCheckRoomAccessClosed(t *testing.T) {
+	s, _ := useTestRegistry(t)
+	s.follows["follower"] = []string{"owner"}
+	s.sessions[1] = &testSession{owner: "owner", visibility: VisibilityFollowers}
+
+	if err := CheckRoomAccess(context.Background(), "owner", "listener", ""); !errors.Is(err, ErrNoAccess) {
+		t.Errorf("Non-follower got %v, want %v", err, ErrNoAccess)
+	}
+	if err := CheckRoomAccess(context.Background(), "owner", "follower", ""); err != nil {
+		t.Errorf("Follower got %v", err)
+	}
+	if GetHub("owner") != nil {
+		t.Errorf("Expected checking a closed room not to open it")
+	}
+}
+
+func TestGetHubsVisibility(t *testing.T) {
+	s, _ := useTestRegistry(t)
+	s.follows["follower"] = []string{"followers"}
+	for _, visibility := range []string{VisibilityPublic, VisibilityFollowers, VisibilityInvite} {
+		AttachHub(queries.UserStub{EggsID: visibility}, visibility)
+	}
+
+	tests := map[string][]string{
+		"":          {"public"},
+		"listener":  {"public"},
+		"follower":  {"followers", "public"},
+		"followers": {"followers", "public"},
+		"invite":    {"invite", "public"},
+	}
+	for viewer, want := range tests {
+		got := make(map[string]bool)
+		for _, publicHub := range GetHubs(viewer, false) {
+			got[publicHub.Owner.EggsID] = true
+		}
+		if len(got) != len(want) {
+			t.Errorf("%q sees %v, want %v", viewer, got, want)
+			continue
+		}
+		for _, owner := range want {
+			if !got[owner] {
+				t.Errorf("%q sees %v, want %v", viewer, got, want)
+			}
+		}
+	}
+}
+
+func TestRoomStartNotifiesFollowers(t *testing.T) {
+	s, _ := useTestRegistry(t)
+	for _, visibility := range []string{VisibilityPublic, VisibilityFollowers, VisibilityInvite} {
+		err := AttachHub(queries.UserStub{EggsID: visibility}, visibility)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	AttachHub(queries.UserStub{EggsID: "public"}, "")
+	if err := AttachHub(queries.UserStub{EggsID: "secret"}, "secret"); err != errInvalidVisibility {
+		t.Errorf("Got %v, want %v", err, errInvalidVisibility)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.roomStarts) != 2 || s.roomStarts[0] != "public" || s.roomStarts[1] != "followers" {
+		t.Errorf("Followers notified of %v, want public and followers", s.roomStarts)
+	}
+}
@@ -64,6 +64,14 @@ var (
 		Name: "eggshellver_song_count",
 		Help: "The number of songs",
 	})
+	opsWebsocketThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "eggshellver_websocket_throttled",
+		Help: "The total number of websocket messages dropped for going over a rate limit, by limit",
+	}, []string{"limit"})
+	opsWebsocketThrottleDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "eggshellver_websocket_throttle_disconnects",
+		Help: "The total number of websocket clients disconnected for going over rate limits",
+	})
 	opPartialCacheSucceeded = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "eggshellver_partial_cache_succeeded",
 		Help: "The number of partial caches succeeded",
@@ -122,6 +122,16 @@ func WebsocketMessage(msgType string, sender string, content string) {
 	logger.Debug().Str("type", msgType).Str("sender", sender).Str("content", content).Msg("websocketmessage")
 }
 
+func WebsocketThrottled(limit string, sender string) {
+	opsWebsocketThrottled.WithLabelValues(limit).Inc()
+	logger.Warn().Str("limit", limit).Str("sender", sender).Msg("websocketthrottled")
+}
+
+func WebsocketThrottleDisconnect(sender string) {
+	opsWebsocketThrottleDisconnects.Inc()
+	logger.Warn().Str("sender", sender).Msg("websocketthrottledisconnect")
+}
+
 func metricError(metricType string, err error) {
 	logger.Error().Err(err).Str("type", metricType).Msg("metricerror")
 }
@@ -0,0 +1,253 @@
+// Package notifications delivers notifications to users in real time. Every
+// instance listens for notifications added by any instance, and passes them on
+// to the sockets its users have open.
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+const (
+	// Time allowed to write a message to the peer.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer.
+	pongWait = 60 * time.Second
+
+	// Send pings to peer with this period. Must be less than pongWait.
+	pingPeriod = (pongWait * 9) / 10
+
+	// Clients have nothing to say besides closing the socket.
+	maxMessageSize = 512
+
+	// Events queued for a slow client before it is disconnected.
+	sendBuffer = 16
+
+	// Time to wait before listening again after losing the connection.
+	relistenDelay = time.Second
+)
+
+// Event is sent to every socket the recipient has open. An "unread" event with
+// the unread count is sent on connecting and when notifications are read, and a
+// "notification" event with the new unread count when one arrives.
+type Event struct {
+	Type         string                `json:"type"`
+	Notification *queries.Notification `json:"notification,omitempty"`
+	Unread       int64                 `json:"unread"`
+}
+
+// Subscriber is a socket listening for a user's notifications.
+type Subscriber struct {
+	User string
+	Conn *websocket.Conn
+	Send chan []byte
+}
+
+// notificationStore reads notifications, so that tests can run without a
+// database.
+type notificationStore interface {
+	GetNotification(ctx context.Context, recipientID string, id int64) (queries.Notification, int64, error)
+	GetUnreadCount(ctx context.Context, recipientID string) (int64, error)
+}
+
+type dbStore struct{}
+
+func (dbStore) GetNotification(ctx context.Context, recipientID string, id int64) (queries.Notification, int64, error) {
+	return queries.GetNotification(ctx, recipientID, id)
+}
+
+func (dbStore) GetUnreadCount(ctx context.Context, recipientID string) (int64, error) {
+	return queries.GetUnreadNotificationCount(ctx, recipientID)
+}
+
+var store notificationStore = dbStore{}
+
+// registry holds the subscribers connected to this instance by user.
+type registry struct {
+	mu          sync.Mutex
+	subscribers map[string]map[*Subscriber]bool
+}
+
+var subscribers = &registry{
+	subscribers: make(map[string]map[*Subscriber]bool),
+}
+
+func (r *registry) add(s *Subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.subscribers[s.User] == nil {
+		r.subscribers[s.User] = make(map[*Subscriber]bool)
+	}
+	r.subscribers[s.User][s] = true
+}
+
+// remove forgets the subscriber and closes its queue, unless it was already
+// removed.
+func (r *registry) remove(s *Subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.removeLocked(s)
+}
+
+func (r *registry) removeLocked(s *Subscriber) {
+	if !r.subscribers[s.User][s] {
+		return
+	}
+	delete(r.subscribers[s.User], s)
+	if len(r.subscribers[s.User]) == 0 {
+		delete(r.subscribers, s.User)
+	}
+	close(s.Send)
+}
+
+func (r *registry) has(user string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.subscribers[user]) > 0
+}
+
+// send queues message for every subscriber of user, dropping those too slow to
+// keep up.
+func (r *registry) send(user string, message []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for s := range r.subscribers[user] {
+		select {
+		case s.Send <- message:
+		default:
+			r.removeLocked(s)
+		}
+	}
+}
+
+// Init starts listening for notifications until ctx is done.
+func Init(ctx context.Context) {
+	go listen(ctx)
+}
+
+func listen(ctx context.Context) {
+	for {
+		err := queries.Listen(ctx, queries.NotificationChannel, receive)
+		if ctx.Err() != nil {
+			return
+		}
+		logging.WebsocketError(err)
+		time.Sleep(relistenDelay)
+	}
+}
+
+// receive passes a signal on to the recipient's sockets on this instance, if
+// they have any open.
+func receive(payload string) {
+	var signal queries.NotificationSignal
+	err := json.Unmarshal([]byte(payload), &signal)
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	if !subscribers.has(signal.Recipient) {
+		return
+	}
+
+	ctx := context.Background()
+	event := Event{Type: "unread"}
+	if signal.ID != 0 {
+		var notification queries.Notification
+		notification, event.Unread, err = store.GetNotification(ctx, signal.Recipient, signal.ID)
+		event.Type = "notification"
+		event.Notification = &notification
+	} else {
+		event.Unread, err = store.GetUnreadCount(ctx, signal.Recipient)
+	}
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		logging.WebsocketError(err)
+		return
+	}
+	subscribers.send(signal.Recipient, b)
+}
+
+// Serve sends the user's notifications over conn until it closes, starting with
+// their unread count.
+func Serve(user string, conn *websocket.Conn) (err error) {
+	unread, err := store.GetUnreadCount(context.Background(), user)
+	if err != nil {
+		return
+	}
+	b, err := json.Marshal(Event{
+		Type:   "unread",
+		Unread: unread,
+	})
+	if err != nil {
+		return
+	}
+	s := &Subscriber{
+		User: user,
+		Conn: conn,
+		Send: make(chan []byte, sendBuffer),
+	}
+	s.Send <- b
+	subscribers.add(s)
+	go s.writePump()
+	go s.readPump()
+	return
+}
+
+// readPump waits for the client to go away, answering pings along the way.
+func (s *Subscriber) readPump() {
+	defer func() {
+		subscribers.remove(s)
+		s.Conn.Close()
+	}()
+	s.Conn.SetReadLimit(maxMessageSize)
+	s.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	s.Conn.SetPongHandler(func(string) error { s.Conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	for {
+		_, _, err := s.Conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logging.WebsocketError(err)
+			}
+			return
+		}
+	}
+}
+
+func (s *Subscriber) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		s.Conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-s.Send:
+			s.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// Dropped for falling behind, or already gone.
+				s.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			err := s.Conn.WriteMessage(websocket.TextMessage, message)
+			if err != nil {
+				return
+			}
+		case <-ticker.C:
+			s.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := s.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+type memoryStore struct {
+	notifications map[int64]queries.Notification
+	unread        int64
+	lookups       int
+}
+
+func (s *memoryStore) GetNotification(ctx context.Context, recipientID string, id int64) (queries.Notification, int64, error) {
+	s.lookups++
+	return s.notifications[id], s.unread, nil
+}
+
+func (s *memoryStore) GetUnreadCount(ctx context.Context, recipientID string) (int64, error) {
+	s.lookups++
+	return s.unread, nil
+}
+
+func useTestStore(t *testing.T) *memoryStore {
+	t.Helper()
+	s := &memoryStore{
+		notifications: make(map[int64]queries.Notification),
+	}
+	oldStore := store
+	store = s
+	t.Cleanup(func() {
+		store = oldStore
+	})
+	return s
+}
+
+func subscribe(t *testing.T, user string, buffer int) *Subscriber {
+	t.Helper()
+	s := &Subscriber{
+		User: user,
+		Send: make(chan []byte, buffer),
+	}
+	subscribers.add(s)
+	t.Cleanup(func() {
+		subscribers.remove(s)
+	})
+	return s
+}
+
+func signal(t *testing.T, signal queries.NotificationSignal) {
+	t.Helper()
+	b, err := json.Marshal(signal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(string(b))
+}
+
+func nextEvent(t *testing.T, s *Subscriber) (event Event) {
+	t.Helper()
+	select {
+	case b := <-s.Send:
+		err := json.Unmarshal(b, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+	default:
+		t.Fatal("Expected an event")
+	}
+	return
+}
+
+func TestReceive(t *testing.T) {
+	s := useTestStore(t)
+	s.notifications[1] = queries.Notification{ID: 1, Type: queries.NotificationFollow}
+	s.unread = 3
+	tabs := []*Subscriber{subscribe(t, "recipient", 4), subscribe(t, "recipient", 4)}
+
+	signal(t, queries.NotificationSignal{ID: 1, Recipient: "recipient"})
+	for _, tab := range tabs {
+		event := nextEvent(t, tab)
+		if event.Type != "notification" || event.Notification == nil || event.Notification.ID != 1 || event.Unread != 3 {
+			t.Errorf("Got event %+v, want notification 1 with 3 unread", event)
+		}
+	}
+
+	s.unread = 0
+	signal(t, queries.NotificationSignal{Recipient: "recipient"})
+	if event := nextEvent(t, tabs[0]); event.Type != "unread" || event.Unread != 0 {
+		t.Errorf("Got event %+v, want 0 unread", event)
+	}
+
+	lookups := s.lookups
+	signal(t, queries.NotificationSignal{ID: 2, Recipient: "someone else"})
+	if s.lookups != lookups {
+		t.Errorf("Expected signals for users without sockets on this instance to be ignored")
+	}
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+	useTestStore(t)
+	slow := subscribe(t, "recipient", 1)
+
+	signal(t, queries.NotificationSignal{Recipient: "recipient"})
+	signal(t, queries.NotificationSignal{Recipient: "recipient"})
+	if subscribers.has("recipient") {
+		t.Fatal("Expected a subscriber with a full queue to be dropped")
+	}
+	<-slow.Send
+	if _, ok := <-slow.Send; ok {
+		t.Errorf("Expected the dropped subscriber's queue to be closed")
+	}
+}
@@ -0,0 +1,203 @@
+package queries
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+)
+
+// Scopes limit what an access token can be used for. Session tokens can be used
+// for everything.
+const (
+	ScopeReadLikes      = "read:likes"
+	ScopeWriteLikes     = "write:likes"
+	ScopeReadFollows    = "read:follows"
+	ScopeWriteFollows   = "write:follows"
+	ScopeReadPlaylists  = "read:playlists"
+	ScopeWritePlaylists = "write:playlists"
+	ScopeReadTimeline   = "read:timeline"
+	ScopeNotifications  = "notifications"
+	ScopeRoomsJoin      = "rooms:join"
+	ScopeRoomsHost      = "rooms:host"
+	ScopeAccountPrivacy = "account:privacy"
+	ScopeAccountDelete  = "account:delete"
+	// Managing sessions and access tokens takes a session, so it cannot be
+	// granted.
+	ScopeAccountManage = "account:manage"
+)
+
+var grantableScopes = map[string]bool{
+	ScopeReadLikes:      true,
+	ScopeWriteLikes:     true,
+	ScopeReadFollows:    true,
+	ScopeWriteFollows:   true,
+	ScopeReadPlaylists:  true,
+	ScopeWritePlaylists: true,
+	ScopeReadTimeline:   true,
+	ScopeNotifications:  true,
+	ScopeRoomsJoin:      true,
+	ScopeRoomsHost:      true,
+	ScopeAccountPrivacy: true,
+	ScopeAccountDelete:  true,
+}
+
+var ErrInvalidScope = errors.New("invalid scope")
+
+// TokenGrant is who a token belongs to, and what it lets its bearer do.
+type TokenGrant struct {
+	UserStub
+	Scopes    []string `db:"scopes"`
+	IsSession bool     `db:"is_session"`
+}
+
+// Allows reports whether the token can be used for scope.
+func (g TokenGrant) Allows(scope string) bool {
+	if g.IsSession {
+		return true
+	}
+	for _, s := range g.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessToken is a token the user made for an integration.
+type AccessToken struct {
+	ID       int64      `json:"id" db:"token_id"`
+	Name     string     `json:"name" db:"token_name"`
+	Scopes   []string   `json:"scopes" db:"scopes"`
+	Created  time.Time  `json:"created" db:"created_time"`
+	LastUsed *time.Time `json:"lastUsed" db:"last_used_time"`
+	Expires  *time.Time `json:"expires" db:"expires_time"`
+}
+
+// NewAccessToken is an access token as it is created, the one time the token
+// itself can be seen.
+type NewAccessToken struct {
+	AccessToken
+	Token string `json:"token" db:"-"`
+}
+
+const accessTokenColumns = "token_id, token_name, scopes, created_time, last_used_time, expires_time"
+
+// GetTokenGrant returns who token belongs to and what it lets its bearer do,
+// whether it belongs to a session or is an access token, and marks it as used.
+// A session token still stored in plaintext is replaced by its hash.
+func GetTokenGrant(ctx context.Context, token string) (grant TokenGrant, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Get(
+		ctx,
+		tx,
+		&grant,
+		`WITH s AS (
+			UPDATE sessions SET last_used_time = NOW(), token_hash = $2, token = NULL WHERE (token_hash = $2 OR token = $1) AND expires_time > NOW() RETURNING eggs_id
+		), a AS (
+			UPDATE access_tokens SET last_used_time = NOW() WHERE token_hash = $2 AND (expires_time IS NULL OR expires_time > NOW()) RETURNING eggs_id, scopes
+		)
+		SELECT u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, g.scopes, g.is_session FROM (
+			SELECT eggs_id, NULL::text[] AS scopes, TRUE AS is_session FROM s
+			UNION ALL
+			SELECT eggs_id, scopes, FALSE AS is_session FROM a
+		) g JOIN users u USING (eggs_id)`,
+		token,
+		hashToken(token),
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// CreateAccessToken makes an access token for eggsID limited to scopes, which
+// stops working at expires if it is set.
+func CreateAccessToken(ctx context.Context, eggsID string, name string, scopes []string, expires *time.Time) (token NewAccessToken, err error) {
+	for _, scope := range scopes {
+		if !grantableScopes[scope] {
+			err = fmt.Errorf("%w %q", ErrInvalidScope, scope)
+			return
+		}
+	}
+	secret, err := GenerateRandomString(64)
+	if err != nil {
+		return
+	}
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Get(
+		ctx,
+		tx,
+		&token,
+		"INSERT INTO access_tokens (eggs_id, token_name, token_hash, scopes, expires_time) VALUES ($1, $2, $3, $4, $5) RETURNING "+accessTokenColumns,
+		eggsID,
+		name,
+		hashToken(secret),
+		scopes,
+		expires,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	token.Token = secret
+	return
+}
+
+// GetAccessTokens returns the access tokens of eggsID, newest first.
+func GetAccessTokens(ctx context.Context, eggsID string) (tokens []AccessToken, err error) {
+	tokens = make([]AccessToken, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&tokens,
+		"SELECT "+accessTokenColumns+" FROM access_tokens WHERE eggs_id = $1 ORDER BY created_time DESC, token_id DESC",
+		eggsID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// DeleteAccessToken revokes an access token of eggsID.
+func DeleteAccessToken(ctx context.Context, eggsID string, tokenID int64) (n int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	cmd, err := tx.Exec(
+		ctx,
+		"DELETE FROM access_tokens WHERE eggs_id = $1 AND token_id = $2",
+		eggsID,
+		tokenID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	n = cmd.RowsAffected()
+	err = commitTransaction(tx)
+	return
+}
@@ -0,0 +1,92 @@
+package queries
+
+import (
+	"context"
+
+	"github.com/georgysavva/scany/pgxscan"
+)
+
+// GetBlocks returns the users that ownerID has blocked from all of their rooms.
+func GetBlocks(ctx context.Context, ownerID string) (blocked []string, err error) {
+	blocked = make([]string, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&blocked,
+		"SELECT blocked_id FROM user_blocks WHERE owner_id = $1 ORDER BY added_time DESC",
+		ownerID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+func IsBlocked(ctx context.Context, ownerID string, userID string) (isBlocked bool, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		"SELECT EXISTS (SELECT 1 FROM user_blocks WHERE owner_id = $1 AND blocked_id = $2)",
+		ownerID,
+		userID,
+	).Scan(&isBlocked)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+func InsertBlocks(ctx context.Context, ownerID string, blockedIDs []string) (n int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	cmd, err := tx.Exec(
+		ctx,
+		"INSERT INTO user_blocks (owner_id, blocked_id) SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING",
+		ownerID,
+		blockedIDs,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	n = cmd.RowsAffected()
+	err = commitTransaction(tx)
+	return
+}
+
+func DeleteBlocks(ctx context.Context, ownerID string, blockedIDs []string) (n int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	cmd, err := tx.Exec(
+		ctx,
+		"DELETE FROM user_blocks WHERE owner_id = $1 AND blocked_id = ANY($2)",
+		ownerID,
+		blockedIDs,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	n = cmd.RowsAffected()
+	err = commitTransaction(tx)
+	return
+}
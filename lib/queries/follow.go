@@ -3,6 +3,7 @@ package queries
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
@@ -34,8 +35,9 @@ type StructuredFollow struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 type StructuredFollows struct {
-	Follows []StructuredFollow `json:"follows"`
-	Total   int64              `json:"total"`
+	Follows    []StructuredFollow `json:"follows"`
+	Total      int64              `json:"total"`
+	NextCursor string             `json:"nextCursor,omitempty"`
 }
 
 func (r rawFollow) ToFollow() StructuredFollow {
@@ -131,7 +133,9 @@ func (arr Follows) Contains(b PartialFollow) bool {
 	return false
 }
 
-func GetFollows(ctx context.Context, followerIDs []string, followeeIDs []string, paginator Paginator) (follows StructuredFollows, err error) {
+// GetFollows returns follows between the users given. Follows by users keeping
+// them private are left out unless viewerID is the follower.
+func GetFollows(ctx context.Context, followerIDs []string, followeeIDs []string, viewerID string, paginator Paginator) (follows StructuredFollows, err error) {
 	if len(followerIDs) == 0 && len(followeeIDs) == 0 {
 		err = errors.New("no users specified")
 		return
@@ -139,22 +143,29 @@ func GetFollows(ctx context.Context, followerIDs []string, followeeIDs []string,
 	var query string
 	var query2 string
 	prefix := "SELECT u1.user_id AS user_id1, u1.eggs_id AS eggs_id1, u1.display_name AS display_name1, u1.is_artist AS is_artist1, u1.image_data_path AS image_data_path1, u1.prefecture_code AS prefecture_code1, u1.profile_text AS profile_text1, u2.user_id AS user_id2, u2.eggs_id AS eggs_id2, u2.display_name AS display_name2, u2.is_artist AS is_artist2, u2.image_data_path AS image_data_path2, u2.prefecture_code AS prefecture_code2, u2.profile_text AS profile_text2, uf.added_time FROM user_follows uf "
-	prefix2 := "SELECT COUNT(*) FROM user_follows "
+	prefix2 := "SELECT COUNT(*) FROM user_follows uf "
 	args := make([]interface{}, 0)
 	if len(followerIDs) == 0 {
-		query = prefix + "INNER JOIN users u1 ON uf.follower_id = u1.eggs_id INNER JOIN users u2 ON uf.followee_id = u2.eggs_id AND uf.followee_id = ANY($1) ORDER BY added_time DESC LIMIT $2 OFFSET $3"
+		query = prefix + "INNER JOIN users u1 ON uf.follower_id = u1.eggs_id INNER JOIN users u2 ON uf.followee_id = u2.eggs_id AND uf.followee_id = ANY($1)"
 		query2 = prefix2 + "WHERE followee_id = ANY($1)"
 		args = append(args, followeeIDs)
 	} else if len(followeeIDs) == 0 {
-		query = prefix + "INNER JOIN users u1 ON uf.follower_id = u1.eggs_id AND uf.follower_id = ANY($1) INNER JOIN users u2 ON uf.followee_id = u2.eggs_id ORDER BY added_time DESC LIMIT $2 OFFSET $3"
+		query = prefix + "INNER JOIN users u1 ON uf.follower_id = u1.eggs_id AND uf.follower_id = ANY($1) INNER JOIN users u2 ON uf.followee_id = u2.eggs_id"
 		query2 = prefix2 + "WHERE follower_id = ANY($1)"
 		args = append(args, followerIDs)
 	} else {
-		query = prefix + "INNER JOIN users u1 ON uf.follower_id = u1.eggs_id AND uf.follower_id = ANY($1) INNER JOIN users u2 ON uf.followee_id = u2.eggs_id AND uf.followee_id = ANY($2) ORDER BY added_time DESC LIMIT $3 OFFSET $4"
+		query = prefix + "INNER JOIN users u1 ON uf.follower_id = u1.eggs_id AND uf.follower_id = ANY($1) INNER JOIN users u2 ON uf.followee_id = u2.eggs_id AND uf.followee_id = ANY($2)"
 		query2 = prefix2 + "WHERE follower_id = ANY($1) AND followee_id = ANY($2)"
 		args = append(args, followerIDs, followeeIDs)
 	}
-	args = append(args, paginator.Limit, paginator.Offset)
+	args = append(args, viewerID)
+	visible := visibleTo("uf.follower_id", "follows_private", fmt.Sprintf("$%d", len(args)))
+	query += " AND " + visible
+	query2 += " AND " + visible
+	query, pageArgs, err := paginator.paginate(query, args, "uf.added_time", "uf.follower_id", "uf.followee_id")
+	if err != nil {
+		return
+	}
 	rawFollows := make(rawFollows, 0)
 
 	tx, err := fetchTransaction()
@@ -167,23 +178,29 @@ func GetFollows(ctx context.Context, followerIDs []string, followeeIDs []string,
 		tx,
 		&rawFollows,
 		query,
-		args...,
+		pageArgs...,
 	)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	var total int64
-	if err = tx.QueryRow(ctx, query2, args[:len(args)-2]...).Scan(&total); err != nil {
+	if err = tx.QueryRow(ctx, query2, args...).Scan(&total); err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	err = commitTransaction(tx)
 	follows = rawFollows.ToFollows(total)
+	if len(rawFollows) > 0 {
+		last := rawFollows[len(rawFollows)-1]
+		follows.NextCursor = paginator.nextCursor(len(rawFollows), last.AddedTime, last.EggsID1, last.EggsID2)
+	}
 	return
 }
 
-func SubmitFollows(ctx context.Context, followerID string, followeeIDs []string) (n int64, err error) {
+// SubmitFollows adds follows, and returns the timeline items of those that are
+// new.
+func SubmitFollows(ctx context.Context, followerID string, followeeIDs []string) (n int64, items []TimelineItem, err error) {
 	timestamp := time.Now().UnixMilli()
 	follows := make([][]interface{}, 0)
 	for i, followeeID := range followeeIDs {
@@ -214,17 +231,43 @@ func SubmitFollows(ctx context.Context, followerID string, followeeIDs []string)
 		RollbackTransaction(tx)
 		return
 	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&items,
+		"SELECT t.follower_id AS id, 'follow' AS type, t.followee_id AS target, t.added_time AS timestamp FROM _temp_upsert_follows t WHERE NOT EXISTS (SELECT 1 FROM user_follows f WHERE f.follower_id = t.follower_id AND f.followee_id = t.followee_id)",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = insertNotifications(
+		ctx,
+		tx,
+		"SELECT t.followee_id AS recipient_id, t.follower_id AS actor_id, '"+NotificationFollow+"' AS notification_type, '' AS target_id FROM _temp_upsert_follows t WHERE NOT EXISTS (SELECT 1 FROM user_follows f WHERE f.follower_id = t.follower_id AND f.followee_id = t.followee_id)",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	cmd, err := tx.Exec(ctx, "INSERT INTO user_follows SELECT * FROM _temp_upsert_follows ON CONFLICT DO NOTHING")
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	n = cmd.RowsAffected()
+	err = addFollows(ctx, tx, followerID, items)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	err = commitTransaction(tx, "_temp_upsert_follows")
 	return
 }
 
-func PutFollows(ctx context.Context, followerID string, followeeIDs []string) (delta int64, total int64, err error) {
+// PutFollows replaces the user's artist follows, and returns the timeline items
+// of the follows that are new.
+func PutFollows(ctx context.Context, followerID string, followeeIDs []string) (delta int64, total int64, items []TimelineItem, err error) {
 	timestamp := time.Now().UnixMilli()
 	follows := make([][]interface{}, 0)
 	for i, followeeID := range followeeIDs {
@@ -258,12 +301,28 @@ func PutFollows(ctx context.Context, followerID string, followeeIDs []string) (d
 		return
 	}
 
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&items,
+		"SELECT t.follower_id AS id, 'follow' AS type, t.followee_id AS target, t.added_time AS timestamp FROM _temp_upsert_follows t WHERE NOT EXISTS (SELECT 1 FROM user_follows f WHERE f.follower_id = t.follower_id AND f.followee_id = t.followee_id)",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+
 	cmd, err := tx.Exec(ctx, "INSERT INTO user_follows SELECT * FROM _temp_upsert_follows ON CONFLICT DO NOTHING")
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	delta = cmd.RowsAffected()
+	err = addFollows(ctx, tx, followerID, items)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 
 	err = tx.QueryRow(
 		ctx,
@@ -275,19 +334,34 @@ func PutFollows(ctx context.Context, followerID string, followeeIDs []string) (d
 		return
 	}
 
-	cmd, err = tx.Exec(ctx, "DELETE FROM user_follows t1 USING users t2 WHERE t1.follower_id = $1 AND t1.followee_id != ALL($2) AND t1.followee_id = t2.eggs_id AND t2.is_artist", followerID, followeeIDs)
+	var unfollowed []string
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&unfollowed,
+		"DELETE FROM user_follows t1 USING users t2 WHERE t1.follower_id = $1 AND t1.followee_id != ALL($2) AND t1.followee_id = t2.eggs_id AND t2.is_artist RETURNING t1.followee_id",
+		followerID,
+		followeeIDs,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = removeFollows(ctx, tx, followerID, unfollowed)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 
-	total -= cmd.RowsAffected()
-	delta -= cmd.RowsAffected()
+	total -= int64(len(unfollowed))
+	delta -= int64(len(unfollowed))
 	err = commitTransaction(tx, "_temp_upsert_follows")
 	return
 }
 
-func ToggleFollow(ctx context.Context, followerID string, followeeID string) (isFollowing bool, err error) {
+// ToggleFollow follows or unfollows followeeID. addedTime is when the follow was
+// added, if it was.
+func ToggleFollow(ctx context.Context, followerID string, followeeID string) (isFollowing bool, addedTime time.Time, err error) {
 	tx, err := fetchTransaction()
 	if err != nil {
 		RollbackTransaction(tx)
@@ -316,16 +390,42 @@ func ToggleFollow(ctx context.Context, followerID string, followeeID string) (is
 			RollbackTransaction(tx)
 			return
 		}
+		err = removeFollows(ctx, tx, followerID, []string{followeeID})
+		if err != nil {
+			RollbackTransaction(tx)
+			return
+		}
 		isFollowing = false
 		err = commitTransaction(tx)
 		return
 	}
 	rows.Close()
-	_, err = tx.Exec(
+	err = tx.QueryRow(
 		ctx,
-		"INSERT INTO user_follows (follower_id, followee_id) VALUES ($1, $2)",
+		"INSERT INTO user_follows (follower_id, followee_id) VALUES ($1, $2) RETURNING added_time",
 		followerID,
 		followeeID,
+	).Scan(&addedTime)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = addFollows(ctx, tx, followerID, []TimelineItem{{
+		ID:        followerID,
+		Type:      "follow",
+		Target:    followeeID,
+		Timestamp: addedTime,
+	}})
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = insertNotifications(
+		ctx,
+		tx,
+		"SELECT $1::text AS recipient_id, $2::text AS actor_id, '"+NotificationFollow+"' AS notification_type, '' AS target_id",
+		followeeID,
+		followerID,
 	)
 	if err != nil {
 		RollbackTransaction(tx)
@@ -353,3 +453,49 @@ func GetFollowCount(ctx context.Context) (n int64, err error) {
 	err = commitTransaction(tx)
 	return
 }
+
+// GetFolloweeIDs returns everyone followerID follows.
+func GetFolloweeIDs(ctx context.Context, followerID string) (followees []string, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&followees,
+		"SELECT followee_id FROM user_follows WHERE follower_id = $1",
+		followerID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// GetFollowedAmong returns which of followeeIDs followerID follows.
+func GetFollowedAmong(ctx context.Context, followerID string, followeeIDs []string) (followed []string, err error) {
+	followed = make([]string, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&followed,
+		"SELECT followee_id FROM user_follows WHERE follower_id = $1 AND followee_id = ANY($2)",
+		followerID,
+		followeeIDs,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
@@ -3,6 +3,7 @@ package queries
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
@@ -30,8 +31,9 @@ type StructuredLike struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 type StructuredLikes struct {
-	Likes []StructuredLike `json:"likes"`
-	Total int64            `json:"total"`
+	Likes      []StructuredLike `json:"likes"`
+	Total      int64            `json:"total"`
+	NextCursor string           `json:"nextCursor,omitempty"`
 }
 
 func (r rawLike) ToLike() StructuredLike {
@@ -119,6 +121,20 @@ func (a LikeTarget) IsValid() bool {
 	return true
 }
 
+// TimelineItem returns the item on the timeline for eggsID liking the target.
+func (a LikeTarget) TimelineItem(eggsID string, timestamp time.Time) TimelineItem {
+	itemType := "musiclike"
+	if a.Type == "playlist" {
+		itemType = "playlistlike"
+	}
+	return TimelineItem{
+		ID:        eggsID,
+		Type:      itemType,
+		Target:    a.ID,
+		Timestamp: timestamp,
+	}
+}
+
 func (arr LikeTargets) IsValid() bool {
 	for _, a := range arr {
 		if !a.IsValid() {
@@ -141,14 +157,16 @@ func (arr LikeTargetsFixed) IsValid() bool {
 	return true
 }
 
-func GetLikedObjects(ctx context.Context, eggsIDs []string, targetIDs []string, targetType string, paginator Paginator) (likes StructuredLikes, err error) {
+// GetLikedObjects returns likes by eggsIDs and/or of targetIDs. Likes by users
+// keeping them private are left out unless viewerID is the one liking.
+func GetLikedObjects(ctx context.Context, eggsIDs []string, targetIDs []string, targetType string, viewerID string, paginator Paginator) (likes StructuredLikes, err error) {
 	if len(targetIDs) == 0 && len(eggsIDs) == 0 {
 		err = errors.New("no target IDs or eggs IDs")
 		return
 	}
 
 	query := "SELECT ul.target_id, ul.target_type, u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, ul.added_time FROM user_likes ul INNER JOIN users u ON ul.eggs_id = u.eggs_id AND "
-	query2 := "SELECT COUNT(*) FROM user_likes WHERE "
+	query2 := "SELECT COUNT(*) FROM user_likes ul WHERE "
 	args := make([]interface{}, 0)
 
 	if targetType == "track" {
@@ -160,19 +178,26 @@ func GetLikedObjects(ctx context.Context, eggsIDs []string, targetIDs []string,
 	}
 
 	if len(targetIDs) == 0 {
-		query += "ul.eggs_id = ANY($1) ORDER BY added_time DESC LIMIT $2 OFFSET $3"
+		query += "ul.eggs_id = ANY($1)"
 		query2 += "eggs_id = ANY($1)"
 		args = append(args, eggsIDs)
 	} else if len(eggsIDs) == 0 {
-		query += "ul.target_id = ANY($1) ORDER BY added_time DESC LIMIT $2 OFFSET $3"
+		query += "ul.target_id = ANY($1)"
 		query2 += "target_id = ANY($1)"
 		args = append(args, targetIDs)
 	} else {
-		query += "ul.target_id = ANY($1) AND ul.eggs_id = ANY($2) ORDER BY added_time DESC LIMIT $3 OFFSET $4"
+		query += "ul.target_id = ANY($1) AND ul.eggs_id = ANY($2)"
 		query2 += "target_id = ANY($1) AND eggs_id = ANY($2)"
 		args = append(args, targetIDs, eggsIDs)
 	}
-	args = append(args, paginator.Limit, paginator.Offset)
+	args = append(args, viewerID)
+	visible := visibleTo("ul.eggs_id", "likes_private", fmt.Sprintf("$%d", len(args)))
+	query += " AND " + visible
+	query2 += " AND " + visible
+	query, pageArgs, err := paginator.paginate(query, args, "ul.added_time", "ul.eggs_id", "ul.target_id")
+	if err != nil {
+		return
+	}
 	rawLikes := make(rawLikes, 0)
 	tx, err := fetchTransaction()
 	if err != nil {
@@ -184,24 +209,29 @@ func GetLikedObjects(ctx context.Context, eggsIDs []string, targetIDs []string,
 		tx,
 		&rawLikes,
 		query,
-		args...,
+		pageArgs...,
 	)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	var total int64
-	err = tx.QueryRow(ctx, query2, args[:len(args)-2]...).Scan(&total)
+	err = tx.QueryRow(ctx, query2, args...).Scan(&total)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	err = commitTransaction(tx)
 	likes = rawLikes.ToLikes(total)
+	if len(rawLikes) > 0 {
+		last := rawLikes[len(rawLikes)-1]
+		likes.NextCursor = paginator.nextCursor(len(rawLikes), last.AddedTime, last.EggsID, last.ID)
+	}
 	return
 }
 
-func LikeObjects(ctx context.Context, eggsID string, targets LikeTargetsFixed) (n int64, err error) {
+// LikeObjects adds likes, and returns the timeline items of those that are new.
+func LikeObjects(ctx context.Context, eggsID string, targets LikeTargetsFixed) (n int64, items []TimelineItem, err error) {
 	timestamp := time.Now().UnixMilli()
 	likes := make([][]interface{}, 0)
 	for i, target := range targets.Targets {
@@ -232,17 +262,34 @@ func LikeObjects(ctx context.Context, eggsID string, targets LikeTargetsFixed) (
 		RollbackTransaction(tx)
 		return
 	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&items,
+		"SELECT t.eggs_id AS id, CASE t.target_type WHEN 'playlist' THEN 'playlistlike' ELSE 'musiclike' END AS type, t.target_id AS target, t.added_time AS timestamp FROM _temp_upsert_likes t WHERE NOT EXISTS (SELECT 1 FROM user_likes l WHERE l.eggs_id = t.eggs_id AND l.target_id = t.target_id)",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	cmd, err := tx.Exec(ctx, "INSERT INTO user_likes SELECT * FROM _temp_upsert_likes ON CONFLICT DO NOTHING")
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	n = cmd.RowsAffected()
+	err = fanOut(ctx, tx, items)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	err = commitTransaction(tx, "_temp_upsert_likes")
 	return
 }
 
-func PutLikes(ctx context.Context, eggsID string, targets LikeTargetsFixed) (delta int64, total int64, err error) {
+// PutLikes replaces the user's likes of one type, and returns the timeline items
+// of the likes that are new.
+func PutLikes(ctx context.Context, eggsID string, targets LikeTargetsFixed) (delta int64, total int64, items []TimelineItem, err error) {
 	timestamp := time.Now().UnixMilli()
 	likes := make([][]interface{}, 0)
 	for i, target := range targets.Targets {
@@ -276,6 +323,17 @@ func PutLikes(ctx context.Context, eggsID string, targets LikeTargetsFixed) (del
 		return
 	}
 
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&items,
+		"SELECT t.eggs_id AS id, CASE t.target_type WHEN 'playlist' THEN 'playlistlike' ELSE 'musiclike' END AS type, t.target_id AS target, t.added_time AS timestamp FROM _temp_upsert_likes t WHERE NOT EXISTS (SELECT 1 FROM user_likes l WHERE l.eggs_id = t.eggs_id AND l.target_id = t.target_id)",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+
 	cmd, err := tx.Exec(ctx, "INSERT INTO user_likes SELECT * FROM _temp_upsert_likes ON CONFLICT DO NOTHING")
 	if err != nil {
 		RollbackTransaction(tx)
@@ -283,6 +341,11 @@ func PutLikes(ctx context.Context, eggsID string, targets LikeTargetsFixed) (del
 	}
 
 	delta = cmd.RowsAffected()
+	err = fanOut(ctx, tx, items)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 
 	err = tx.QueryRow(
 		ctx,
@@ -295,19 +358,35 @@ func PutLikes(ctx context.Context, eggsID string, targets LikeTargetsFixed) (del
 		return
 	}
 
-	cmd, err = tx.Exec(ctx, "DELETE FROM user_likes WHERE eggs_id = $1 AND target_id != ALL($2) AND target_type = $3", eggsID, targets.IDs(), targets.Type)
+	var unliked []string
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&unliked,
+		"DELETE FROM user_likes WHERE eggs_id = $1 AND target_id != ALL($2) AND target_type = $3 RETURNING target_id",
+		eggsID,
+		targets.IDs(),
+		targets.Type,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = removeFromTimelines(ctx, tx, LikeTarget{Type: targets.Type}.TimelineItem(eggsID, time.Time{}).Type, eggsID, unliked)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 
-	total -= cmd.RowsAffected()
-	delta -= cmd.RowsAffected()
+	total -= int64(len(unliked))
+	delta -= int64(len(unliked))
 	err = commitTransaction(tx, "_temp_upsert_likes")
 	return
 }
 
-func ToggleLike(ctx context.Context, eggsID string, target LikeTarget) (isFollowing bool, err error) {
+// ToggleLike likes or unlikes target. addedTime is when the like was added, if
+// it was.
+func ToggleLike(ctx context.Context, eggsID string, target LikeTarget) (isFollowing bool, addedTime time.Time, err error) {
 	tx, err := fetchTransaction()
 	if err != nil {
 		RollbackTransaction(tx)
@@ -338,22 +417,45 @@ func ToggleLike(ctx context.Context, eggsID string, target LikeTarget) (isFollow
 			RollbackTransaction(tx)
 			return
 		}
+		err = removeFromTimelines(ctx, tx, target.TimelineItem(eggsID, time.Time{}).Type, eggsID, []string{target.ID})
+		if err != nil {
+			RollbackTransaction(tx)
+			return
+		}
 		isFollowing = false
 		err = commitTransaction(tx)
 		return
 	}
 	rows.Close()
-	_, err = tx.Exec(
+	err = tx.QueryRow(
 		ctx,
-		"INSERT INTO user_likes (eggs_id, target_id, target_type) VALUES ($1, $2, $3)",
+		"INSERT INTO user_likes (eggs_id, target_id, target_type) VALUES ($1, $2, $3) RETURNING added_time",
 		eggsID,
 		target.ID,
 		target.Type,
-	)
+	).Scan(&addedTime)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = fanOut(ctx, tx, []TimelineItem{target.TimelineItem(eggsID, addedTime)})
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
+	if target.Type == "playlist" {
+		err = insertNotifications(
+			ctx,
+			tx,
+			"SELECT eggs_id AS recipient_id, $1::text AS actor_id, '"+NotificationPlaylistLike+"' AS notification_type, playlist_id AS target_id FROM playlists WHERE playlist_id = $2",
+			eggsID,
+			target.ID,
+		)
+		if err != nil {
+			RollbackTransaction(tx)
+			return
+		}
+	}
 	isFollowing = true
 	err = commitTransaction(tx)
 	return
@@ -0,0 +1,266 @@
+package queries
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+// Kinds of notification.
+const (
+	// Someone followed the recipient.
+	NotificationFollow = "follow"
+	// Someone liked one of the recipient's playlists. The target is the playlist.
+	NotificationPlaylistLike = "playlistLike"
+	// Someone the recipient follows opened a room. The target is the room.
+	NotificationRoomStart = "roomStart"
+)
+
+// NotificationChannel is notified with a NotificationSignal whenever a
+// notification is added or read.
+const NotificationChannel = "eggshellver_notifications"
+
+// NotificationSignal names the recipient whose notifications changed, and the
+// notification added, if any.
+type NotificationSignal struct {
+	ID        int64  `json:"id,omitempty"`
+	Recipient string `json:"recipient"`
+}
+
+type rawNotification struct {
+	NotificationID   int64     `db:"notification_id"`
+	NotificationType string    `db:"notification_type"`
+	TargetID         string    `db:"target_id"`
+	IsRead           bool      `db:"is_read"`
+	AddedTime        time.Time `db:"added_time"`
+	UserID           int       `db:"user_id"`
+	EggsID           string    `db:"eggs_id"`
+	DisplayName      string    `db:"display_name"`
+	IsArtist         bool      `db:"is_artist"`
+	ImageDataPath    string    `db:"image_data_path"`
+	PrefectureCode   int       `db:"prefecture_code"`
+	ProfileText      string    `db:"profile_text"`
+}
+type rawNotifications []rawNotification
+
+type Notification struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	Actor     UserStub  `json:"actor"`
+	TargetID  string    `json:"targetId,omitempty"`
+	IsRead    bool      `json:"isRead"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type NotificationPage struct {
+	Notifications []Notification `json:"notifications"`
+	Unread        int64          `json:"unread"`
+	NextCursor    string         `json:"nextCursor,omitempty"`
+}
+
+func (r rawNotification) ToNotification() Notification {
+	return Notification{
+		ID:   r.NotificationID,
+		Type: r.NotificationType,
+		Actor: UserStub{
+			UserID:         r.UserID,
+			EggsID:         r.EggsID,
+			DisplayName:    r.DisplayName,
+			IsArtist:       r.IsArtist,
+			ImageDataPath:  r.ImageDataPath,
+			PrefectureCode: r.PrefectureCode,
+			ProfileText:    r.ProfileText,
+		},
+		TargetID:  r.TargetID,
+		IsRead:    r.IsRead,
+		Timestamp: r.AddedTime,
+	}
+}
+
+func (arr rawNotifications) ToNotifications() (notifications []Notification) {
+	notifications = make([]Notification, 0)
+	for _, r := range arr {
+		notifications = append(notifications, r.ToNotification())
+	}
+	return
+}
+
+const notificationQuery = "SELECT n.notification_id, n.notification_type, n.target_id, n.is_read, n.added_time, u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text FROM notifications n INNER JOIN users u ON n.actor_id = u.eggs_id AND n.recipient_id = $1"
+
+// insertNotifications adds the notifications selected by query, which returns
+// recipient_id, actor_id, notification_type and target_id, and signals their
+// recipients once tx commits. Users are not notified of their own actions, nor
+// again of something they have not read yet.
+func insertNotifications(ctx context.Context, tx pgx.Tx, query string, args ...interface{}) (err error) {
+	_, err = tx.Exec(
+		ctx,
+		"WITH inserted AS (INSERT INTO notifications (recipient_id, actor_id, notification_type, target_id) SELECT n.recipient_id, n.actor_id, n.notification_type, n.target_id FROM ("+query+") n WHERE n.recipient_id != n.actor_id AND NOT EXISTS (SELECT 1 FROM notifications x WHERE x.recipient_id = n.recipient_id AND x.actor_id = n.actor_id AND x.notification_type = n.notification_type AND x.target_id = n.target_id AND NOT x.is_read) RETURNING notification_id, recipient_id) SELECT pg_notify('"+NotificationChannel+"', json_build_object('id', notification_id, 'recipient', recipient_id)::text) FROM inserted",
+		args...,
+	)
+	return
+}
+
+// NotifyRoomStart notifies the owner's followers that they opened a room.
+func NotifyRoomStart(ctx context.Context, ownerID string) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = insertNotifications(
+		ctx,
+		tx,
+		"SELECT follower_id AS recipient_id, followee_id AS actor_id, '"+NotificationRoomStart+"' AS notification_type, followee_id AS target_id FROM user_follows WHERE followee_id = $1",
+		ownerID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// GetNotifications returns the recipient's notifications, newest first, along
+// with how many are unread.
+func GetNotifications(ctx context.Context, recipientID string, unreadOnly bool, paginator Paginator) (page NotificationPage, err error) {
+	query := notificationQuery
+	if unreadOnly {
+		query += " AND NOT n.is_read"
+	}
+	query, args, err := paginator.paginate(
+		query,
+		[]interface{}{recipientID},
+		"n.added_time",
+		"n.notification_id::text",
+	)
+	if err != nil {
+		return
+	}
+	rawNotifications := make(rawNotifications, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&rawNotifications,
+		query,
+		args...,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		"SELECT COUNT(*) FROM notifications WHERE recipient_id = $1 AND NOT is_read",
+		recipientID,
+	).Scan(&page.Unread)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+
+	page.Notifications = rawNotifications.ToNotifications()
+	if len(rawNotifications) > 0 {
+		last := rawNotifications[len(rawNotifications)-1]
+		page.NextCursor = paginator.nextCursor(len(rawNotifications), last.AddedTime, strconv.FormatInt(last.NotificationID, 10))
+	}
+	return
+}
+
+// GetNotification returns one of the recipient's notifications, and how many
+// of their notifications are unread.
+func GetNotification(ctx context.Context, recipientID string, id int64) (notification Notification, unread int64, err error) {
+	var raw rawNotification
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Get(
+		ctx,
+		tx,
+		&raw,
+		notificationQuery+" AND n.notification_id = $2",
+		recipientID,
+		id,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		"SELECT COUNT(*) FROM notifications WHERE recipient_id = $1 AND NOT is_read",
+		recipientID,
+	).Scan(&unread)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	notification = raw.ToNotification()
+	return
+}
+
+func GetUnreadNotificationCount(ctx context.Context, recipientID string) (n int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		"SELECT COUNT(*) FROM notifications WHERE recipient_id = $1 AND NOT is_read",
+		recipientID,
+	).Scan(&n)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// MarkNotificationsRead marks the given notifications of the recipient as read,
+// or all of them if ids is nil, and returns how many were unread.
+func MarkNotificationsRead(ctx context.Context, recipientID string, ids []int64) (n int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	cmd, err := tx.Exec(
+		ctx,
+		"UPDATE notifications SET is_read = TRUE WHERE recipient_id = $1 AND NOT is_read AND ($2::bigint[] IS NULL OR notification_id = ANY($2))",
+		recipientID,
+		ids,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	n = cmd.RowsAffected()
+	if n > 0 {
+		_, err = tx.Exec(
+			ctx,
+			"SELECT pg_notify($1, json_build_object('recipient', $2::text)::text)",
+			NotificationChannel,
+			recipientID,
+		)
+		if err != nil {
+			RollbackTransaction(tx)
+			return
+		}
+	}
+	err = commitTransaction(tx)
+	return
+}
@@ -0,0 +1,98 @@
+package queries
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/yayuyokitano/eggshellver/lib/services"
+)
+
+// Notify sends payload to every connection listening on channel.
+func Notify(ctx context.Context, channel string, payload string) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"SELECT pg_notify($1, $2)",
+		channel,
+		payload,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// Listen calls handle with every notification on channel, until ctx is done or
+// the connection fails. It holds a connection from the pool while listening.
+func Listen(ctx context.Context, channel string, handle func(payload string)) (err error) {
+	conn, err := services.Pool.Acquire(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Release()
+	_, err = conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize())
+	if err != nil {
+		return
+	}
+	for {
+		notification, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		handle(notification.Payload)
+	}
+}
+
+// InsertRoomBroadcast stores a broadcast too large for a notification payload,
+// and clears out ones old enough that every listener has read them.
+func InsertRoomBroadcast(ctx context.Context, payload string) (id int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM room_broadcasts WHERE added_time < NOW() - INTERVAL '1 minute'",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		"INSERT INTO room_broadcasts (payload) VALUES ($1) RETURNING broadcast_id",
+		payload,
+	).Scan(&id)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+func GetRoomBroadcast(ctx context.Context, id int64) (payload string, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		"SELECT payload FROM room_broadcasts WHERE broadcast_id = $1",
+		id,
+	).Scan(&payload)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
@@ -1,16 +1,55 @@
 package queries
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 type Paginator struct {
-	Limit  int `json:"limit"`
-	Offset int `json:"offset"`
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+	Cursor *Cursor `json:"cursor"`
+}
+
+// Cursor is the position of the last item on a page, ordered by timestamp and
+// then by the keys that make the item unique. Clients only see it encoded.
+type Cursor struct {
+	Timestamp time.Time `json:"t"`
+	Keys      []string  `json:"k"`
+}
+
+func (c Cursor) Encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-func InitializePaginator(query url.Values) Paginator {
+func DecodeCursor(s string) (c Cursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		err = ErrInvalidCursor
+		return
+	}
+	err = json.Unmarshal(b, &c)
+	if err != nil || c.Timestamp.IsZero() {
+		err = ErrInvalidCursor
+	}
+	return
+}
+
+// InitializePaginator reads limit/offset, or cursor if present. An empty cursor
+// parameter requests the first page in cursor mode.
+func InitializePaginator(query url.Values) (paginator Paginator, err error) {
 	limit, err := strconv.Atoi(query.Get("limit"))
 	if err != nil {
 		limit = 50
@@ -19,8 +58,97 @@ func InitializePaginator(query url.Values) Paginator {
 	if err != nil {
 		offset = 0
 	}
-	return Paginator{
+	err = nil
+	paginator = Paginator{
 		Limit:  limit,
 		Offset: offset,
 	}
+	if !query.Has("cursor") {
+		return
+	}
+	paginator.Offset = 0
+	paginator.Cursor = &Cursor{}
+	if query.Get("cursor") == "" {
+		return
+	}
+	cursor, err := DecodeCursor(query.Get("cursor"))
+	if err != nil {
+		return
+	}
+	paginator.Cursor = &cursor
+	return
+}
+
+func (p Paginator) IsCursor() bool {
+	return p.Cursor != nil
+}
+
+// cursorArgs returns the cursor as arguments numbered from $argStart, along with
+// their placeholders. Both are empty in offset mode and on the first cursor page.
+func (p Paginator) cursorArgs(argStart int, keyCount int) (placeholders string, args []interface{}, err error) {
+	if p.Cursor == nil || p.Cursor.Timestamp.IsZero() {
+		return
+	}
+	if len(p.Cursor.Keys) != keyCount {
+		err = ErrInvalidCursor
+		return
+	}
+	args = append(args, p.Cursor.Timestamp)
+	for _, key := range p.Cursor.Keys {
+		args = append(args, key)
+	}
+	numbered := make([]string, 0, len(args))
+	for i := range args {
+		numbered = append(numbered, fmt.Sprintf("$%d", argStart+i))
+	}
+	placeholders = strings.Join(numbered, ", ")
+	return
+}
+
+// after returns a row comparison selecting rows that sort after the cursor.
+func after(placeholders string, timestampColumn string, keyColumns ...string) string {
+	return fmt.Sprintf("(%s, %s) < (%s)", timestampColumn, strings.Join(keyColumns, ", "), placeholders)
+}
+
+// orderBy returns an ORDER BY clause on the timestamp and key columns, newest first.
+func orderBy(timestampColumn string, keyColumns ...string) string {
+	columns := []string{timestampColumn + " DESC"}
+	for _, key := range keyColumns {
+		columns = append(columns, key+" DESC")
+	}
+	return " ORDER BY " + strings.Join(columns, ", ")
+}
+
+// paginate appends the cursor condition, ordering and limit to a query that ends
+// in a WHERE or JOIN condition, and returns the extended argument list.
+func (p Paginator) paginate(query string, args []interface{}, timestampColumn string, keyColumns ...string) (string, []interface{}, error) {
+	pageArgs := append([]interface{}{}, args...)
+	placeholders, cursorArgs, err := p.cursorArgs(len(pageArgs)+1, len(keyColumns))
+	if err != nil {
+		return "", nil, err
+	}
+	if placeholders != "" {
+		query += " AND " + after(placeholders, timestampColumn, keyColumns...)
+		pageArgs = append(pageArgs, cursorArgs...)
+	}
+	query += orderBy(timestampColumn, keyColumns...)
+	pageArgs = append(pageArgs, p.Limit)
+	query += fmt.Sprintf(" LIMIT $%d", len(pageArgs))
+	if !p.IsCursor() {
+		pageArgs = append(pageArgs, p.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(pageArgs))
+	}
+	return query, pageArgs, nil
+}
+
+// nextCursor returns the encoded cursor for the page following one that ended
+// at the given item, or an empty string if the page was not full.
+func (p Paginator) nextCursor(n int, timestamp time.Time, keys ...string) string {
+	if n == 0 || n < p.Limit {
+		return ""
+	}
+	return Cursor{
+		Timestamp: timestamp,
+		Keys:      keys,
+	}.Encode()
 }
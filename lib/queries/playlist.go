@@ -3,6 +3,7 @@ package queries
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
@@ -51,8 +52,9 @@ type StructuredPlaylist struct {
 	Timestamp  time.Time `json:"timestamp"`
 }
 type StructuredPlaylists struct {
-	Playlists []StructuredPlaylist `json:"playlists"`
-	Total     int64                `json:"total"`
+	Playlists  []StructuredPlaylist `json:"playlists"`
+	Total      int64                `json:"total"`
+	NextCursor string               `json:"nextCursor,omitempty"`
 }
 
 func (r rawPlaylist) ToPlaylist() StructuredPlaylist {
@@ -97,7 +99,9 @@ type PartialPlaylist struct {
 	EggsID     string `json:"eggsID" db:"eggs_id"`
 }
 
-func GetPlaylists(ctx context.Context, eggsIDs []string, playlistIDs []string, paginator Paginator) (playlists StructuredPlaylists, err error) {
+// GetPlaylists returns playlists by eggsIDs and/or with playlistIDs. Playlists
+// of users keeping them private are left out unless viewerID is the owner.
+func GetPlaylists(ctx context.Context, eggsIDs []string, playlistIDs []string, viewerID string, paginator Paginator) (playlists StructuredPlaylists, err error) {
 	if len(playlistIDs) == 0 && len(eggsIDs) == 0 {
 		err = errors.New("no playlist IDs or eggs IDs")
 		return
@@ -106,22 +110,29 @@ func GetPlaylists(ctx context.Context, eggsIDs []string, playlistIDs []string, p
 	var query string
 	var query2 string
 	prefix := "SELECT ul.playlist_id, u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, ul.last_modified FROM playlists ul INNER JOIN users u ON ul.eggs_id = u.eggs_id AND "
-	prefix2 := "SELECT COUNT(*) FROM playlists WHERE "
+	prefix2 := "SELECT COUNT(*) FROM playlists ul WHERE "
 	args := make([]interface{}, 0)
 	if len(playlistIDs) == 0 {
-		query = prefix + "ul.eggs_id = ANY($1) ORDER BY last_modified DESC LIMIT $2 OFFSET $3"
+		query = prefix + "ul.eggs_id = ANY($1)"
 		query2 = prefix2 + "eggs_id = ANY($1)"
 		args = append(args, eggsIDs)
 	} else if len(eggsIDs) == 0 {
-		query = prefix + "ul.playlist_id = ANY($1) ORDER BY last_modified DESC LIMIT $2 OFFSET $3"
+		query = prefix + "ul.playlist_id = ANY($1)"
 		query2 = prefix2 + "playlist_id = ANY($1)"
 		args = append(args, playlistIDs)
 	} else {
-		query = prefix + "ul.playlist_id = ANY($1) AND ul.eggs_id = ANY($2) ORDER BY last_modified DESC LIMIT $3 OFFSET $4"
+		query = prefix + "ul.playlist_id = ANY($1) AND ul.eggs_id = ANY($2)"
 		query2 = prefix2 + "playlist_id = ANY($1) AND eggs_id = ANY($2)"
 		args = append(args, playlistIDs, eggsIDs)
 	}
-	args = append(args, paginator.Limit, paginator.Offset)
+	args = append(args, viewerID)
+	visible := visibleTo("ul.eggs_id", "playlists_private", fmt.Sprintf("$%d", len(args)))
+	query += " AND " + visible
+	query2 += " AND " + visible
+	query, pageArgs, err := paginator.paginate(query, args, "ul.last_modified", "ul.playlist_id")
+	if err != nil {
+		return
+	}
 	rawPlaylists := make(rawPlaylists, 0)
 	tx, err := fetchTransaction()
 	if err != nil {
@@ -133,24 +144,30 @@ func GetPlaylists(ctx context.Context, eggsIDs []string, playlistIDs []string, p
 		tx,
 		&rawPlaylists,
 		query,
-		args...,
+		pageArgs...,
 	)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	var total int64
-	err = tx.QueryRow(ctx, query2, args[:len(args)-2]...).Scan(&total)
+	err = tx.QueryRow(ctx, query2, args...).Scan(&total)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	err = commitTransaction(tx)
 	playlists = rawPlaylists.ToPlaylists(total)
+	if len(rawPlaylists) > 0 {
+		last := rawPlaylists[len(rawPlaylists)-1]
+		playlists.NextCursor = paginator.nextCursor(len(rawPlaylists), last.LastModified, last.PlaylistID)
+	}
 	return
 }
 
-func PostPlaylists(ctx context.Context, eggsID string, playlistInputs []PlaylistInput) (inserted int64, updated int64, err error) {
+// PostPlaylists adds or updates playlists, and returns the timeline items of
+// those that are new or modified.
+func PostPlaylists(ctx context.Context, eggsID string, playlistInputs []PlaylistInput) (inserted int64, updated int64, items []TimelineItem, err error) {
 	playlists := make([][]interface{}, 0)
 	for _, playlist := range playlistInputs {
 		playlists = append(playlists, []interface{}{eggsID, playlist.PlaylistID, playlist.LastModified})
@@ -180,6 +197,16 @@ func PostPlaylists(ctx context.Context, eggsID string, playlistInputs []Playlist
 		RollbackTransaction(tx)
 		return
 	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&items,
+		"SELECT t.eggs_id AS id, 'playlist' AS type, t.playlist_id AS target, t.last_modified AS timestamp FROM _temp_upsert_playlists t WHERE NOT EXISTS (SELECT 1 FROM playlists p WHERE p.playlist_id = t.playlist_id AND p.last_modified = t.last_modified)",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	row := tx.QueryRow(ctx, `
 		WITH t AS (
 			INSERT INTO playlists SELECT * FROM _temp_upsert_playlists ON CONFLICT (playlist_id) DO UPDATE SET last_modified = EXCLUDED.last_modified RETURNING xmax
@@ -191,6 +218,11 @@ func PostPlaylists(ctx context.Context, eggsID string, playlistInputs []Playlist
 		RollbackTransaction(tx)
 		return
 	}
+	err = fanOut(ctx, tx, items)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	err = commitTransaction(tx, "_temp_upsert_playlists")
 	return
 }
@@ -201,9 +233,12 @@ func DeletePlaylists(ctx context.Context, eggsID string, playlistIDs []string) (
 		RollbackTransaction(tx)
 		return
 	}
-	cmd, err := tx.Exec(
+	var deleted []string
+	err = pgxscan.Select(
 		ctx,
-		"DELETE FROM playlists WHERE eggs_id = $1 AND playlist_id = ANY($2)",
+		tx,
+		&deleted,
+		"DELETE FROM playlists WHERE eggs_id = $1 AND playlist_id = ANY($2) RETURNING playlist_id",
 		eggsID,
 		playlistIDs,
 	)
@@ -211,12 +246,19 @@ func DeletePlaylists(ctx context.Context, eggsID string, playlistIDs []string) (
 		RollbackTransaction(tx)
 		return
 	}
-	n = cmd.RowsAffected()
+	err = removeFromTimelines(ctx, tx, "playlist", eggsID, deleted)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	n = int64(len(deleted))
 	err = commitTransaction(tx)
 	return
 }
 
-func PutPlaylists(ctx context.Context, eggsID string, playlistInputs PlaylistInputs) (delta int64, total int64, err error) {
+// PutPlaylists replaces the user's playlists, and returns the timeline items of
+// those that are new or modified.
+func PutPlaylists(ctx context.Context, eggsID string, playlistInputs PlaylistInputs) (delta int64, total int64, items []TimelineItem, err error) {
 
 	playlists := make([][]interface{}, 0)
 	for _, playlist := range playlistInputs {
@@ -250,6 +292,17 @@ func PutPlaylists(ctx context.Context, eggsID string, playlistInputs PlaylistInp
 		return
 	}
 
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&items,
+		"SELECT t.eggs_id AS id, 'playlist' AS type, t.playlist_id AS target, t.last_modified AS timestamp FROM _temp_upsert_playlists t WHERE NOT EXISTS (SELECT 1 FROM playlists p WHERE p.playlist_id = t.playlist_id AND p.last_modified = t.last_modified)",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+
 	var inserted int64
 	var updated int64
 	row := tx.QueryRow(ctx, `
@@ -263,6 +316,11 @@ func PutPlaylists(ctx context.Context, eggsID string, playlistInputs PlaylistInp
 		RollbackTransaction(tx)
 		return
 	}
+	err = fanOut(ctx, tx, items)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	total = inserted + updated
 
 	playlistIDs := make([]string, 0)
@@ -270,13 +328,26 @@ func PutPlaylists(ctx context.Context, eggsID string, playlistInputs PlaylistInp
 		playlistIDs = append(playlistIDs, playlist.PlaylistID)
 	}
 
-	cmd, err := tx.Exec(ctx, "DELETE FROM playlists WHERE eggs_id = $1 AND playlist_id != ALL($2)", eggsID, playlistIDs)
+	var deleted []string
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&deleted,
+		"DELETE FROM playlists WHERE eggs_id = $1 AND playlist_id != ALL($2) RETURNING playlist_id",
+		eggsID,
+		playlistIDs,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = removeFromTimelines(ctx, tx, "playlist", eggsID, deleted)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 
-	delta = inserted - cmd.RowsAffected()
+	delta = inserted - int64(len(deleted))
 	err = commitTransaction(tx, "_temp_upsert_playlists")
 	return
 }
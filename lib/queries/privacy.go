@@ -0,0 +1,90 @@
+package queries
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/georgysavva/scany/pgxscan"
+)
+
+// PrivacySettings hides parts of a user's activity from everyone but
+// themselves. Users without settings share everything.
+type PrivacySettings struct {
+	LikesPrivate     bool `json:"likesPrivate" db:"likes_private"`
+	FollowsPrivate   bool `json:"followsPrivate" db:"follows_private"`
+	PlaylistsPrivate bool `json:"playlistsPrivate" db:"playlists_private"`
+}
+
+// Hides reports whether the settings keep timeline items of itemType private.
+func (s PrivacySettings) Hides(itemType string) bool {
+	switch itemType {
+	case "musiclike", "playlistlike":
+		return s.LikesPrivate
+	case "follow":
+		return s.FollowsPrivate
+	case "playlist":
+		return s.PlaylistsPrivate
+	}
+	return false
+}
+
+// visibleTo returns a condition on rows owned by ownerColumn, which hold only if
+// the owner is the viewer in viewerArg or does not keep privateColumn private.
+func visibleTo(ownerColumn string, privateColumn string, viewerArg string) string {
+	return fmt.Sprintf("(%[1]s = %[3]s OR NOT EXISTS (SELECT 1 FROM user_privacy p WHERE p.eggs_id = %[1]s AND p.%[2]s))", ownerColumn, privateColumn, viewerArg)
+}
+
+// roomVisibleTo is the condition that the viewer in viewerArg may see the room
+// session of ownerColumn, going by its visibilityColumn. Like the room itself,
+// it is seen by its owner, by everyone if public, and by the owner's followers
+// if followers-only.
+func roomVisibleTo(ownerColumn string, visibilityColumn string, viewerArg string) string {
+	return fmt.Sprintf("(%[1]s = %[3]s OR %[2]s = 'public' OR (%[2]s = 'followers' AND EXISTS (SELECT 1 FROM user_follows rf WHERE rf.follower_id = %[3]s AND rf.followee_id = %[1]s)))", ownerColumn, visibilityColumn, viewerArg)
+}
+
+func GetPrivacySettings(ctx context.Context, eggsID string) (settings PrivacySettings, err error) {
+	rawSettings := make([]PrivacySettings, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&rawSettings,
+		"SELECT likes_private, follows_private, playlists_private FROM user_privacy WHERE eggs_id = $1",
+		eggsID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	if len(rawSettings) > 0 {
+		settings = rawSettings[0]
+	}
+	return
+}
+
+func PutPrivacySettings(ctx context.Context, eggsID string, settings PrivacySettings) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO user_privacy (eggs_id, likes_private, follows_private, playlists_private) VALUES ($1, $2, $3, $4) ON CONFLICT (eggs_id) DO UPDATE SET likes_private = EXCLUDED.likes_private, follows_private = EXCLUDED.follows_private, playlists_private = EXCLUDED.playlists_private",
+		eggsID,
+		settings.LikesPrivate,
+		settings.FollowsPrivate,
+		settings.PlaylistsPrivate,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
@@ -0,0 +1,357 @@
+package queries
+
+import (
+	"context"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+)
+
+type rawRoom struct {
+	UserID         int       `db:"user_id"`
+	EggsID         string    `db:"eggs_id"`
+	DisplayName    string    `db:"display_name"`
+	IsArtist       bool      `db:"is_artist"`
+	ImageDataPath  string    `db:"image_data_path"`
+	PrefectureCode int       `db:"prefecture_code"`
+	ProfileText    string    `db:"profile_text"`
+	Title          string    `db:"title"`
+	Blocklist      []string  `db:"blocklist"`
+	Cohosts        []string  `db:"cohosts"`
+	Song           []byte    `db:"song"`
+	Queue          []byte    `db:"queue"`
+	CreatedTime    time.Time `db:"created_time"`
+	InstanceID     string    `db:"instance_id"`
+	Visibility     string    `db:"visibility"`
+	SessionID      int64     `db:"session_id"`
+	Listeners      int       `db:"listeners"`
+	Roster         []string  `db:"roster"`
+}
+type rawRooms []rawRoom
+
+type Room struct {
+	Owner       UserStub
+	Title       string
+	Blocklist   []string
+	Cohosts     []string
+	Song        []byte
+	Queue       []byte
+	CreatedTime time.Time
+	InstanceID  string
+	Visibility  string
+	SessionID   int64
+	Listeners   int
+	Roster      []string
+}
+
+func (r rawRoom) ToRoom() Room {
+	return Room{
+		Owner: UserStub{
+			UserID:         r.UserID,
+			EggsID:         r.EggsID,
+			DisplayName:    r.DisplayName,
+			IsArtist:       r.IsArtist,
+			ImageDataPath:  r.ImageDataPath,
+			PrefectureCode: r.PrefectureCode,
+			ProfileText:    r.ProfileText,
+		},
+		Title:       r.Title,
+		Blocklist:   r.Blocklist,
+		Cohosts:     r.Cohosts,
+		Song:        r.Song,
+		Queue:       r.Queue,
+		CreatedTime: r.CreatedTime,
+		InstanceID:  r.InstanceID,
+		Visibility:  r.Visibility,
+		SessionID:   r.SessionID,
+		Listeners:   r.Listeners,
+		Roster:      r.Roster,
+	}
+}
+
+func (arr rawRooms) ToRooms() (rooms []Room) {
+	rooms = make([]Room, 0)
+	for _, r := range arr {
+		rooms = append(rooms, r.ToRoom())
+	}
+	return
+}
+
+const roomQuery = "SELECT u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, r.title, r.blocklist, r.cohosts, r.song, r.queue, r.created_time, r.instance_id, r.visibility, COALESCE(r.session_id, 0) AS session_id, COALESCE((SELECT SUM(p.listeners) FROM room_presence p WHERE p.owner_id = r.owner_id), 0) AS listeners, COALESCE((SELECT array_agg(DISTINCT l.eggs_id) FROM room_presence p, unnest(p.roster) AS l(eggs_id) WHERE p.owner_id = r.owner_id), '{}') AS roster FROM rooms r INNER JOIN users u ON r.owner_id = u.eggs_id"
+
+func GetRooms(ctx context.Context) (rooms []Room, err error) {
+	rawRooms := make(rawRooms, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&rawRooms,
+		roomQuery,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	rooms = rawRooms.ToRooms()
+	return
+}
+
+// GetRoom returns the room owned by ownerID. If it is not open, the error
+// satisfies pgxscan.NotFound.
+func GetRoom(ctx context.Context, ownerID string) (room Room, err error) {
+	var raw rawRoom
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Get(
+		ctx,
+		tx,
+		&raw,
+		roomQuery+" WHERE r.owner_id = $1",
+		ownerID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	room = raw.ToRoom()
+	return
+}
+
+// GetRoomVisibility returns the visibility of the room of ownerID, or of its
+// last session if it is closed. Owners who never opened a room have a public
+// one.
+func GetRoomVisibility(ctx context.Context, ownerID string) (visibility string, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		"SELECT COALESCE((SELECT visibility FROM rooms WHERE owner_id = $1), (SELECT visibility FROM room_sessions WHERE owner_id = $1 ORDER BY started_time DESC LIMIT 1), 'public')",
+		ownerID,
+	).Scan(&visibility)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+func SaveRoom(ctx context.Context, room Room) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO rooms (owner_id, title, blocklist, song, queue, created_time, instance_id, cohosts, visibility, session_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NULLIF($10, 0)) ON CONFLICT (owner_id) DO UPDATE SET title = EXCLUDED.title, blocklist = EXCLUDED.blocklist, cohosts = EXCLUDED.cohosts, song = EXCLUDED.song, queue = EXCLUDED.queue, instance_id = EXCLUDED.instance_id, visibility = EXCLUDED.visibility, session_id = EXCLUDED.session_id",
+		room.Owner.EggsID,
+		room.Title,
+		room.Blocklist,
+		string(room.Song),
+		string(room.Queue),
+		room.CreatedTime,
+		room.InstanceID,
+		room.Cohosts,
+		room.Visibility,
+		room.SessionID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+func DeleteRoom(ctx context.Context, ownerID string) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM rooms WHERE owner_id = $1",
+		ownerID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// SetRoomPresence records how many listeners an instance has in a room, and who
+// they are, so that both can be combined across instances.
+func SetRoomPresence(ctx context.Context, ownerID string, instanceID string, listeners int, roster []string) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO room_presence (owner_id, instance_id, listeners, roster) SELECT $1, $2, $3, $4 WHERE EXISTS (SELECT 1 FROM rooms WHERE owner_id = $1) ON CONFLICT (owner_id, instance_id) DO UPDATE SET listeners = EXCLUDED.listeners, roster = EXCLUDED.roster",
+		ownerID,
+		instanceID,
+		listeners,
+		roster,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+type rawRoomMessage struct {
+	MessageID      string    `db:"message_id"`
+	OwnerID        string    `db:"owner_id"`
+	UserID         int       `db:"user_id"`
+	EggsID         string    `db:"eggs_id"`
+	DisplayName    string    `db:"display_name"`
+	IsArtist       bool      `db:"is_artist"`
+	ImageDataPath  string    `db:"image_data_path"`
+	PrefectureCode int       `db:"prefecture_code"`
+	ProfileText    string    `db:"profile_text"`
+	Message        string    `db:"message"`
+	Privileged     bool      `db:"privileged"`
+	Blocked        bool      `db:"blocked"`
+	AddedTime      time.Time `db:"added_time"`
+}
+type rawRoomMessages []rawRoomMessage
+
+type RoomMessage struct {
+	ID         string
+	OwnerID    string
+	Sender     UserStub
+	Message    string
+	Privileged bool
+	Blocked    bool
+	Timestamp  time.Time
+}
+
+func (r rawRoomMessage) ToRoomMessage() RoomMessage {
+	return RoomMessage{
+		ID:      r.MessageID,
+		OwnerID: r.OwnerID,
+		Sender: UserStub{
+			UserID:         r.UserID,
+			EggsID:         r.EggsID,
+			DisplayName:    r.DisplayName,
+			IsArtist:       r.IsArtist,
+			ImageDataPath:  r.ImageDataPath,
+			PrefectureCode: r.PrefectureCode,
+			ProfileText:    r.ProfileText,
+		},
+		Message:    r.Message,
+		Privileged: r.Privileged,
+		Blocked:    r.Blocked,
+		Timestamp:  r.AddedTime,
+	}
+}
+
+func (arr rawRoomMessages) ToRoomMessages() (messages []RoomMessage) {
+	messages = make([]RoomMessage, 0)
+	for _, r := range arr {
+		messages = append(messages, r.ToRoomMessage())
+	}
+	return
+}
+
+// Number of chat messages kept for each room. Older ones are deleted as new ones
+// come in.
+const roomMessageLimit = 1000
+
+// InsertRoomMessage saves a chat message, and deletes the room's messages that
+// are no longer among the newest roomMessageLimit.
+func InsertRoomMessage(ctx context.Context, message RoomMessage) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO room_messages (message_id, owner_id, sender_id, message, privileged, blocked, added_time) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+		message.ID,
+		message.OwnerID,
+		message.Sender.EggsID,
+		message.Message,
+		message.Privileged,
+		message.Blocked,
+		message.Timestamp,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM room_messages WHERE owner_id = $1 AND added_time < (SELECT added_time FROM room_messages WHERE owner_id = $1 ORDER BY added_time DESC LIMIT 1 OFFSET $2)",
+		message.OwnerID,
+		roomMessageLimit-1,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// GetRoomMessages pages through the chat history of a room, newest first. It is
+// always cursor based, as new messages would shift any offset.
+func GetRoomMessages(ctx context.Context, ownerID string, paginator Paginator) (messages []RoomMessage, nextCursor string, err error) {
+	if !paginator.IsCursor() {
+		paginator.Cursor = &Cursor{}
+	}
+	query, args, err := paginator.paginate(
+		"SELECT rm.message_id, rm.owner_id, u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, rm.message, rm.privileged, rm.blocked, rm.added_time FROM room_messages rm INNER JOIN users u ON rm.sender_id = u.eggs_id AND rm.owner_id = $1",
+		[]interface{}{ownerID},
+		"rm.added_time",
+		"rm.message_id",
+	)
+	if err != nil {
+		return
+	}
+	rawMessages := make(rawRoomMessages, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&rawMessages,
+		query,
+		args...,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	messages = rawMessages.ToRoomMessages()
+	if len(rawMessages) > 0 {
+		last := rawMessages[len(rawMessages)-1]
+		nextCursor = paginator.nextCursor(len(rawMessages), last.AddedTime, last.MessageID)
+	}
+	return
+}
@@ -0,0 +1,281 @@
+package queries
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+)
+
+type RoomSessionTrack struct {
+	MusicID             string         `json:"musicId" db:"music_id"`
+	Title               string         `json:"title" db:"title"`
+	Artist              string         `json:"artist" db:"artist"`
+	MusicImageDataPath  string         `json:"musicImageDataPath" db:"music_image_data_path"`
+	ArtistImageDataPath string         `json:"artistImageDataPath" db:"artist_image_data_path"`
+	Reactions           map[string]int `json:"reactions" db:"reactions"`
+	Likes               int            `json:"likes" db:"likes"`
+	Skips               int            `json:"skips" db:"skips"`
+	StartedTime         time.Time      `json:"startedTime" db:"started_time"`
+	EndedTime           time.Time      `json:"endedTime" db:"ended_time"`
+}
+
+type rawRoomSessionTrack struct {
+	SessionID int64 `db:"session_id"`
+	RoomSessionTrack
+}
+
+type rawRoomSession struct {
+	SessionID      int64      `db:"session_id"`
+	UserID         int        `db:"user_id"`
+	EggsID         string     `db:"eggs_id"`
+	DisplayName    string     `db:"display_name"`
+	IsArtist       bool       `db:"is_artist"`
+	ImageDataPath  string     `db:"image_data_path"`
+	PrefectureCode int        `db:"prefecture_code"`
+	ProfileText    string     `db:"profile_text"`
+	Title          string     `db:"title"`
+	StartedTime    time.Time  `db:"started_time"`
+	EndedTime      *time.Time `db:"ended_time"`
+	PeakListeners  int        `db:"peak_listeners"`
+	ChatCount      int        `db:"chat_count"`
+}
+type rawRoomSessions []rawRoomSession
+
+// RoomSession is the recap of one time a room was open, from when it was
+// created until it closed. EndedTime is nil while the room is still open.
+type RoomSession struct {
+	ID            int64              `json:"id"`
+	Owner         UserStub           `json:"owner"`
+	Title         string             `json:"title"`
+	StartedTime   time.Time          `json:"startedTime"`
+	EndedTime     *time.Time         `json:"endedTime,omitempty"`
+	PeakListeners int                `json:"peakListeners"`
+	ChatCount     int                `json:"chatCount"`
+	Tracks        []RoomSessionTrack `json:"tracks"`
+}
+
+type RoomSessionPage struct {
+	Sessions   []RoomSession `json:"sessions"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+func (r rawRoomSession) ToRoomSession() RoomSession {
+	return RoomSession{
+		ID: r.SessionID,
+		Owner: UserStub{
+			UserID:         r.UserID,
+			EggsID:         r.EggsID,
+			DisplayName:    r.DisplayName,
+			IsArtist:       r.IsArtist,
+			ImageDataPath:  r.ImageDataPath,
+			PrefectureCode: r.PrefectureCode,
+			ProfileText:    r.ProfileText,
+		},
+		Title:         r.Title,
+		StartedTime:   r.StartedTime,
+		EndedTime:     r.EndedTime,
+		PeakListeners: r.PeakListeners,
+		ChatCount:     r.ChatCount,
+		Tracks:        make([]RoomSessionTrack, 0),
+	}
+}
+
+func (arr rawRoomSessions) ToRoomSessions() (sessions []RoomSession) {
+	sessions = make([]RoomSession, 0)
+	for _, r := range arr {
+		sessions = append(sessions, r.ToRoomSession())
+	}
+	return
+}
+
+// StartRoomSession starts the recap of a room, which is shown to whoever the
+// room's visibility lets in.
+func StartRoomSession(ctx context.Context, ownerID string, title string, visibility string, startedTime time.Time) (sessionID int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		"INSERT INTO room_sessions (owner_id, title, visibility, started_time) VALUES ($1, $2, $3, $4) RETURNING session_id",
+		ownerID,
+		title,
+		visibility,
+		startedTime,
+	).Scan(&sessionID)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+func InsertRoomSessionTrack(ctx context.Context, sessionID int64, track RoomSessionTrack) (err error) {
+	if track.Reactions == nil {
+		track.Reactions = make(map[string]int)
+	}
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO room_session_tracks (session_id, music_id, title, artist, music_image_data_path, artist_image_data_path, reactions, likes, skips, started_time, ended_time) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)",
+		sessionID,
+		track.MusicID,
+		track.Title,
+		track.Artist,
+		track.MusicImageDataPath,
+		track.ArtistImageDataPath,
+		track.Reactions,
+		track.Likes,
+		track.Skips,
+		track.StartedTime,
+		track.EndedTime,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// UpdateRoomSession adds chats to the session's count and raises its peak
+// listeners, so that an instance restarting mid-session can keep counting from
+// zero. The session ends if endedTime is set, and goes on the timelines of the
+// owner's followers unless the room was invite-only.
+func UpdateRoomSession(ctx context.Context, sessionID int64, title string, visibility string, peakListeners int, chats int, endedTime *time.Time) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	var sessions []struct {
+		TimelineItem
+		Visibility string `db:"visibility"`
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&sessions,
+		"UPDATE room_sessions SET title = $2, visibility = $3, peak_listeners = GREATEST(peak_listeners, $4), chat_count = chat_count + $5, ended_time = COALESCE($6, ended_time) WHERE session_id = $1 RETURNING owner_id AS id, 'room' AS type, session_id::text AS target, ended_time AS timestamp, visibility",
+		sessionID,
+		title,
+		visibility,
+		peakListeners,
+		chats,
+		endedTime,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	if endedTime != nil {
+		items := make([]TimelineItem, 0, len(sessions))
+		for _, session := range sessions {
+			if session.Visibility != "invite" {
+				items = append(items, session.TimelineItem)
+			}
+		}
+		err = fanOut(ctx, tx, items)
+		if err != nil {
+			RollbackTransaction(tx)
+			return
+		}
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// SetRoomSessionVisibility keeps the session's visibility in step with its
+// room's.
+func SetRoomSessionVisibility(ctx context.Context, sessionID int64, visibility string) (err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"UPDATE room_sessions SET visibility = $2 WHERE session_id = $1",
+		sessionID,
+		visibility,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// GetRoomSessions returns the sessions hosted by ownerID that viewerID may see,
+// newest first, with the tracks played in each. The owner sees every session,
+// followers also see followers-only ones, and nobody else sees invite-only
+// ones. viewerID is empty for anonymous viewers.
+func GetRoomSessions(ctx context.Context, ownerID string, viewerID string, paginator Paginator) (sessions []RoomSession, nextCursor string, err error) {
+	query, args, err := paginator.paginate(
+		"SELECT s.session_id, u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, s.title, s.started_time, s.ended_time, s.peak_listeners, s.chat_count FROM room_sessions s INNER JOIN users u ON s.owner_id = u.eggs_id AND s.owner_id = $1 WHERE "+roomVisibleTo("s.owner_id", "s.visibility", "$2"),
+		[]interface{}{ownerID, viewerID},
+		"s.started_time",
+		"s.session_id::text",
+	)
+	if err != nil {
+		return
+	}
+	rawSessions := make(rawRoomSessions, 0)
+	rawTracks := make([]rawRoomSessionTrack, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&rawSessions,
+		query,
+		args...,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	sessionIDs := make([]int64, 0, len(rawSessions))
+	for _, session := range rawSessions {
+		sessionIDs = append(sessionIDs, session.SessionID)
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&rawTracks,
+		"SELECT session_id, music_id, title, artist, music_image_data_path, artist_image_data_path, reactions, likes, skips, started_time, ended_time FROM room_session_tracks WHERE session_id = ANY($1) ORDER BY started_time, track_id",
+		sessionIDs,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+
+	sessions = rawSessions.ToRoomSessions()
+	index := make(map[int64]int, len(sessions))
+	for i, session := range sessions {
+		index[session.ID] = i
+	}
+	for _, track := range rawTracks {
+		i := index[track.SessionID]
+		sessions[i].Tracks = append(sessions[i].Tracks, track.RoomSessionTrack)
+	}
+	if len(rawSessions) > 0 {
+		last := rawSessions[len(rawSessions)-1]
+		nextCursor = paginator.nextCursor(len(rawSessions), last.StartedTime, strconv.FormatInt(last.SessionID, 10))
+	}
+	return
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"time"
 
+	"github.com/georgysavva/scany/pgxscan"
 	"github.com/jackc/pgx/v4"
 )
 
@@ -27,7 +28,8 @@ type SearchSongResp struct {
 	TotalCount int        `json:"totalCount"`
 }
 
-func PostSongs(ctx context.Context, songData []SongData) (n int64, err error) {
+// PostSongs adds songs, and returns the timeline items of those that are new.
+func PostSongs(ctx context.Context, songData []SongData) (n int64, items []TimelineItem, err error) {
 	songs := make([][]interface{}, 0)
 	for _, song := range songData {
 		songs = append(songs, []interface{}{song.ArtistData.ArtistName, song.MusicID, song.ReleaseDate})
@@ -57,12 +59,27 @@ func PostSongs(ctx context.Context, songData []SongData) (n int64, err error) {
 		RollbackTransaction(tx)
 		return
 	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&items,
+		"SELECT t.eggs_id AS id, 'music' AS type, t.music_id AS target, t.release_date AS timestamp FROM _temp_upsert_songs t WHERE NOT EXISTS (SELECT 1 FROM songs s WHERE s.eggs_id = t.eggs_id AND s.music_id = t.music_id)",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	cmd, err := tx.Exec(ctx, "INSERT INTO songs SELECT * FROM _temp_upsert_songs ON CONFLICT DO NOTHING")
 	if err != nil {
 		RollbackTransaction(tx)
 		return
 	}
 	n = cmd.RowsAffected()
+	err = fanOut(ctx, tx, items)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	err = commitTransaction(tx, "_temp_upsert_songs")
 	return
 }
@@ -2,6 +2,10 @@ package queries
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
@@ -14,38 +18,205 @@ type TimelineItem struct {
 	Timestamp time.Time `json:"timestamp" db:"timestamp"`
 }
 
-func GetTimeline(ctx context.Context, eggsID string, offset int, limit int) (timeline []TimelineItem, err error) {
-	tx, err := fetchTransaction()
+type TimelinePage struct {
+	Items      []TimelineItem `json:"items"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+type timelineBranch struct {
+	itemType  string
+	id        string
+	target    string
+	timestamp string
+	from      string
+	where     string
+	// Column of user_privacy keeping the items private, if any.
+	private string
+	// Column of the room visibility deciding who sees the items, if any.
+	visibility string
+}
+
+var timelineBranches = []timelineBranch{
+	{"music", "eggs_id", "music_id", "release_date", "songs", "eggs_id = ANY(SELECT id FROM followed_users)", "", ""},
+	{"musiclike", "eggs_id", "target_id", "added_time", "user_likes", "target_type = 'track' AND eggs_id = ANY(SELECT id FROM followed_users)", "likes_private", ""},
+	{"playlist", "eggs_id", "playlist_id", "last_modified", "playlists", "eggs_id = ANY(SELECT id FROM followed_users)", "playlists_private", ""},
+	{"playlistlike", "eggs_id", "target_id", "added_time", "user_likes", "target_type = 'playlist' AND eggs_id = ANY(SELECT id FROM followed_users)", "likes_private", ""},
+	{"follow", "follower_id", "followee_id", "added_time", "user_follows", "follower_id = ANY(SELECT id FROM followed_users)", "follows_private", ""},
+	{"room", "owner_id", "session_id::text", "ended_time", "room_sessions", "ended_time IS NOT NULL AND visibility <> 'invite' AND owner_id = ANY(SELECT id FROM followed_users)", "", "visibility"},
+}
+
+// TimelineFilter narrows down a timeline. Zero values leave it unfiltered.
+type TimelineFilter struct {
+	// Item types to include.
+	Types []string
+	// Followed users to include.
+	Actors []string
+	// Items from at least Since and before Until.
+	Since *time.Time
+	Until *time.Time
+	// Whether to include the user's own actions.
+	IncludeSelf bool
+}
+
+var ErrInvalidTimelineType = errors.New("invalid timeline item type")
+
+// branches returns the branches of the item types the filter asks for.
+func (f TimelineFilter) branches() (branches []timelineBranch, err error) {
+	if len(f.Types) == 0 {
+		return timelineBranches, nil
+	}
+	types := make(map[string]bool, len(f.Types))
+	for _, itemType := range f.Types {
+		types[itemType] = true
+	}
+	for _, branch := range timelineBranches {
+		if types[branch.itemType] {
+			branches = append(branches, branch)
+			delete(types, branch.itemType)
+		}
+	}
+	for itemType := range types {
+		return nil, fmt.Errorf("%w %q", ErrInvalidTimelineType, itemType)
+	}
+	return
+}
+
+// timelineWindow holds the placeholders of the filter's time window, if any.
+type timelineWindow struct {
+	since string
+	until string
+}
+
+// conditions returns the window as conditions on timestampColumn.
+func (w timelineWindow) conditions(timestampColumn string) (conditions string) {
+	if w.since != "" {
+		conditions += " AND " + timestampColumn + " >= " + w.since
+	}
+	if w.until != "" {
+		conditions += " AND " + timestampColumn + " < " + w.until
+	}
+	return
+}
+
+// query returns the branch as a SELECT. In cursor mode every branch is cut down
+// to its own page first, so the sort after the UNION only sees a few rows.
+// Private items, and rooms the viewer in viewerArg may not see, are left out
+// unless they belong to the viewer, or viewerArg is empty.
+func (b timelineBranch) query(cursorMode bool, placeholders string, limitArg string, window timelineWindow, viewerArg string) string {
+	query := fmt.Sprintf("SELECT %s AS id, '%s' AS type, %s AS target, %s AS timestamp FROM %s WHERE %s", b.id, b.itemType, b.target, b.timestamp, b.from, b.where)
+	if viewerArg != "" && b.private != "" {
+		query += " AND " + visibleTo(b.id, b.private, viewerArg)
+	}
+	if viewerArg != "" && b.visibility != "" {
+		query += " AND " + roomVisibleTo(b.id, b.visibility, viewerArg)
+	}
+	query += window.conditions(b.timestamp)
+	if !cursorMode {
+		return query
+	}
+	if placeholders != "" {
+		query += " AND " + after(placeholders, b.timestamp, "'"+b.itemType+"'::text", b.id, b.target)
+	}
+	return "(" + query + orderBy(b.timestamp, b.id, b.target) + " LIMIT " + limitArg + ")"
+}
+
+// GetTimeline returns what the users eggsID follows have been up to, newest
+// first, as seen by viewerID. Every filter is applied inside the branches, so
+// that the rows they leave out are never read.
+func GetTimeline(ctx context.Context, eggsID string, viewerID string, filter TimelineFilter, paginator Paginator) (timeline []TimelineItem, nextCursor string, err error) {
+	branches, err := filter.branches()
+	if err != nil {
+		return
+	}
+
+	args := []interface{}{eggsID, viewerID}
+	viewer := "(SELECT id FROM viewer)"
+	followed := "SELECT followee_id AS id FROM user_follows WHERE follower_id = $1"
+	self := "SELECT $1::text AS id"
+	entries := "SELECT actor_id AS id, item_type AS type, target_id AS target, item_time AS timestamp FROM timeline_entries WHERE owner_id = $1 AND " + entriesVisibleTo(viewer)
+	if len(filter.Actors) > 0 {
+		args = append(args, filter.Actors)
+		followed += fmt.Sprintf(" AND followee_id = ANY($%d)", len(args))
+		self += fmt.Sprintf(" WHERE $1 = ANY($%d)", len(args))
+		entries += fmt.Sprintf(" AND actor_id = ANY($%d)", len(args))
+	}
+	if filter.IncludeSelf {
+		followed += " UNION " + self
+	}
+	// With a fan-out store, only the user's own items come from the branches.
+	if fanOutReads() {
+		followed = self
+		if !filter.IncludeSelf {
+			branches = nil
+		}
+		if len(filter.Types) > 0 {
+			args = append(args, filter.Types)
+			entries += fmt.Sprintf(" AND item_type = ANY($%d)", len(args))
+		}
+	}
+	var window timelineWindow
+	if filter.Since != nil {
+		args = append(args, *filter.Since)
+		window.since = fmt.Sprintf("$%d", len(args))
+	}
+	if filter.Until != nil {
+		args = append(args, *filter.Until)
+		window.until = fmt.Sprintf("$%d", len(args))
+	}
+
+	placeholders, cursorArgs, err := paginator.cursorArgs(len(args)+1, 3)
 	if err != nil {
-		RollbackTransaction(tx)
 		return
 	}
+	args = append(args, cursorArgs...)
+	args = append(args, paginator.Limit)
+	limitArg := fmt.Sprintf("$%d", len(args))
+
+	selects := make([]string, 0, len(branches)+1)
+	for _, branch := range branches {
+		selects = append(selects, branch.query(paginator.IsCursor(), placeholders, limitArg, window, viewer))
+	}
+	if fanOutReads() {
+		entries += window.conditions("item_time")
+		if paginator.IsCursor() {
+			if placeholders != "" {
+				entries += " AND " + after(placeholders, "item_time", "item_type", "actor_id", "target_id")
+			}
+			entries = "(" + entries + orderBy("item_time", "item_type", "actor_id", "target_id") + " LIMIT " + limitArg + ")"
+		}
+		selects = append(selects, entries)
+	}
 
 	query := `
 		WITH followed_users AS (
-			SELECT followee_id AS id FROM user_follows WHERE follower_id = $1
+			` + followed + `
+		), viewer AS (
+			SELECT $2::text AS id
 		)
-		SELECT eggs_id AS id, 'music' AS type, music_id AS target, release_date AS timestamp FROM songs WHERE eggs_id = ANY(SELECT id FROM followed_users)
-		UNION ALL
-		SELECT eggs_id AS id, 'musiclike' AS type, target_id AS target, added_time AS timestamp FROM user_likes WHERE target_type = 'track' AND eggs_id = ANY(SELECT id FROM followed_users)
-		UNION ALL
-		SELECT eggs_id AS id, 'playlist' AS type, playlist_id AS target, last_modified AS timestamp FROM playlists WHERE eggs_id = ANY(SELECT id FROM followed_users)
-		UNION ALL
-		SELECT eggs_id AS id, 'playlistlike' AS type, target_id AS target, added_time AS timestamp FROM user_likes WHERE target_type = 'playlist' AND eggs_id = ANY(SELECT id FROM followed_users)
-		UNION ALL
-		SELECT follower_id AS id, 'follow' AS type, followee_id AS target, added_time AS timestamp FROM user_follows WHERE follower_id = ANY(SELECT id FROM followed_users)
-		ORDER BY timestamp DESC
-		LIMIT $2 OFFSET $3
-	`
+		SELECT * FROM (
+			` + strings.Join(selects, "\n\t\t\tUNION ALL\n\t\t\t") + `
+		) timeline`
+	if placeholders != "" {
+		query += " WHERE " + after(placeholders, "timestamp", "type", "id", "target")
+	}
+	query += orderBy("timestamp", "type", "id", "target") + " LIMIT " + limitArg
+	if !paginator.IsCursor() {
+		args = append(args, paginator.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 
 	err = pgxscan.Select(
 		ctx,
 		tx,
 		&timeline,
 		query,
-		eggsID,
-		limit,
-		offset,
+		args...,
 	)
 	if err != nil {
 		RollbackTransaction(tx)
@@ -53,5 +224,222 @@ func GetTimeline(ctx context.Context, eggsID string, offset int, limit int) (tim
 	}
 
 	err = commitTransaction(tx)
+	if len(timeline) > 0 {
+		last := timeline[len(timeline)-1]
+		nextCursor = paginator.nextCursor(len(timeline), last.Timestamp, last.Type, last.ID, last.Target)
+	}
+	return
+}
+
+// TimelineTarget is what a timeline item is about. When targets are expanded,
+// the field matching the item type is filled in if the target is known: User
+// for follows, Song for music and music likes, Playlist for playlists and
+// playlist likes, and Room for rooms.
+type TimelineTarget struct {
+	ID       string              `json:"id"`
+	User     *UserStub           `json:"user,omitempty"`
+	Song     *TimelineSong       `json:"song,omitempty"`
+	Playlist *StructuredPlaylist `json:"playlist,omitempty"`
+	Room     *RoomSession        `json:"room,omitempty"`
+}
+
+type TimelineSong struct {
+	MusicID     string    `json:"musicId"`
+	ReleaseDate time.Time `json:"releaseDate"`
+	Artist      UserStub  `json:"artist"`
+}
+
+type rawTimelineSong struct {
+	MusicID        string    `db:"music_id"`
+	ReleaseDate    time.Time `db:"release_date"`
+	UserID         int       `db:"user_id"`
+	EggsID         string    `db:"eggs_id"`
+	DisplayName    string    `db:"display_name"`
+	IsArtist       bool      `db:"is_artist"`
+	ImageDataPath  string    `db:"image_data_path"`
+	PrefectureCode int       `db:"prefecture_code"`
+	ProfileText    string    `db:"profile_text"`
+}
+
+func (r rawTimelineSong) ToTimelineSong() TimelineSong {
+	return TimelineSong{
+		MusicID:     r.MusicID,
+		ReleaseDate: r.ReleaseDate,
+		Artist: UserStub{
+			UserID:         r.UserID,
+			EggsID:         r.EggsID,
+			DisplayName:    r.DisplayName,
+			IsArtist:       r.IsArtist,
+			ImageDataPath:  r.ImageDataPath,
+			PrefectureCode: r.PrefectureCode,
+			ProfileText:    r.ProfileText,
+		},
+	}
+}
+
+// ExpandedTimelineItem is one or more timeline items of the same type by the
+// same user. The embedded item is the newest of them, and Targets lists every
+// item's target, newest first.
+type ExpandedTimelineItem struct {
+	TimelineItem
+	Actor   *UserStub        `json:"actor,omitempty"`
+	Count   int              `json:"count"`
+	Targets []TimelineTarget `json:"targets"`
+}
+
+type ExpandedTimelinePage struct {
+	Items      []ExpandedTimelineItem `json:"items"`
+	NextCursor string                 `json:"nextCursor,omitempty"`
+}
+
+// Items are only grouped with ones at most this much newer.
+const timelineGroupWindow = 24 * time.Hour
+
+// GroupTimeline wraps each item for expanding. If aggregate is set, runs of
+// items of the same type by the same user are grouped into one, such as a user
+// liking several tracks in a row.
+func GroupTimeline(items []TimelineItem, aggregate bool) []ExpandedTimelineItem {
+	grouped := make([]ExpandedTimelineItem, 0, len(items))
+	for _, item := range items {
+		if aggregate && len(grouped) > 0 {
+			last := &grouped[len(grouped)-1]
+			if last.ID == item.ID && last.Type == item.Type && last.Timestamp.Sub(item.Timestamp) <= timelineGroupWindow {
+				last.Count++
+				last.Targets = append(last.Targets, TimelineTarget{ID: item.Target})
+				continue
+			}
+		}
+		grouped = append(grouped, ExpandedTimelineItem{
+			TimelineItem: item,
+			Count:        1,
+			Targets:      []TimelineTarget{{ID: item.Target}},
+		})
+	}
+	return grouped
+}
+
+// timelineTargetIDs collects the targets to look up for expanding items.
+type timelineTargetIDs struct {
+	users     []string
+	songs     []string
+	playlists []string
+	sessions  []int64
+}
+
+func (ids *timelineTargetIDs) add(itemType string, target string) {
+	switch itemType {
+	case "follow":
+		ids.users = append(ids.users, target)
+	case "music", "musiclike":
+		ids.songs = append(ids.songs, target)
+	case "playlist", "playlistlike":
+		ids.playlists = append(ids.playlists, target)
+	case "room":
+		session, err := strconv.ParseInt(target, 10, 64)
+		if err == nil {
+			ids.sessions = append(ids.sessions, session)
+		}
+	}
+}
+
+// ExpandTimeline fills in the user behind each item if users is set, and what
+// each item is about if targets is set.
+func ExpandTimeline(ctx context.Context, items []ExpandedTimelineItem, users bool, targets bool) (err error) {
+	var ids timelineTargetIDs
+	for _, item := range items {
+		if users {
+			ids.users = append(ids.users, item.ID)
+		}
+		if targets {
+			for _, target := range item.Targets {
+				ids.add(item.Type, target.ID)
+			}
+		}
+	}
+
+	userStubs := make([]UserStub, 0)
+	songs := make([]rawTimelineSong, 0)
+	playlists := make(rawPlaylists, 0)
+	sessions := make(rawRoomSessions, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	lookups := []struct {
+		dest  interface{}
+		query string
+		ids   interface{}
+		count int
+	}{
+		{&userStubs, "SELECT user_id, eggs_id, display_name, is_artist, image_data_path, prefecture_code, profile_text FROM users WHERE eggs_id = ANY($1)", ids.users, len(ids.users)},
+		{&songs, "SELECT s.music_id, s.release_date, u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text FROM songs s INNER JOIN users u ON s.eggs_id = u.eggs_id AND s.music_id = ANY($1)", ids.songs, len(ids.songs)},
+		{&playlists, "SELECT p.playlist_id, u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, p.last_modified FROM playlists p INNER JOIN users u ON p.eggs_id = u.eggs_id AND p.playlist_id = ANY($1)", ids.playlists, len(ids.playlists)},
+		{&sessions, "SELECT s.session_id, u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, s.title, s.started_time, s.ended_time, s.peak_listeners, s.chat_count FROM room_sessions s INNER JOIN users u ON s.owner_id = u.eggs_id AND s.session_id = ANY($1)", ids.sessions, len(ids.sessions)},
+	}
+	for _, lookup := range lookups {
+		if lookup.count == 0 {
+			continue
+		}
+		err = pgxscan.Select(ctx, tx, lookup.dest, lookup.query, lookup.ids)
+		if err != nil {
+			RollbackTransaction(tx)
+			return
+		}
+	}
+	err = commitTransaction(tx)
+	if err != nil {
+		return
+	}
+
+	userMap := make(map[string]UserStub, len(userStubs))
+	for _, user := range userStubs {
+		userMap[user.EggsID] = user
+	}
+	songMap := make(map[string]TimelineSong, len(songs))
+	for _, song := range songs {
+		songMap[song.MusicID] = song.ToTimelineSong()
+	}
+	playlistMap := make(map[string]StructuredPlaylist, len(playlists))
+	for _, playlist := range playlists {
+		playlistMap[playlist.PlaylistID] = playlist.ToPlaylist()
+	}
+	sessionMap := make(map[string]RoomSession, len(sessions))
+	for _, session := range sessions {
+		sessionMap[strconv.FormatInt(session.SessionID, 10)] = session.ToRoomSession()
+	}
+
+	for i := range items {
+		item := &items[i]
+		if users {
+			if user, ok := userMap[item.ID]; ok {
+				item.Actor = &user
+			}
+		}
+		if !targets {
+			continue
+		}
+		for j := range item.Targets {
+			target := &item.Targets[j]
+			switch item.Type {
+			case "follow":
+				if user, ok := userMap[target.ID]; ok {
+					target.User = &user
+				}
+			case "music", "musiclike":
+				if song, ok := songMap[target.ID]; ok {
+					target.Song = &song
+				}
+			case "playlist", "playlistlike":
+				if playlist, ok := playlistMap[target.ID]; ok {
+					target.Playlist = &playlist
+				}
+			case "room":
+				if session, ok := sessionMap[target.ID]; ok {
+					target.Room = &session
+				}
+			}
+		}
+	}
 	return
 }
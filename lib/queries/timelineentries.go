@@ -0,0 +1,244 @@
+package queries
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+	"github.com/jackc/pgx/v4"
+)
+
+// How timelines are stored, set with TIMELINE_STORE.
+const (
+	// Timelines are put together from the source tables on every request. This
+	// is the default.
+	TimelineStoreUnion = "union"
+	// timeline_entries is kept up to date as well, so that it can be backfilled
+	// and checked before reading from it.
+	TimelineStoreFanoutWrite = "fanout-write"
+	// timeline_entries is kept up to date and timelines are read from it.
+	TimelineStoreFanout = "fanout"
+)
+
+var timelineStore = os.Getenv("TIMELINE_STORE")
+
+// fanOutWrites reports whether writes go to timeline_entries. Each user has the
+// items of everyone they follow there, but not their own.
+func fanOutWrites() bool {
+	return timelineStore == TimelineStoreFanoutWrite || timelineStore == TimelineStoreFanout
+}
+
+func fanOutReads() bool {
+	return timelineStore == TimelineStoreFanout
+}
+
+// timelineSource selects every item of the users in followed_users, which the
+// query must define.
+func timelineSource() string {
+	selects := make([]string, 0, len(timelineBranches))
+	for _, branch := range timelineBranches {
+		selects = append(selects, branch.query(false, "", "", timelineWindow{}, ""))
+	}
+	return strings.Join(selects, " UNION ALL ")
+}
+
+// entriesVisibleTo is the condition of timelineBranch.query on private items
+// and room visibility for timeline_entries, which holds every item type. Rooms
+// are looked up as they are now, as their visibility can change after the
+// entries are written.
+func entriesVisibleTo(viewerArg string) string {
+	private := make([]string, 0, len(timelineBranches))
+	var visible string
+	for _, branch := range timelineBranches {
+		if branch.private != "" {
+			private = append(private, fmt.Sprintf("(item_type = '%s' AND p.%s)", branch.itemType, branch.private))
+		}
+		if branch.visibility != "" {
+			visible += fmt.Sprintf(" AND (item_type <> '%s' OR EXISTS (SELECT 1 FROM %s v WHERE v.%s = target_id AND %s))", branch.itemType, branch.from, branch.target, roomVisibleTo("v."+branch.id, "v."+branch.visibility, viewerArg))
+		}
+	}
+	return fmt.Sprintf("((actor_id = %s OR NOT EXISTS (SELECT 1 FROM user_privacy p WHERE p.eggs_id = actor_id AND (%s)))%s)", viewerArg, strings.Join(private, " OR "), visible)
+}
+
+const upsertTimelineEntries = " ON CONFLICT (owner_id, item_type, actor_id, target_id) DO UPDATE SET item_time = EXCLUDED.item_time"
+
+// fanOut adds items to the timelines of their actors' followers.
+func fanOut(ctx context.Context, tx pgx.Tx, items []TimelineItem) (err error) {
+	if !fanOutWrites() || len(items) == 0 {
+		return
+	}
+	ids := make([]string, 0, len(items))
+	types := make([]string, 0, len(items))
+	targets := make([]string, 0, len(items))
+	timestamps := make([]time.Time, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+		types = append(types, item.Type)
+		targets = append(targets, item.Target)
+		timestamps = append(timestamps, item.Timestamp)
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO timeline_entries (owner_id, actor_id, item_type, target_id, item_time) SELECT f.follower_id, i.id, i.type, i.target, i.timestamp FROM unnest($1::text[], $2::text[], $3::text[], $4::timestamptz[]) AS i(id, type, target, timestamp) INNER JOIN user_follows f ON f.followee_id = i.id"+upsertTimelineEntries,
+		ids,
+		types,
+		targets,
+		timestamps,
+	)
+	return
+}
+
+// removeFromTimelines takes the actor's items of itemType about targets off
+// every timeline.
+func removeFromTimelines(ctx context.Context, tx pgx.Tx, itemType string, actorID string, targetIDs []string) (err error) {
+	if !fanOutWrites() || len(targetIDs) == 0 {
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM timeline_entries WHERE actor_id = $1 AND item_type = $2 AND target_id = ANY($3)",
+		actorID,
+		itemType,
+		targetIDs,
+	)
+	return
+}
+
+// addFollowees puts everything the followees have done on the follower's
+// timeline.
+func addFollowees(ctx context.Context, tx pgx.Tx, followerID string, followeeIDs []string) (err error) {
+	if !fanOutWrites() || len(followeeIDs) == 0 {
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"WITH followed_users AS (SELECT unnest($2::text[]) AS id) INSERT INTO timeline_entries (owner_id, actor_id, item_type, target_id, item_time) SELECT $1, id, type, target, timestamp FROM ("+timelineSource()+") source"+upsertTimelineEntries,
+		followerID,
+		followeeIDs,
+	)
+	return
+}
+
+// removeFollowees takes the followees' items off the follower's timeline.
+func removeFollowees(ctx context.Context, tx pgx.Tx, followerID string, followeeIDs []string) (err error) {
+	if !fanOutWrites() || len(followeeIDs) == 0 {
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM timeline_entries WHERE owner_id = $1 AND actor_id = ANY($2)",
+		followerID,
+		followeeIDs,
+	)
+	return
+}
+
+// addFollows adds a follow to the timelines of the follower's followers, and the
+// followees' items to the follower's timeline.
+func addFollows(ctx context.Context, tx pgx.Tx, followerID string, items []TimelineItem) (err error) {
+	err = fanOut(ctx, tx, items)
+	if err != nil {
+		return
+	}
+	followeeIDs := make([]string, 0, len(items))
+	for _, item := range items {
+		followeeIDs = append(followeeIDs, item.Target)
+	}
+	return addFollowees(ctx, tx, followerID, followeeIDs)
+}
+
+// removeFollows undoes addFollows.
+func removeFollows(ctx context.Context, tx pgx.Tx, followerID string, followeeIDs []string) (err error) {
+	err = removeFromTimelines(ctx, tx, "follow", followerID, followeeIDs)
+	if err != nil {
+		return
+	}
+	return removeFollowees(ctx, tx, followerID, followeeIDs)
+}
+
+// GetTimelineOwners returns the users who should have a timeline, and those who
+// have one stored.
+func GetTimelineOwners(ctx context.Context) (owners []string, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&owners,
+		"SELECT follower_id FROM user_follows UNION SELECT owner_id FROM timeline_entries ORDER BY 1",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// RebuildTimeline replaces the stored timeline of ownerID with one put together
+// from the source tables, and returns how many items it has.
+func RebuildTimeline(ctx context.Context, ownerID string) (n int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM timeline_entries WHERE owner_id = $1",
+		ownerID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	cmd, err := tx.Exec(
+		ctx,
+		"WITH followed_users AS (SELECT followee_id AS id FROM user_follows WHERE follower_id = $1) INSERT INTO timeline_entries (owner_id, actor_id, item_type, target_id, item_time) SELECT $1, id, type, target, timestamp FROM ("+timelineSource()+") source"+upsertTimelineEntries,
+		ownerID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	n = cmd.RowsAffected()
+	err = commitTransaction(tx)
+	return
+}
+
+// CheckTimeline compares the stored timeline of ownerID with the one put
+// together from the source tables. Missing items are only in the source tables,
+// and extra items only in the stored timeline.
+func CheckTimeline(ctx context.Context, ownerID string) (missing int64, extra int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = tx.QueryRow(
+		ctx,
+		`WITH followed_users AS (
+			SELECT followee_id AS id FROM user_follows WHERE follower_id = $1
+		), expected AS (
+			`+timelineSource()+`
+		), stored AS (
+			SELECT actor_id AS id, item_type AS type, target_id AS target, item_time AS timestamp FROM timeline_entries WHERE owner_id = $1
+		)
+		SELECT
+			(SELECT COUNT(*) FROM (SELECT * FROM expected EXCEPT SELECT * FROM stored) m),
+			(SELECT COUNT(*) FROM (SELECT * FROM stored EXCEPT SELECT * FROM expected) e)`,
+		ownerID,
+	).Scan(&missing, &extra)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
@@ -184,7 +184,7 @@ func PostUserStubs(ctx context.Context, users []UserStub) (inserted int64, updat
 	return
 }
 
-func InsertUser(ctx context.Context, user User, token string) (err error) {
+func InsertUser(ctx context.Context, user User) (err error) {
 	tx, err := fetchTransaction()
 	if err != nil {
 		RollbackTransaction(tx)
@@ -193,7 +193,7 @@ func InsertUser(ctx context.Context, user User, token string) (err error) {
 
 	_, err = tx.Exec(
 		ctx,
-		"INSERT INTO users (user_id, eggs_id, display_name, is_artist, image_data_path, prefecture_code, profile_text, token) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		"INSERT INTO users (user_id, eggs_id, display_name, is_artist, image_data_path, prefecture_code, profile_text) VALUES ($1, $2, $3, $4, $5, $6, $7)",
 		user.UserID,
 		user.EggsID,
 		user.DisplayName,
@@ -201,27 +201,6 @@ func InsertUser(ctx context.Context, user User, token string) (err error) {
 		user.ImageDataPath,
 		user.PrefectureCode,
 		user.ProfileText,
-		token,
-	)
-	if err != nil {
-		RollbackTransaction(tx)
-		return
-	}
-	err = commitTransaction(tx)
-	return
-}
-
-func UpdateUserToken(ctx context.Context, user User, token string) (err error) {
-	tx, err := fetchTransaction()
-	if err != nil {
-		RollbackTransaction(tx)
-		return
-	}
-	_, err = tx.Exec(
-		ctx,
-		"UPDATE users SET token = $1 WHERE eggs_id = $2",
-		token,
-		user.EggsID,
 	)
 	if err != nil {
 		RollbackTransaction(tx)
@@ -278,47 +257,17 @@ func GetUsers(ctx context.Context, eggsids []string, userids []int) (output []Us
 	return
 }
 
-func GetUserStubFromToken(ctx context.Context, token string) (output []UserStub, err error) {
-	tx, err := fetchTransaction()
-	if err != nil {
-		RollbackTransaction(tx)
-		return
-	}
-	err = pgxscan.Select(
-		ctx,
-		tx,
-		&output,
-		"SELECT user_id, eggs_id, display_name, is_artist, image_data_path, prefecture_code, profile_text FROM users WHERE token = $1",
-		token,
-	)
-	if err != nil {
-		RollbackTransaction(tx)
-		return
-	}
-	err = commitTransaction(tx)
-	return
-}
-
+// GetEggsIDByToken returns the user a session or access token belongs to, if it
+// has not expired.
 func GetEggsIDByToken(ctx context.Context, token string) (eggsID string, err error) {
-	tx, err := fetchTransaction()
-	if err != nil {
-		RollbackTransaction(tx)
-		return
-	}
-	err = tx.QueryRow(
-		ctx,
-		"SELECT eggs_id FROM users WHERE token = $1",
-		token,
-	).Scan(&eggsID)
-	if err != nil {
-		RollbackTransaction(tx)
-		return
-	}
-	err = commitTransaction(tx)
+	grant, err := GetTokenGrant(ctx, token)
+	eggsID = grant.EggsID
 	return
 }
 
-func GetUserCredentials(ctx context.Context, user User) (eggsID string, token string, err error) {
+// GetUserAuthStatus returns the eggsID of the user if they are known, and
+// whether they have logged in before.
+func GetUserAuthStatus(ctx context.Context, user User) (eggsID string, hasSession bool, err error) {
 	tx, err := fetchTransaction()
 	if err != nil {
 		RollbackTransaction(tx)
@@ -326,9 +275,9 @@ func GetUserCredentials(ctx context.Context, user User) (eggsID string, token st
 	}
 	err = tx.QueryRow(
 		ctx,
-		"SELECT eggs_id, token FROM users WHERE eggs_id = $1",
+		"SELECT u.eggs_id, EXISTS (SELECT 1 FROM sessions s WHERE s.eggs_id = u.eggs_id) FROM users u WHERE u.eggs_id = $1",
 		user.EggsID,
-	).Scan(&eggsID, &token)
+	).Scan(&eggsID, &hasSession)
 	if err != nil {
 		RollbackTransaction(tx)
 		return
@@ -363,7 +312,7 @@ func GetAuthenticatedUserCount(ctx context.Context) (n int64, err error) {
 	}
 	err = tx.QueryRow(
 		ctx,
-		"SELECT COUNT(*) FROM users WHERE token != ''",
+		"SELECT COUNT(DISTINCT eggs_id) FROM sessions",
 	).Scan(&n)
 	if err != nil {
 		RollbackTransaction(tx)
@@ -379,6 +328,16 @@ func UNSAFEDeleteUser(ctx context.Context, eggsID string) (err error) {
 		RollbackTransaction(tx)
 		return
 	}
+	// Entries about the user as a target are not covered by foreign keys.
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM timeline_entries WHERE item_type = 'follow' AND target_id = $1",
+		eggsID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
 	_, err = tx.Exec(
 		ctx,
 		"DELETE FROM users WHERE eggs_id = $1",
@@ -0,0 +1,254 @@
+package queries
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+)
+
+const (
+	// Time a token works for before it has to be refreshed.
+	tokenLifetime = 30 * 24 * time.Hour
+
+	// Time a refresh token works for, after which the user has to log in again.
+	refreshTokenLifetime = 180 * 24 * time.Hour
+)
+
+var ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+
+// tokenHashKey keys the hashes tokens are stored as, so that a copy of the
+// database is not enough to check guesses against them. It must stay the same
+// for tokens to keep working. services.Start refuses to run without it outside
+// of tests.
+var tokenHashKey = []byte(os.Getenv("TOKEN_HASH_KEY"))
+
+// hashToken returns what token is stored and looked up as. Tokens are random,
+// so a single keyed hash is enough.
+func hashToken(token string) string {
+	mac := hmac.New(sha256.New, tokenHashKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// UserSession is a device the user is logged in on.
+type UserSession struct {
+	ID         int64     `json:"id" db:"session_id"`
+	DeviceID   string    `json:"deviceId" db:"device_id"`
+	DeviceName string    `json:"deviceName" db:"device_name"`
+	Created    time.Time `json:"created" db:"created_time"`
+	LastUsed   time.Time `json:"lastUsed" db:"last_used_time"`
+	Expires    time.Time `json:"expires" db:"expires_time"`
+}
+
+// SessionTokens are handed out when a session starts or is refreshed. Using the
+// refresh token replaces both tokens. Only their hashes are stored, so this is
+// the one time they can be seen.
+type SessionTokens struct {
+	UserSession
+	Token          string    `json:"token" db:"-"`
+	RefreshToken   string    `json:"refreshToken" db:"-"`
+	RefreshExpires time.Time `json:"refreshExpires" db:"refresh_expires_time"`
+}
+
+const sessionTokensColumns = "session_id, device_id, device_name, created_time, last_used_time, expires_time, refresh_expires_time"
+
+func generateSessionTokens() (token string, refreshToken string, err error) {
+	token, err = GenerateRandomString(64)
+	if err != nil {
+		return
+	}
+	refreshToken, err = GenerateRandomString(64)
+	return
+}
+
+// StartSession logs eggsID in on a device, replacing the tokens of any session
+// it already had there. Sessions that can no longer be used are cleared out.
+func StartSession(ctx context.Context, eggsID string, deviceID string, deviceName string) (tokens SessionTokens, err error) {
+	token, refreshToken, err := generateSessionTokens()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"DELETE FROM sessions WHERE eggs_id = $1 AND expires_time <= NOW() AND (refresh_expires_time IS NULL OR refresh_expires_time <= NOW())",
+		eggsID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Get(
+		ctx,
+		tx,
+		&tokens,
+		`INSERT INTO sessions (eggs_id, device_id, device_name, token_hash, refresh_token_hash, expires_time, refresh_expires_time) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (eggs_id, device_id) DO UPDATE SET device_name = EXCLUDED.device_name, token = NULL, token_hash = EXCLUDED.token_hash, refresh_token = NULL, refresh_token_hash = EXCLUDED.refresh_token_hash, created_time = NOW(), last_used_time = NOW(), expires_time = EXCLUDED.expires_time, refresh_expires_time = EXCLUDED.refresh_expires_time
+		RETURNING `+sessionTokensColumns,
+		eggsID,
+		deviceID,
+		deviceName,
+		hashToken(token),
+		hashToken(refreshToken),
+		now.Add(tokenLifetime),
+		now.Add(refreshTokenLifetime),
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	tokens.Token = token
+	tokens.RefreshToken = refreshToken
+	return
+}
+
+// RefreshSession replaces the tokens of the session with refreshToken. The old
+// tokens stop working straight away.
+func RefreshSession(ctx context.Context, refreshToken string) (tokens SessionTokens, err error) {
+	token, newRefreshToken, err := generateSessionTokens()
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Get(
+		ctx,
+		tx,
+		&tokens,
+		"UPDATE sessions SET token = NULL, token_hash = $3, refresh_token = NULL, refresh_token_hash = $4, expires_time = $5, refresh_expires_time = $6, last_used_time = NOW() WHERE (refresh_token_hash = $2 OR refresh_token = $1) AND refresh_expires_time > NOW() RETURNING "+sessionTokensColumns,
+		refreshToken,
+		hashToken(refreshToken),
+		hashToken(token),
+		hashToken(newRefreshToken),
+		now.Add(tokenLifetime),
+		now.Add(refreshTokenLifetime),
+	)
+	if pgxscan.NotFound(err) {
+		err = ErrInvalidRefreshToken
+	}
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	tokens.Token = token
+	tokens.RefreshToken = newRefreshToken
+	return
+}
+
+// GetSessions returns the sessions of eggsID that can still be used, most
+// recently used first.
+func GetSessions(ctx context.Context, eggsID string) (sessions []UserSession, err error) {
+	sessions = make([]UserSession, 0)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&sessions,
+		"SELECT session_id, device_id, device_name, created_time, last_used_time, expires_time FROM sessions WHERE eggs_id = $1 AND (expires_time > NOW() OR refresh_expires_time > NOW()) ORDER BY last_used_time DESC, session_id DESC",
+		eggsID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// DeleteSession logs eggsID out of a session, revoking its tokens.
+func DeleteSession(ctx context.Context, eggsID string, sessionID int64) (n int64, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	cmd, err := tx.Exec(
+		ctx,
+		"DELETE FROM sessions WHERE eggs_id = $1 AND session_id = $2",
+		eggsID,
+		sessionID,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	n = cmd.RowsAffected()
+	err = commitTransaction(tx)
+	return
+}
+
+// HashStoredTokens replaces the tokens still stored in plaintext by their
+// hashes, and returns how many sessions had any.
+func HashStoredTokens(ctx context.Context) (n int64, err error) {
+	var plaintext []struct {
+		ID           int64   `db:"session_id"`
+		Token        *string `db:"token"`
+		RefreshToken *string `db:"refresh_token"`
+	}
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Select(
+		ctx,
+		tx,
+		&plaintext,
+		"SELECT session_id, token, refresh_token FROM sessions WHERE token IS NOT NULL OR refresh_token IS NOT NULL FOR UPDATE",
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	ids := make([]int64, 0, len(plaintext))
+	tokenHashes := make([]*string, 0, len(plaintext))
+	refreshTokenHashes := make([]*string, 0, len(plaintext))
+	for _, session := range plaintext {
+		ids = append(ids, session.ID)
+		tokenHashes = append(tokenHashes, hashStoredToken(session.Token))
+		refreshTokenHashes = append(refreshTokenHashes, hashStoredToken(session.RefreshToken))
+	}
+	cmd, err := tx.Exec(
+		ctx,
+		"UPDATE sessions s SET token = NULL, token_hash = COALESCE(h.token_hash, s.token_hash), refresh_token = NULL, refresh_token_hash = COALESCE(h.refresh_token_hash, s.refresh_token_hash) FROM unnest($1::bigint[], $2::text[], $3::text[]) AS h(session_id, token_hash, refresh_token_hash) WHERE s.session_id = h.session_id",
+		ids,
+		tokenHashes,
+		refreshTokenHashes,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	n = cmd.RowsAffected()
+	err = commitTransaction(tx)
+	return
+}
+
+func hashStoredToken(token *string) *string {
+	if token == nil {
+		return nil
+	}
+	hash := hashToken(*token)
+	return &hash
+}
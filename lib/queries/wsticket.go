@@ -0,0 +1,78 @@
+package queries
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/georgysavva/scany/pgxscan"
+)
+
+// Time a websocket ticket has to be used within.
+const ticketLifetime = 30 * time.Second
+
+var ErrInvalidTicket = errors.New("invalid or expired ticket")
+
+// CreateTicket returns a ticket that opens one websocket with what grant allows.
+// Tickets go in the URL, so they only work once and not for long.
+func CreateTicket(ctx context.Context, grant TokenGrant) (ticket string, expires time.Time, err error) {
+	ticket, err = GenerateRandomString(64)
+	if err != nil {
+		return
+	}
+	expires = time.Now().Add(ticketLifetime)
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM ws_tickets WHERE expires_time <= NOW()")
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		"INSERT INTO ws_tickets (ticket_hash, eggs_id, scopes, is_session, expires_time) VALUES ($1, $2, $3, $4, $5)",
+		hashToken(ticket),
+		grant.EggsID,
+		grant.Scopes,
+		grant.IsSession,
+		expires,
+	)
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
+
+// RedeemTicket uses up ticket, and returns what it allows.
+func RedeemTicket(ctx context.Context, ticket string) (grant TokenGrant, err error) {
+	tx, err := fetchTransaction()
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = pgxscan.Get(
+		ctx,
+		tx,
+		&grant,
+		`WITH t AS (
+			DELETE FROM ws_tickets WHERE ticket_hash = $1 RETURNING eggs_id, scopes, is_session, expires_time
+		)
+		SELECT u.user_id, u.eggs_id, u.display_name, u.is_artist, u.image_data_path, u.prefecture_code, u.profile_text, t.scopes, t.is_session
+		FROM t JOIN users u USING (eggs_id) WHERE t.expires_time > NOW()`,
+		hashToken(ticket),
+	)
+	if pgxscan.NotFound(err) {
+		err = ErrInvalidTicket
+	}
+	if err != nil {
+		RollbackTransaction(tx)
+		return
+	}
+	err = commitTransaction(tx)
+	return
+}
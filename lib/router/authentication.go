@@ -2,8 +2,8 @@ package router
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
@@ -11,94 +11,148 @@ import (
 	"github.com/yayuyokitano/eggshellver/lib/queries"
 )
 
-func AuthenticatePostRequest[V any](r *http.Request, b []byte, v *V) (eggsID string, statusErr *logging.StatusError) {
-	err := json.Unmarshal(b, v)
-	if err != nil {
-		statusErr = logging.SE(http.StatusBadRequest, err)
-		return
-	}
-	eggsID, err = authenticateUser(r.Header.Get("Authorization"))
-	if err != nil {
-		statusErr = logging.SE(http.StatusUnauthorized, err)
-	}
-	return
+// AuthLevel is whether a method needs its requests to be authenticated.
+type AuthLevel int
+
+const (
+	// AuthPublic methods ignore the Authorization header.
+	AuthPublic AuthLevel = iota
+	// AuthOptional methods authenticate requests that have an Authorization
+	// header, and let anonymous ones through.
+	AuthOptional
+	// AuthRequired methods reject requests that are not authenticated.
+	AuthRequired
+)
+
+// AnyScope lets tokens through whatever their scopes, for methods that pass
+// them on to be checked later.
+const AnyScope = "*"
+
+// Auth is what a method needs its requests to be authenticated with.
+type Auth struct {
+	Level AuthLevel
+	// Scope the token has to allow. Only session tokens allow the empty scope.
+	Scope string
 }
 
-func AuthenticateIndividualPostRequest(r *http.Request, b []byte, v ...*string) (eggsID string, statusErr *logging.StatusError) {
-	pathSplit := strings.Split(r.URL.Path, "/")
-	if len(pathSplit) < len(v)+2 {
-		statusErr = logging.SE(http.StatusBadRequest, errors.New("invalid path"))
-		return
+func Optional(scope string) Auth {
+	return Auth{Level: AuthOptional, Scope: scope}
+}
+
+func Required(scope string) Auth {
+	return Auth{Level: AuthRequired, Scope: scope}
+}
+
+// MethodAuth is the Auth of each method of an endpoint. Methods are public
+// unless set.
+type MethodAuth struct {
+	GET    Auth
+	POST   Auth
+	PUT    Auth
+	DELETE Auth
+}
+
+type grantKey struct{}
+
+// Authenticate checks r against auth, and returns it with the grant of its
+// token in its context.
+func Authenticate(r *http.Request, auth Auth) (*http.Request, *logging.StatusError) {
+	if auth.Level == AuthPublic {
+		return r, nil
 	}
-	for i := 0; i < len(v); i++ {
-		*v[i] = pathSplit[i+2]
-		if *v[i] == "" {
-			statusErr = logging.SE(http.StatusBadRequest, errors.New("invalid path"))
-			return
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		if auth.Level == AuthOptional {
+			return r, nil
 		}
+		return r, logging.SE(http.StatusUnauthorized, errors.New("authorization is required"))
 	}
-	eggsID, err := authenticateUser(r.Header.Get("Authorization"))
-	if err != nil {
-		statusErr = logging.SE(http.StatusUnauthorized, err)
+	token, ok := BearerToken(header)
+	if !ok {
+		return r, logging.SE(http.StatusUnauthorized, errors.New("malformed Authorization header, expected a Bearer token"))
 	}
-	return
+	grant, se := authenticateToken(token, auth.Scope)
+	if se != nil {
+		return r, se
+	}
+	return r.WithContext(context.WithValue(r.Context(), grantKey{}, grant)), nil
 }
 
-func AuthenticateDeleteRequest(r *http.Request, v *[]string) (eggsID string, statusErr *logging.StatusError) {
-	*v = queries.GetArray(r.URL.Query(), "target")
-	eggsID, err := authenticateUser(r.Header.Get("Authorization"))
-	if err != nil {
-		statusErr = logging.SE(http.StatusUnauthorized, err)
+// BearerToken returns the token of a "Bearer <token>" Authorization header.
+func BearerToken(header string) (token string, ok bool) {
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
 	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// Grant returns what the token the request is authenticated with allows, if
+// it has one.
+func Grant(r *http.Request) (grant queries.TokenGrant, ok bool) {
+	grant, ok = r.Context().Value(grantKey{}).(queries.TokenGrant)
 	return
 }
 
-func AuthenticateSpecificUser(r *http.Request) (userStub queries.UserStub, se *logging.StatusError) {
-	authSplit := strings.Split(r.URL.Path, "/")
-	user := authSplit[len(authSplit)-2]
+// User returns the user the request is authenticated as, if any.
+func User(r *http.Request) (userStub queries.UserStub, ok bool) {
+	grant, ok := Grant(r)
+	return grant.UserStub, ok
+}
 
-	if user == "" {
-		se = logging.SE(http.StatusBadRequest, errors.New("please specify user to authenticate"))
-		return
-	}
+// EggsID returns the eggsID of the user the request is authenticated as, or an
+// empty eggsID if it is anonymous.
+func EggsID(r *http.Request) string {
+	userStub, _ := User(r)
+	return userStub.EggsID
+}
 
-	userStub, se = UserStubFromToken(r)
-	if se != nil {
+// RequireUser returns the eggsID of the user the request is authenticated as,
+// for methods that cannot be used anonymously.
+func RequireUser(r *http.Request) (eggsID string, se *logging.StatusError) {
+	userStub, ok := User(r)
+	if !ok {
+		se = logging.SE(http.StatusUnauthorized, errors.New("authorization is required"))
 		return
 	}
-	if userStub.EggsID != user {
-		se = logging.SE(http.StatusUnauthorized, errors.New("failed to authenticate user"))
-	}
-
+	eggsID = userStub.EggsID
 	return
 }
 
-func UserStubFromToken(r *http.Request) (userStub queries.UserStub, statusErr *logging.StatusError) {
-	authSplit := strings.Split(r.URL.Path, "/")
-	token := authSplit[len(authSplit)-1]
-
-	userStubs, err := queries.GetUserStubFromToken(context.Background(), token)
-	if err != nil {
-		statusErr = logging.SE(http.StatusUnauthorized, err)
-		return
+// PathParams reads the path segments after the endpoint into v, none of which
+// may be empty.
+func PathParams(r *http.Request, v ...*string) *logging.StatusError {
+	pathSplit := strings.Split(r.URL.Path, "/")
+	if len(pathSplit) < len(v)+2 {
+		return logging.SE(http.StatusBadRequest, errors.New("invalid path"))
 	}
-	if len(userStubs) == 0 {
-		statusErr = logging.SE(http.StatusUnauthorized, errors.New("failed to authenticate user"))
-		return
+	for i := 0; i < len(v); i++ {
+		*v[i] = pathSplit[i+2]
+		if *v[i] == "" {
+			return logging.SE(http.StatusBadRequest, errors.New("invalid path"))
+		}
 	}
-	userStub = userStubs[0]
-	return
+	return nil
 }
 
-func AuthenticateRequestOnly(r *http.Request) (eggsID string, statusErr *logging.StatusError) {
-	eggsID, err := authenticateUser(r.Header.Get("Authorization"))
+func authenticateToken(token string, scope string) (grant queries.TokenGrant, statusErr *logging.StatusError) {
+	grant, err := queries.GetTokenGrant(context.Background(), token)
 	if err != nil {
 		statusErr = logging.SE(http.StatusUnauthorized, err)
+		return
 	}
+	statusErr = checkScope(grant, scope)
 	return
 }
 
-func authenticateUser(bearer string) (eggsID string, err error) {
-	eggsID, err = queries.GetEggsIDByToken(context.Background(), bearer[7:])
-	return
+func checkScope(grant queries.TokenGrant, scope string) *logging.StatusError {
+	if scope != AnyScope && !grant.Allows(scope) {
+		err := fmt.Errorf("token does not have the %s scope", scope)
+		if scope == "" {
+			err = errors.New("only session tokens can be used here")
+		}
+		return logging.SE(http.StatusForbidden, err)
+	}
+	return nil
 }
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	for header, want := range map[string]string{
+		"Bearer abc":   "abc",
+		"bearer abc":   "abc",
+		"Bearer  abc ": "abc",
+	} {
+		token, ok := BearerToken(header)
+		if !ok || token != want {
+			t.Errorf("BearerToken(%q) = %q, %t, want %q", header, token, ok, want)
+		}
+	}
+
+	for _, header := range []string{"", "B", "Bearer", "Bearer ", "Bearer   ", "Basic abc", "abcdefghijk"} {
+		if token, ok := BearerToken(header); ok {
+			t.Errorf("Expected %q to be rejected, got %q", header, token)
+		}
+	}
+}
+
+func TestAuthenticateWithoutToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/likes", nil)
+	_, se := Authenticate(r, Optional("read:likes"))
+	if se != nil {
+		t.Errorf("Expected anonymous request to be allowed, got %v", se.Err)
+	}
+	_, se = Authenticate(r, Required("read:likes"))
+	if se == nil || se.Code != http.StatusUnauthorized {
+		t.Errorf("Expected anonymous request to be unauthorized, got %v", se)
+	}
+	if _, ok := User(r); ok {
+		t.Errorf("Expected anonymous request to have no user")
+	}
+	if _, se := RequireUser(r); se == nil || se.Code != http.StatusUnauthorized {
+		t.Errorf("Expected RequireUser to reject anonymous request, got %v", se)
+	}
+
+	r.Header.Set("Authorization", "short")
+	_, se = Authenticate(r, Auth{})
+	if se != nil {
+		t.Errorf("Expected public method to ignore the Authorization header, got %v", se.Err)
+	}
+	_, se = Authenticate(r, Optional("read:likes"))
+	if se == nil || se.Code != http.StatusUnauthorized {
+		t.Errorf("Expected malformed header to be unauthorized, got %v", se)
+	}
+}
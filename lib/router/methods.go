@@ -14,58 +14,84 @@ import (
 type HTTPImplementer = func(io.Writer, *http.Request, []byte) *logging.StatusError
 type WebSocketEstablisher = func(http.ResponseWriter, *http.Request) *logging.StatusError
 
+// StreamHandler writes a long lived response itself, such as server-sent events.
+type StreamHandler = func(http.ResponseWriter, *http.Request) *logging.StatusError
+
 type Methods struct {
 	GET    HTTPImplementer
 	POST   HTTPImplementer
 	PUT    HTTPImplementer
 	DELETE HTTPImplementer
+	Auth   MethodAuth
 }
 
-func HandleWebsocket(endpoint string, method WebSocketEstablisher) {
+// HandleStream serves GET requests with a handler that is given the response
+// writer directly, rather than having its output buffered and logged.
+func HandleStream(endpoint string, method StreamHandler, auth Auth) {
 	http.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			logging.LogRequest(r, nil)
-			t := time.Now()
-			handleCors(w, r)
-			se := method(w, r)
-			if se != nil {
-				logging.HandleError(*se, r, []byte(""), t)
-				http.Error(w, se.Err.Error(), se.Code)
-				return
-			}
-			logging.LogRequestCompletion(*bytes.NewBuffer([]byte("")), r, t)
-		case "OPTIONS": // CORS preflight request
-			HandleMethod(HandleCORSPreflight, w, r)
-		default:
-			HandleMethod(ReturnMethodNotAllowed, w, r)
-		}
+		serveStream(method, auth, w, r)
 	})
 }
 
+func serveStream(method StreamHandler, auth Auth, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		logging.LogRequest(r, nil)
+		t := time.Now()
+		handleCors(w, r)
+		r, se := Authenticate(r, auth)
+		if se == nil {
+			se = method(w, r)
+		}
+		if se != nil {
+			logging.HandleError(*se, r, []byte(""), t)
+			http.Error(w, se.Err.Error(), se.Code)
+			return
+		}
+		logging.LogRequestCompletion(*bytes.NewBuffer([]byte("")), r, t)
+	case "OPTIONS": // CORS preflight request
+		HandleMethod(HandleCORSPreflight, w, r)
+	default:
+		HandleMethod(ReturnMethodNotAllowed, w, r)
+	}
+}
+
 func Handle(endpoint string, m Methods) {
 	http.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
 		var method HTTPImplementer
+		var auth Auth
 
 		switch r.Method {
 		case "GET":
-			method = m.GET
+			method, auth = m.GET, m.Auth.GET
 		case "POST":
-			method = m.POST
+			method, auth = m.POST, m.Auth.POST
 		case "PUT":
-			method = m.PUT
+			method, auth = m.PUT, m.Auth.PUT
 		case "DELETE":
-			method = m.DELETE
+			method, auth = m.DELETE, m.Auth.DELETE
 		case "OPTIONS": // CORS preflight request
 			method = HandleCORSPreflight
 		default:
 			method = ReturnMethodNotAllowed
 		}
 
-		HandleMethod(method, w, r)
+		HandleAuthenticated(method, auth, w, r)
 	})
 }
 
+// HandleAuthenticated authenticates the request against auth before handling it
+// like HandleMethod.
+func HandleAuthenticated(m HTTPImplementer, auth Auth, w http.ResponseWriter, r *http.Request) {
+	HandleMethod(func(w io.Writer, r *http.Request, b []byte) *logging.StatusError {
+		r, se := Authenticate(r, auth)
+		if se != nil {
+			return se
+		}
+		return m(w, r, b)
+	}, w, r)
+}
+
 func HandleMethod(m HTTPImplementer, w http.ResponseWriter, r *http.Request) {
 	t := time.Now()
 	b, err := io.ReadAll(r.Body)
@@ -11,7 +11,7 @@ func CommitToggling(t *testing.T, r *http.Request, execute HTTPImplementer, toke
 	t.Helper()
 	w := httptest.NewRecorder()
 	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	HandleMethod(execute, w, r)
+	HandleAuthenticated(execute, Required(""), w, r)
 	if w.Code != http.StatusOK {
 		t.Errorf("Status code is %d, want %d", w.Code, http.StatusOK)
 	}
@@ -27,7 +27,7 @@ func CommitMutating(t *testing.T, r *http.Request, execute HTTPImplementer, toke
 	t.Helper()
 	w := httptest.NewRecorder()
 	r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-	HandleMethod(execute, w, r)
+	HandleAuthenticated(execute, Required(""), w, r)
 	if w.Code != http.StatusOK {
 		t.Errorf("Status code is %d, want %d", w.Code, http.StatusOK)
 	}
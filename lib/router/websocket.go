@@ -0,0 +1,113 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
+)
+
+// TokenSubprotocolPrefix marks the subprotocol a websocket client offers its
+// token in, as browsers cannot set the Authorization header on websockets. It
+// has to be offered alongside a subprotocol the server can pick, such as
+// "eggshellver.v2".
+const TokenSubprotocolPrefix = "eggshellver.bearer."
+
+// allowPathTokens keeps the deprecated /ws/join/{room}/{token} form working for
+// clients that have not moved to subprotocols or tickets yet.
+var allowPathTokens = os.Getenv("WS_PATH_TOKENS") == "true"
+
+type wsCredentialsKey struct{}
+
+type wsCredentials struct {
+	ticket    string
+	pathToken string
+}
+
+// HandleWebsocket serves websocket handshakes to endpoint followed by params
+// path segments. Tickets and tokens are taken out of the URL before anything
+// logs it, and are left for AuthenticateWebsocket.
+func HandleWebsocket(endpoint string, params int, method WebSocketEstablisher) {
+	http.HandleFunc(endpoint, func(w http.ResponseWriter, r *http.Request) {
+		serveStream(method, Auth{}, w, takeCredentials(r, endpoint, params))
+	})
+}
+
+func takeCredentials(r *http.Request, endpoint string, params int) *http.Request {
+	var credentials wsCredentials
+	u := *r.URL
+
+	query := u.Query()
+	if query.Has("ticket") {
+		credentials.ticket = query.Get("ticket")
+		query.Del("ticket")
+		u.RawQuery = query.Encode()
+	}
+
+	segments := strings.Split(strings.TrimPrefix(u.Path, endpoint), "/")
+	if len(segments) > params && segments[params] != "" {
+		credentials.pathToken = segments[params]
+		u.Path = endpoint + strings.Join(segments[:params], "/")
+		u.RawPath = ""
+	}
+
+	r = r.WithContext(context.WithValue(r.Context(), wsCredentialsKey{}, credentials))
+	r.URL = &u
+	r.RequestURI = u.RequestURI()
+	return r
+}
+
+// AuthenticateWebsocket returns the user opening a websocket, if what they
+// authenticated with allows scope. The ticket query parameter is tried first,
+// then a token subprotocol, then the deprecated token at the end of the path.
+func AuthenticateWebsocket(r *http.Request, scope string) (userStub queries.UserStub, se *logging.StatusError) {
+	credentials, _ := r.Context().Value(wsCredentialsKey{}).(wsCredentials)
+
+	var grant queries.TokenGrant
+	if credentials.ticket != "" {
+		var err error
+		grant, err = queries.RedeemTicket(context.Background(), credentials.ticket)
+		if errors.Is(err, queries.ErrInvalidTicket) {
+			se = logging.SE(http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			se = logging.SE(http.StatusInternalServerError, err)
+			return
+		}
+		se = checkScope(grant, scope)
+		userStub = grant.UserStub
+		return
+	}
+
+	token, ok := subprotocolToken(r)
+	if !ok && credentials.pathToken != "" {
+		if !allowPathTokens {
+			se = logging.SE(http.StatusUnauthorized, errors.New("tokens in the path are no longer accepted, use a ticket or the token subprotocol"))
+			return
+		}
+		token, ok = credentials.pathToken, true
+	}
+	if !ok {
+		se = logging.SE(http.StatusUnauthorized, errors.New("authorization is required"))
+		return
+	}
+	grant, se = authenticateToken(token, scope)
+	userStub = grant.UserStub
+	return
+}
+
+func subprotocolToken(r *http.Request) (token string, ok bool) {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, TokenSubprotocolPrefix) {
+			token = strings.TrimPrefix(protocol, TokenSubprotocolPrefix)
+			return token, token != ""
+		}
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTakeCredentials(t *testing.T) {
+	r := takeCredentials(httptest.NewRequest("GET", "/ws/join/room/secret?invite=abc&ticket=xyz", nil), "/ws/join/", 1)
+	if r.URL.Path != "/ws/join/room" || r.URL.RawQuery != "invite=abc" || r.RequestURI != "/ws/join/room?invite=abc" {
+		t.Errorf("Expected credentials to be taken out of the URL, got %s", r.RequestURI)
+	}
+	credentials := r.Context().Value(wsCredentialsKey{}).(wsCredentials)
+	if credentials.pathToken != "secret" || credentials.ticket != "xyz" {
+		t.Errorf("Got credentials %+v", credentials)
+	}
+
+	r = takeCredentials(httptest.NewRequest("GET", "/ws/notifications/secret", nil), "/ws/notifications/", 0)
+	if r.URL.Path != "/ws/notifications/" || r.Context().Value(wsCredentialsKey{}).(wsCredentials).pathToken != "secret" {
+		t.Errorf("Expected token to be taken out of %s", r.URL.Path)
+	}
+
+	r = takeCredentials(httptest.NewRequest("GET", "/ws/join/room", nil), "/ws/join/", 1)
+	if r.URL.Path != "/ws/join/room" || r.Context().Value(wsCredentialsKey{}).(wsCredentials) != (wsCredentials{}) {
+		t.Errorf("Expected URL without credentials to be left alone, got %s", r.URL.Path)
+	}
+}
+
+func TestAuthenticateWebsocketWithoutCredentials(t *testing.T) {
+	r := takeCredentials(httptest.NewRequest("GET", "/ws/join/room", nil), "/ws/join/", 1)
+	_, se := AuthenticateWebsocket(r, "rooms:join")
+	if se == nil || se.Code != http.StatusUnauthorized {
+		t.Errorf("Expected websocket without credentials to be unauthorized, got %v", se)
+	}
+
+	if allowPathTokens {
+		t.Skip("WS_PATH_TOKENS is set")
+	}
+	r = takeCredentials(httptest.NewRequest("GET", "/ws/join/room/secret", nil), "/ws/join/", 1)
+	_, se = AuthenticateWebsocket(r, "rooms:join")
+	if se == nil || se.Code != http.StatusUnauthorized {
+		t.Errorf("Expected path token to be rejected, got %v", se)
+	}
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/url"
 	"os"
@@ -12,10 +13,20 @@ import (
 var Pool *pgxpool.Pool
 var IsTesting bool
 
+var ErrNoTokenHashKey = errors.New("TOKEN_HASH_KEY must be set, as tokens are stored hashed with it")
+
+var ErrNoInviteSecret = errors.New("ROOM_INVITE_SECRET must be set with ROOM_BACKEND=postgres, so that every instance accepts the same invite links")
+
 func Start() (err error) {
 	if os.Getenv("TESTING") == "true" {
 		IsTesting = true
 	}
+	if !IsTesting && os.Getenv("TOKEN_HASH_KEY") == "" {
+		return ErrNoTokenHashKey
+	}
+	if !IsTesting && os.Getenv("ROOM_BACKEND") == "postgres" && os.Getenv("ROOM_INVITE_SECRET") == "" {
+		return ErrNoInviteSecret
+	}
 
 	connectionString := fmt.Sprintf("postgresql://%s:%s@db:5432/%s?pool_max_conns=100",
 		os.Getenv("POSTGRES_USER"), url.QueryEscape(os.Getenv("POSTGRES_PASSWORD")), os.Getenv("POSTGRES_DB"))
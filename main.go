@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
@@ -13,13 +16,19 @@ import (
 	"github.com/yayuyokitano/eggshellver/lib/cachecreator"
 	followendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/follow"
 	likeendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/like"
+	notificationendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/notification"
 	playlistendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/playlist"
+	privacyendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/privacy"
+	roomendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/room"
 	"github.com/yayuyokitano/eggshellver/lib/endpoints/timeline"
 	userendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/user"
 	userstubendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/userstub"
 	wsendpoint "github.com/yayuyokitano/eggshellver/lib/endpoints/ws"
+	"github.com/yayuyokitano/eggshellver/lib/eventbus"
 	"github.com/yayuyokitano/eggshellver/lib/hub"
 	"github.com/yayuyokitano/eggshellver/lib/logging"
+	"github.com/yayuyokitano/eggshellver/lib/notifications"
+	"github.com/yayuyokitano/eggshellver/lib/queries"
 	"github.com/yayuyokitano/eggshellver/lib/router"
 	"github.com/yayuyokitano/eggshellver/lib/services"
 )
@@ -32,62 +41,179 @@ func main() {
 		fmt.Println("Migration complete!")
 		return
 	case "createcache":
-		services.Start()
+		startServices()
 		defer services.Stop()
 		go logging.ServeLogs()
 		cachecreator.AttemptRunPartialCache()
 		fmt.Println("Cache creation complete!")
 		return
+	case "backfilltimeline":
+		startServices()
+		defer services.Stop()
+		backfillTimelines()
+		return
+	case "checktimeline":
+		startServices()
+		defer services.Stop()
+		checkTimelines(len(os.Args) > 2 && os.Args[2] == "fix")
+		return
+	case "hashtokens":
+		startServices()
+		defer services.Stop()
+		n, err := queries.HashStoredTokens(context.Background())
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Hashed the tokens of %d sessions!\n", n)
+		return
+	case "schema":
+		b, err := hub.Schema()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(string(b))
+		return
 	case "start":
 		fmt.Println("Starting server...")
 	default:
 		fmt.Println("Invalid command")
 		return
 	}
-	services.Start()
-	hub.Init()
+	startServices()
 	defer services.Stop()
 	fmt.Println("Connected to Postgres!")
 
-	startServer()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	err := hub.Init(ctx)
+	if err != nil {
+		fmt.Println("Failed to restore rooms:", err)
+	}
+	notifications.Init(ctx)
+	eventbus.Init(ctx)
+
+	startServer(ctx)
 }
 
-func startServer() {
+// startServices connects to the database, and exits if the services cannot
+// start.
+func startServices() {
+	err := services.Start()
+	if err != nil {
+		fmt.Println("Failed to start services:", err)
+		os.Exit(1)
+	}
+}
+
+// Time allowed for requests and rooms to finish when shutting down.
+const shutdownTimeout = 10 * time.Second
+
+func startServer(ctx context.Context) {
 	router.Handle("/follows", router.Methods{
 		POST:   followendpoint.Post,
 		GET:    followendpoint.Get,
 		PUT:    followendpoint.Put,
 		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			POST: router.Required(queries.ScopeWriteFollows),
+			GET:  router.Optional(queries.ScopeReadFollows),
+			PUT:  router.Required(queries.ScopeWriteFollows),
+		},
 	})
 	router.Handle("/follow/", router.Methods{
 		POST:   followendpoint.Toggle,
 		GET:    router.ReturnMethodNotAllowed,
 		PUT:    router.ReturnMethodNotAllowed,
 		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			POST: router.Required(queries.ScopeWriteFollows),
+		},
 	})
 	router.Handle("/likes", router.Methods{
 		POST:   likeendpoint.Post,
 		GET:    likeendpoint.Get,
 		PUT:    likeendpoint.Put,
 		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			POST: router.Required(queries.ScopeWriteLikes),
+			GET:  router.Optional(queries.ScopeReadLikes),
+			PUT:  router.Required(queries.ScopeWriteLikes),
+		},
 	})
 	router.Handle("/like/", router.Methods{
 		POST:   likeendpoint.Toggle,
 		GET:    router.ReturnMethodNotAllowed,
 		PUT:    router.ReturnMethodNotAllowed,
 		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			POST: router.Required(queries.ScopeWriteLikes),
+		},
 	})
 	router.Handle("/playlists", router.Methods{
 		POST:   playlistendpoint.Post,
 		GET:    playlistendpoint.Get,
 		PUT:    playlistendpoint.Put,
 		DELETE: playlistendpoint.Delete,
+		Auth: router.MethodAuth{
+			POST:   router.Required(queries.ScopeWritePlaylists),
+			GET:    router.Optional(queries.ScopeReadPlaylists),
+			PUT:    router.Required(queries.ScopeWritePlaylists),
+			DELETE: router.Required(queries.ScopeWritePlaylists),
+		},
 	})
 	router.Handle("/users", router.Methods{
 		POST:   userendpoint.Post,
 		GET:    userendpoint.Get,
 		PUT:    router.ReturnMethodNotAllowed,
 		DELETE: userendpoint.Delete,
+		Auth: router.MethodAuth{
+			DELETE: router.Required(queries.ScopeAccountDelete),
+		},
+	})
+	router.Handle("/sessions", router.Methods{
+		POST:   userendpoint.PostSession,
+		GET:    userendpoint.GetSessions,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			GET: router.Required(queries.ScopeAccountManage),
+		},
+	})
+	router.Handle("/sessions/", router.Methods{
+		POST:   router.ReturnMethodNotAllowed,
+		GET:    router.ReturnMethodNotAllowed,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: userendpoint.DeleteSession,
+		Auth: router.MethodAuth{
+			DELETE: router.Required(queries.ScopeAccountManage),
+		},
+	})
+	router.Handle("/sessions/refresh", router.Methods{
+		POST:   userendpoint.RefreshSession,
+		GET:    router.ReturnMethodNotAllowed,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+	})
+	router.Handle("/tokens", router.Methods{
+		POST:   userendpoint.PostToken,
+		GET:    userendpoint.GetTokens,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			POST: router.Required(queries.ScopeAccountManage),
+			GET:  router.Required(queries.ScopeAccountManage),
+		},
+	})
+	router.Handle("/tokens/", router.Methods{
+		POST:   router.ReturnMethodNotAllowed,
+		GET:    router.ReturnMethodNotAllowed,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: userendpoint.DeleteToken,
+		Auth: router.MethodAuth{
+			DELETE: router.Required(queries.ScopeAccountManage),
+		},
 	})
 	router.Handle("/twitterauth", router.Methods{
 		POST:   userendpoint.PostTwitter,
@@ -106,22 +232,119 @@ func startServer() {
 		GET:    timeline.Get,
 		PUT:    router.ReturnMethodNotAllowed,
 		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			GET: router.Optional(queries.ScopeReadTimeline),
+		},
+	})
+	router.HandleStream("/timeline/stream", timeline.Stream, router.Optional(queries.ScopeReadTimeline))
+	router.Handle("/rooms/history", router.Methods{
+		POST:   router.ReturnMethodNotAllowed,
+		GET:    roomendpoint.GetHistory,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			GET: router.Optional(queries.ScopeRoomsJoin),
+		},
+	})
+	router.Handle("/notifications", router.Methods{
+		POST:   router.ReturnMethodNotAllowed,
+		GET:    notificationendpoint.Get,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			GET: router.Required(queries.ScopeNotifications),
+		},
+	})
+	router.Handle("/notifications/read", router.Methods{
+		POST:   notificationendpoint.MarkRead,
+		GET:    router.ReturnMethodNotAllowed,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			POST: router.Required(queries.ScopeNotifications),
+		},
+	})
+	router.Handle("/privacy", router.Methods{
+		POST:   router.ReturnMethodNotAllowed,
+		GET:    privacyendpoint.Get,
+		PUT:    privacyendpoint.Put,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			GET: router.Required(queries.ScopeAccountPrivacy),
+			PUT: router.Required(queries.ScopeAccountPrivacy),
+		},
 	})
 
-	router.HandleWebsocket("/ws/join/", wsendpoint.Establish)
-	router.HandleWebsocket("/ws/create/", wsendpoint.Create)
+	router.HandleWebsocket("/ws/join/", 1, wsendpoint.Establish)
+	router.HandleWebsocket("/ws/create/", 1, wsendpoint.Create)
+	router.HandleWebsocket("/ws/notifications/", 0, wsendpoint.EstablishNotifications)
+	router.Handle("/ws/ticket", router.Methods{
+		POST:   wsendpoint.PostTicket,
+		GET:    router.ReturnMethodNotAllowed,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			POST: router.Required(router.AnyScope),
+		},
+	})
 	router.Handle("/ws/list", router.Methods{
 		POST:   router.ReturnMethodNotAllowed,
 		GET:    wsendpoint.GetHubs,
 		PUT:    router.ReturnMethodNotAllowed,
 		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			GET: router.Optional(queries.ScopeRoomsJoin),
+		},
+	})
+	router.Handle("/ws/invite/", router.Methods{
+		POST:   wsendpoint.CreateInvite,
+		GET:    router.ReturnMethodNotAllowed,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			POST: router.Required(queries.ScopeRoomsHost),
+		},
+	})
+	router.Handle("/ws/history/", router.Methods{
+		POST:   router.ReturnMethodNotAllowed,
+		GET:    wsendpoint.GetHistory,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
+		Auth: router.MethodAuth{
+			GET: router.Optional(queries.ScopeRoomsJoin),
+		},
+	})
+	router.Handle("/ws/schema", router.Methods{
+		POST:   router.ReturnMethodNotAllowed,
+		GET:    wsendpoint.GetSchema,
+		PUT:    router.ReturnMethodNotAllowed,
+		DELETE: router.ReturnMethodNotAllowed,
 	})
 
 	go logging.ServeLogs()
 	go cachecreator.StartCacheLoop(1 * time.Hour)
 	fmt.Println("===========")
 	fmt.Println("eggshellver v0.1.0")
-	http.ListenAndServe(":10000", nil)
+	server := &http.Server{Addr: ":10000"}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Println(err)
+		}
+	}()
+
+	<-ctx.Done()
+	fmt.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		fmt.Println("Failed to shut down server:", err)
+	}
+	err = hub.Wait(shutdownCtx)
+	if err != nil {
+		fmt.Println("Failed to shut down rooms:", err)
+	}
 }
 
 func performMigration(firstTime bool) {
@@ -157,3 +380,54 @@ func performMigration(firstTime bool) {
 	fmt.Printf("Applied %d migrations!\n", n)
 
 }
+
+// backfillTimelines rebuilds every stored timeline, for switching
+// TIMELINE_STORE over to fan-out.
+func backfillTimelines() {
+	ctx := context.Background()
+	owners, err := queries.GetTimelineOwners(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for i, owner := range owners {
+		n, err := queries.RebuildTimeline(ctx, owner)
+		if err != nil {
+			fmt.Println("Failed to rebuild timeline of", owner, err)
+			continue
+		}
+		fmt.Printf("[%d/%d] %s: %d items\n", i+1, len(owners), owner, n)
+	}
+	fmt.Println("Timeline backfill complete!")
+}
+
+// checkTimelines reports stored timelines that differ from their source tables,
+// rebuilding them if fix is set.
+func checkTimelines(fix bool) {
+	ctx := context.Background()
+	owners, err := queries.GetTimelineOwners(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	inconsistent := 0
+	for _, owner := range owners {
+		missing, extra, err := queries.CheckTimeline(ctx, owner)
+		if err != nil {
+			fmt.Println("Failed to check timeline of", owner, err)
+			continue
+		}
+		if missing == 0 && extra == 0 {
+			continue
+		}
+		inconsistent++
+		fmt.Printf("%s: %d missing, %d extra\n", owner, missing, extra)
+		if fix {
+			_, err = queries.RebuildTimeline(ctx, owner)
+			if err != nil {
+				fmt.Println("Failed to rebuild timeline of", owner, err)
+			}
+		}
+	}
+	fmt.Printf("%d of %d timelines inconsistent\n", inconsistent, len(owners))
+}
@@ -0,0 +1,11 @@
+-- +migrate Up
+CREATE TABLE rooms (
+  owner_id TEXT NOT NULL PRIMARY KEY,
+  title TEXT NOT NULL DEFAULT '',
+  blocklist TEXT[] NOT NULL DEFAULT '{}',
+  song JSONB NOT NULL DEFAULT '{}',
+  created_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (owner_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+-- +migrate Down
+DROP TABLE rooms;
@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE room_messages (
+  message_id TEXT NOT NULL PRIMARY KEY,
+  owner_id TEXT NOT NULL,
+  sender_id TEXT NOT NULL,
+  message TEXT NOT NULL,
+  privileged BOOLEAN NOT NULL DEFAULT FALSE,
+  blocked BOOLEAN NOT NULL DEFAULT FALSE,
+  added_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (owner_id) REFERENCES users (eggs_id) ON DELETE CASCADE,
+  FOREIGN KEY (sender_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+CREATE INDEX room_messages_owner_added_time ON room_messages (owner_id, added_time desc);
+-- +migrate Down
+DROP TABLE room_messages;
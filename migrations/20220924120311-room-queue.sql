@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE rooms ADD COLUMN queue JSONB NOT NULL DEFAULT '[]';
+
+-- +migrate Down
+ALTER TABLE rooms DROP COLUMN queue;
@@ -0,0 +1,21 @@
+-- +migrate Up
+ALTER TABLE rooms ADD COLUMN instance_id TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE room_presence (
+  owner_id TEXT NOT NULL,
+  instance_id TEXT NOT NULL,
+  listeners INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (owner_id, instance_id),
+  FOREIGN KEY (owner_id) REFERENCES rooms (owner_id) ON DELETE CASCADE
+);
+
+CREATE TABLE room_broadcasts (
+  broadcast_id BIGSERIAL PRIMARY KEY,
+  payload TEXT NOT NULL,
+  added_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- +migrate Down
+DROP TABLE room_broadcasts;
+DROP TABLE room_presence;
+ALTER TABLE rooms DROP COLUMN instance_id;
@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE user_blocks (
+  owner_id TEXT NOT NULL,
+  blocked_id TEXT NOT NULL,
+  added_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (owner_id, blocked_id),
+  FOREIGN KEY (owner_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+
+ALTER TABLE rooms ADD COLUMN cohosts TEXT[] NOT NULL DEFAULT '{}';
+
+-- +migrate Down
+ALTER TABLE rooms DROP COLUMN cohosts;
+DROP TABLE user_blocks;
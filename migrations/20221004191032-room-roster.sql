@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE room_presence ADD COLUMN roster TEXT[] NOT NULL DEFAULT '{}';
+
+-- +migrate Down
+ALTER TABLE room_presence DROP COLUMN roster;
@@ -0,0 +1,5 @@
+-- +migrate Up
+ALTER TABLE rooms ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public';
+
+-- +migrate Down
+ALTER TABLE rooms DROP COLUMN visibility;
@@ -0,0 +1,37 @@
+-- +migrate Up
+CREATE TABLE room_sessions (
+  session_id BIGSERIAL PRIMARY KEY,
+  owner_id TEXT NOT NULL,
+  title TEXT NOT NULL DEFAULT '',
+  started_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  ended_time TIMESTAMP(3) WITH TIME ZONE,
+  peak_listeners INTEGER NOT NULL DEFAULT 0,
+  chat_count INTEGER NOT NULL DEFAULT 0,
+  FOREIGN KEY (owner_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+CREATE INDEX room_sessions_owner_started_time ON room_sessions (owner_id, started_time desc);
+CREATE INDEX room_sessions_ended_time ON room_sessions (ended_time desc);
+
+CREATE TABLE room_session_tracks (
+  track_id BIGSERIAL PRIMARY KEY,
+  session_id BIGINT NOT NULL,
+  music_id TEXT NOT NULL,
+  title TEXT NOT NULL DEFAULT '',
+  artist TEXT NOT NULL DEFAULT '',
+  music_image_data_path TEXT NOT NULL DEFAULT '',
+  artist_image_data_path TEXT NOT NULL DEFAULT '',
+  reactions JSONB NOT NULL DEFAULT '{}',
+  likes INTEGER NOT NULL DEFAULT 0,
+  skips INTEGER NOT NULL DEFAULT 0,
+  started_time TIMESTAMP(3) WITH TIME ZONE NOT NULL,
+  ended_time TIMESTAMP(3) WITH TIME ZONE NOT NULL,
+  FOREIGN KEY (session_id) REFERENCES room_sessions (session_id) ON DELETE CASCADE
+);
+CREATE INDEX room_session_tracks_session_started_time ON room_session_tracks (session_id, started_time);
+
+ALTER TABLE rooms ADD COLUMN session_id BIGINT;
+
+-- +migrate Down
+ALTER TABLE rooms DROP COLUMN session_id;
+DROP TABLE room_session_tracks;
+DROP TABLE room_sessions;
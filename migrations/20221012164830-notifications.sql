@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE notifications (
+  notification_id BIGSERIAL PRIMARY KEY,
+  recipient_id TEXT NOT NULL,
+  actor_id TEXT NOT NULL,
+  notification_type TEXT NOT NULL,
+  target_id TEXT NOT NULL DEFAULT '',
+  is_read BOOLEAN NOT NULL DEFAULT FALSE,
+  added_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  FOREIGN KEY (recipient_id) REFERENCES users (eggs_id) ON DELETE CASCADE,
+  FOREIGN KEY (actor_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+CREATE INDEX notifications_recipient_added_time ON notifications (recipient_id, added_time desc, notification_id desc);
+CREATE INDEX notifications_recipient_unread ON notifications (recipient_id) WHERE NOT is_read;
+-- +migrate Down
+DROP TABLE notifications;
@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE timeline_entries (
+  owner_id TEXT NOT NULL,
+  actor_id TEXT NOT NULL,
+  item_type TEXT NOT NULL,
+  target_id TEXT NOT NULL,
+  item_time TIMESTAMP(3) WITH TIME ZONE NOT NULL,
+  PRIMARY KEY (owner_id, item_type, actor_id, target_id),
+  FOREIGN KEY (owner_id) REFERENCES users (eggs_id) ON DELETE CASCADE,
+  FOREIGN KEY (actor_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+CREATE INDEX timeline_entries_owner_item_time ON timeline_entries (owner_id, item_time desc, item_type desc, actor_id desc, target_id desc);
+CREATE INDEX timeline_entries_actor ON timeline_entries (actor_id, item_type, target_id);
+-- +migrate Down
+DROP TABLE timeline_entries;
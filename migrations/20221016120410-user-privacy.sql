@@ -0,0 +1,10 @@
+-- +migrate Up
+CREATE TABLE user_privacy (
+  eggs_id TEXT PRIMARY KEY,
+  likes_private BOOLEAN NOT NULL DEFAULT FALSE,
+  follows_private BOOLEAN NOT NULL DEFAULT FALSE,
+  playlists_private BOOLEAN NOT NULL DEFAULT FALSE,
+  FOREIGN KEY (eggs_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+-- +migrate Down
+DROP TABLE user_privacy;
@@ -0,0 +1,24 @@
+-- +migrate Up
+CREATE TABLE sessions (
+  session_id BIGSERIAL PRIMARY KEY,
+  eggs_id TEXT NOT NULL,
+  device_id TEXT NOT NULL DEFAULT '',
+  device_name TEXT NOT NULL DEFAULT '',
+  token TEXT NOT NULL UNIQUE,
+  refresh_token TEXT UNIQUE,
+  created_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_used_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  expires_time TIMESTAMP(3) WITH TIME ZONE NOT NULL,
+  refresh_expires_time TIMESTAMP(3) WITH TIME ZONE,
+  UNIQUE (eggs_id, device_id),
+  FOREIGN KEY (eggs_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+-- Existing tokens keep working for a while, but cannot be refreshed.
+INSERT INTO sessions (eggs_id, device_name, token, expires_time) SELECT eggs_id, 'Legacy', token, NOW() + INTERVAL '30 days' FROM users WHERE token != '';
+DROP INDEX user_token_index;
+ALTER TABLE users DROP COLUMN token;
+-- +migrate Down
+ALTER TABLE users ADD COLUMN token TEXT NOT NULL DEFAULT '';
+UPDATE users u SET token = s.token FROM (SELECT DISTINCT ON (eggs_id) eggs_id, token FROM sessions ORDER BY eggs_id, last_used_time DESC) s WHERE u.eggs_id = s.eggs_id;
+CREATE INDEX user_token_index ON users (token);
+DROP TABLE sessions;
@@ -0,0 +1,10 @@
+-- +migrate Up
+-- Plaintext tokens are replaced by their hashes on next use, or by running hashtokens.
+ALTER TABLE sessions ADD COLUMN token_hash TEXT UNIQUE;
+ALTER TABLE sessions ADD COLUMN refresh_token_hash TEXT UNIQUE;
+ALTER TABLE sessions ALTER COLUMN token DROP NOT NULL;
+-- +migrate Down
+DELETE FROM sessions WHERE token IS NULL;
+ALTER TABLE sessions ALTER COLUMN token SET NOT NULL;
+ALTER TABLE sessions DROP COLUMN refresh_token_hash;
+ALTER TABLE sessions DROP COLUMN token_hash;
@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE access_tokens (
+  token_id BIGSERIAL PRIMARY KEY,
+  eggs_id TEXT NOT NULL,
+  token_name TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  scopes TEXT[] NOT NULL,
+  created_time TIMESTAMP(3) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_used_time TIMESTAMP(3) WITH TIME ZONE,
+  expires_time TIMESTAMP(3) WITH TIME ZONE,
+  FOREIGN KEY (eggs_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+CREATE INDEX access_tokens_eggs_id ON access_tokens (eggs_id);
+-- +migrate Down
+DROP TABLE access_tokens;
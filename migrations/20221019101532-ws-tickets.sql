@@ -0,0 +1,11 @@
+-- +migrate Up
+CREATE TABLE ws_tickets (
+  ticket_hash TEXT PRIMARY KEY,
+  eggs_id TEXT NOT NULL,
+  scopes TEXT[],
+  is_session BOOLEAN NOT NULL,
+  expires_time TIMESTAMP(3) WITH TIME ZONE NOT NULL,
+  FOREIGN KEY (eggs_id) REFERENCES users (eggs_id) ON DELETE CASCADE
+);
+-- +migrate Down
+DROP TABLE ws_tickets;
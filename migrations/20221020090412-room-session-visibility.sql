@@ -0,0 +1,7 @@
+-- +migrate Up
+ALTER TABLE room_sessions ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public';
+UPDATE room_sessions s SET visibility = r.visibility FROM rooms r WHERE r.session_id = s.session_id;
+DELETE FROM timeline_entries e USING room_sessions s WHERE e.item_type = 'room' AND e.target_id = s.session_id::text AND s.visibility = 'invite';
+
+-- +migrate Down
+ALTER TABLE room_sessions DROP COLUMN visibility;